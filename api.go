@@ -19,6 +19,8 @@
 package udprobe
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"sync"
@@ -33,6 +35,8 @@ type API struct {
 	ts         TagSet
 	handler    *http.ServeMux
 	mutex      sync.RWMutex
+	errs       chan error // For reporting if the server fails
+	wg         sync.WaitGroup
 }
 
 // PromHandler handles requests for Prometheus metrics.
@@ -58,17 +62,72 @@ func (api *API) PromHandler() http.Handler {
 	})
 }
 
+// SummariesHandler responds with the latest summaries as JSON, along with the
+// tags of their destinations. See SummaryFilter for how they can be filtered.
+func (api *API) SummariesHandler(rw http.ResponseWriter, request *http.Request) {
+	filter, err := ParseSummaryFilter(request.URL.Query())
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	api.summarizer.CMutex.RLock()
+	api.mutex.RLock()
+	summaries := make([]*SummaryJSON, 0)
+	for _, summary := range api.summarizer.Cache {
+		tags := api.ts.Get(summary.Pd.DstIP.String())
+		if filter.Matches(summary, tags) {
+			summaries = append(summaries, NewSummaryJSON(summary, tags))
+		}
+	}
+	api.mutex.RUnlock()
+	api.summarizer.CMutex.RUnlock()
+
+	rw.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(rw).Encode(summaries)
+	if err != nil {
+		HandleMinorErrorMsg(err, "failed to write summaries")
+	}
+}
+
+// InfluxHandler responds with the latest summaries in InfluxDB line protocol,
+// filtered the same as by SummariesHandler.
+func (api *API) InfluxHandler(rw http.ResponseWriter, request *http.Request) {
+	filter, err := ParseSummaryFilter(request.URL.Query())
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var buf []byte
+	api.summarizer.CMutex.RLock()
+	api.mutex.RLock()
+	for _, summary := range api.summarizer.Cache {
+		tags := api.ts.Get(summary.Pd.DstIP.String())
+		if filter.Matches(summary, tags) {
+			buf = AppendInfluxLine(buf, summary, tags)
+		}
+	}
+	api.mutex.RUnlock()
+	api.summarizer.CMutex.RUnlock()
+
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, err = rw.Write(buf)
+	if err != nil {
+		HandleMinorErrorMsg(err, "failed to write summaries")
+	}
+}
+
 // StatusHandler acts as a back healthcheck and simply returns 200 OK.
 func (api *API) StatusHandler(rw http.ResponseWriter, request *http.Request) {
 	fmt.Fprintf(rw, "ok")
 }
 
-// Stop will close down the server and cause Run to exit.
+// Stop will close down the server and wait for Run to exit.
 func (api *API) Stop() {
 	err := api.server.Close()
 	if err != nil {
 		HandleMinorErrorMsg(err, "Error stopping API")
 	}
+	api.wg.Wait()
 	LogInfo("API Stopped")
 }
 
@@ -76,7 +135,25 @@ func (api *API) Stop() {
 func (api *API) Run() {
 	// This basically just exists to be consistent with the existing pattern
 	// while also allowing it to be run blocking if desired.
-	go api.RunForever()
+	api.wg.Add(1)
+	go func() {
+		defer api.wg.Done()
+		if err := api.RunForever(); err != nil {
+			reportError(api.errs, err)
+		}
+	}()
+}
+
+// Tags provides a copy of the tags for the key, such as a destination IP,
+// which is empty if there aren't any.
+func (api *API) Tags(key string) Tags {
+	api.mutex.RLock()
+	defer api.mutex.RUnlock()
+	tags := make(Tags, len(api.ts[key]))
+	for k, v := range api.ts[key] {
+		tags[k] = v
+	}
+	return tags
 }
 
 // MergeUpdateTagSet combines a provided TagSet with the existing one
@@ -96,25 +173,32 @@ func (api *API) MergeUpdateTagSet(t TagSet) {
 // RunForever sets up the handlers above and then listens for requests until
 // stopped or a fatal error occurs.
 //
-// Calling this will block until stopped/crashed.
-func (api *API) RunForever() {
+// Calling this will block until stopped/crashed, and returns nil if stopped.
+func (api *API) RunForever() error {
 	// Setup the handlers
 	// TODO(nwinemiller): It might be better to move this elsewhere?
 	api.setupHandlers()
 	err := api.server.ListenAndServe()
 	if err != nil && err != http.ErrServerClosed {
-		HandleFatalErrorMsg(err, "API server failed")
+		return fmt.Errorf("API server failed: %w", err)
 	}
+	return nil
 }
 
 // SetupHandlers attaches the handlers above to the http server mux.
 func (api *API) setupHandlers() {
 	api.handler.HandleFunc("/status", api.StatusHandler)
 	api.handler.Handle("/metrics", api.PromHandler())
+	api.handler.HandleFunc("/summaries", api.SummariesHandler)
+	api.handler.HandleFunc("/influxdata", api.InfluxHandler)
 }
 
 // New returns an initialized API struct.
-func NewAPI(s *Summarizer, t TagSet, addr string) *API {
+//
+// If the server fails while running via Run, the error is sent to errs. Once
+// ctx is done, the server is closed, the same as Stop.
+func NewAPI(ctx context.Context, s *Summarizer, t TagSet, addr string,
+	errs chan error) *API {
 	// TODO(nwinemiller): In the future, make these options that can be provided.
 	handler := http.NewServeMux()
 	server := &http.Server{
@@ -125,5 +209,7 @@ func NewAPI(s *Summarizer, t TagSet, addr string) *API {
 		t = make(TagSet)
 	}
 	RegisterPrometheus() // Register the necessary variables with the Prometheus handler.
-	return &API{summarizer: s, ts: t, handler: handler, server: server}
+	context.AfterFunc(ctx, func() { server.Close() })
+	return &API{summarizer: s, ts: t, handler: handler, server: server,
+		errs: errs}
 }
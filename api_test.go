@@ -1,9 +1,108 @@
 package udprobe
 
 import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 )
 
 func TestStatusHandler(t *testing.T) {
 	// TODO(nwinemiller): Do more intensive mocking and testing in the future.
 }
+
+// exampleSummaries are two summaries from the same source to different
+// destinations, with different ToS.
+var exampleSummaries = []*Summary{
+	{
+		Pd: &PathDist{SrcIP: net.ParseIP("10.0.0.1"), SrcPort: 40000,
+			DstIP: net.ParseIP("10.0.1.1"), DstPort: 8100, Proto: "udp"},
+		RTTAvg:         1.5,
+		RTTPercentiles: []Percentile{{P: 99, Value: 2}},
+		Sent:           10,
+		Lost:           1,
+		Loss:           10,
+	},
+	{
+		Pd: &PathDist{SrcIP: net.ParseIP("10.0.0.1"), SrcPort: 40000,
+			DstIP: net.ParseIP("10.0.1.2"), DstPort: 8100, Proto: "udp"},
+		Tos:  184,
+		Sent: 10,
+	},
+}
+
+func TestSummariesHandler(t *testing.T) {
+	api := &API{
+		summarizer: &Summarizer{Cache: exampleSummaries},
+		ts: TagSet{
+			"10.0.1.1": {"dst_hostname": "reflector-1", "site": "a"},
+			"10.0.1.2": {"dst_hostname": "reflector-2", "site": "a"},
+		},
+	}
+	for _, test := range []struct {
+		query    string
+		expected []string // Of the dst_hostname of each summary
+	}{
+		{"", []string{"reflector-1", "reflector-2"}},
+		{"?dst_ip=10.0.1.2", []string{"reflector-2"}},
+		{"?src_ip=10.0.0.2", nil},
+		{"?tos=184", []string{"reflector-2"}},
+		{"?site=a&dst_hostname=reflector-1", []string{"reflector-1"}},
+		{"?site=b", nil},
+	} {
+		rw := httptest.NewRecorder()
+		api.SummariesHandler(rw, httptest.NewRequest("GET",
+			"/summaries"+test.query, nil))
+		if rw.Code != http.StatusOK {
+			t.Error("Wrong status for", test.query, "Got", rw.Code)
+			continue
+		}
+		var summaries []*SummaryJSON
+		if err := json.Unmarshal(rw.Body.Bytes(), &summaries); err != nil {
+			t.Error("Invalid JSON for", test.query, err)
+			continue
+		}
+		var hostnames []string
+		for _, summary := range summaries {
+			hostnames = append(hostnames, summary.Tags["dst_hostname"])
+		}
+		if len(hostnames) != len(test.expected) {
+			t.Error("Wrong summaries for", test.query, "Got", hostnames,
+				"expected", test.expected)
+			continue
+		}
+		for i := range hostnames {
+			if hostnames[i] != test.expected[i] {
+				t.Error("Wrong summaries for", test.query, "Got", hostnames,
+					"expected", test.expected)
+				break
+			}
+		}
+	}
+
+	for _, query := range []string{"?dst_ip=nope", "?tos=256"} {
+		rw := httptest.NewRecorder()
+		api.SummariesHandler(rw, httptest.NewRequest("GET",
+			"/summaries"+query, nil))
+		if rw.Code != http.StatusBadRequest {
+			t.Error("Expected a bad request for", query, "Got", rw.Code)
+		}
+	}
+}
+
+func TestNewSummaryJSON(t *testing.T) {
+	tags := Tags{"dst_hostname": "reflector-1"}
+	sj := NewSummaryJSON(exampleSummaries[0], tags)
+	if sj.SrcIP != "10.0.0.1" || sj.DstIP != "10.0.1.1" || sj.DstPort != 8100 ||
+		sj.RTTAvg != 1.5 || sj.Loss != 10 {
+		t.Error("Wrong fields. Got", sj)
+	}
+	if len(sj.RTTPercentiles) != 1 || sj.RTTPercentiles[0].Value != 2 {
+		t.Error("Wrong percentiles. Got", sj.RTTPercentiles)
+	}
+	tags["dst_hostname"] = "changed"
+	if sj.Tags["dst_hostname"] != "reflector-1" {
+		t.Error("Tags weren't copied. Got", sj.Tags)
+	}
+}
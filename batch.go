@@ -0,0 +1,239 @@
+// Batched sending and receiving of UDP packets via sendmmsg/recvmmsg.
+package udprobe
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// BatchMessage is a single packet sent or received by a BatchConn.
+type BatchMessage struct {
+	Buf  []byte       // Data to send, or buffer to receive into
+	OOB  []byte       // Control messages to send, or buffer to receive into
+	Addr *net.UDPAddr // Destination when sending, source when receiving
+	N    int          // Bytes of Buf received
+	NN   int          // Bytes of OOB received
+}
+
+// mmsghdr matches struct mmsghdr from sendmmsg(2).
+type mmsghdr struct {
+	Hdr unix.Msghdr
+	Len uint32
+}
+
+// mmsgBuffers holds the syscall structures for one direction of a BatchConn,
+// so they aren't reallocated for each batch.
+type mmsgBuffers struct {
+	hdrs  []mmsghdr
+	iovs  []unix.Iovec
+	names []unix.RawSockaddrAny
+}
+
+// prepare fills in the syscall structures for msgs, and returns the headers
+// to pass to the syscall.
+func (b *mmsgBuffers) prepare(msgs []BatchMessage, family int, send bool) []mmsghdr {
+	if len(msgs) > len(b.hdrs) {
+		msgs = msgs[:len(b.hdrs)]
+	}
+	for i := range msgs {
+		hdr := &b.hdrs[i]
+		*hdr = mmsghdr{}
+		iov := &b.iovs[i]
+		*iov = unix.Iovec{}
+		if len(msgs[i].Buf) > 0 {
+			iov.Base = &msgs[i].Buf[0]
+			iov.SetLen(len(msgs[i].Buf))
+		}
+		hdr.Hdr.Iov = iov
+		hdr.Hdr.SetIovlen(1)
+		if len(msgs[i].OOB) > 0 {
+			hdr.Hdr.Control = &msgs[i].OOB[0]
+			hdr.Hdr.SetControllen(len(msgs[i].OOB))
+		}
+		name := &b.names[i]
+		hdr.Hdr.Name = (*byte)(unsafe.Pointer(name))
+		if send {
+			hdr.Hdr.Namelen = putSockaddr(name, msgs[i].Addr, family)
+		} else {
+			hdr.Hdr.Namelen = unix.SizeofSockaddrAny
+		}
+	}
+	return b.hdrs[:len(msgs)]
+}
+
+// newMmsgBuffers creates mmsgBuffers for up to size messages.
+func newMmsgBuffers(size int) *mmsgBuffers {
+	return &mmsgBuffers{
+		hdrs:  make([]mmsghdr, size),
+		iovs:  make([]unix.Iovec, size),
+		names: make([]unix.RawSockaddrAny, size),
+	}
+}
+
+// BatchConn sends and receives batches of packets on a UDPConn with a single
+// syscall per batch.
+//
+// One goroutine can send while another receives, but neither direction is
+// safe to use from multiple goroutines.
+type BatchConn struct {
+	conn   *net.UDPConn
+	raw    syscall.RawConn
+	family int
+	size   int
+	rx     *mmsgBuffers
+	tx     *mmsgBuffers
+}
+
+// Size provides the maximum number of messages sent or received at once.
+func (bc *BatchConn) Size() int {
+	return bc.size
+}
+
+// ReadBatch receives up to len(msgs) packets, waiting until at least one is
+// available or the read deadline of the conn passes. Returns the number of
+// msgs that were filled in.
+func (bc *BatchConn) ReadBatch(msgs []BatchMessage) (int, error) {
+	hdrs := bc.rx.prepare(msgs, bc.family, false)
+	var n int
+	var opErr error
+	err := bc.raw.Read(func(fd uintptr) bool {
+		n, opErr = mmsg(unix.SYS_RECVMMSG, fd, hdrs, unix.MSG_DONTWAIT)
+		// Returning false waits for the socket to be readable
+		return opErr != unix.EAGAIN
+	})
+	if err == nil {
+		err = opErr
+	}
+	if err != nil {
+		return 0, &net.OpError{Op: "recvmmsg", Net: "udp",
+			Source: bc.conn.LocalAddr(), Err: err}
+	}
+	for i := 0; i < n; i++ {
+		msgs[i].N = int(hdrs[i].Len)
+		msgs[i].NN = int(hdrs[i].Hdr.Controllen)
+		msgs[i].Addr = sockaddrToUDPAddr(&bc.rx.names[i])
+	}
+	return n, nil
+}
+
+// WriteBatch sends all of msgs, in as few syscalls as possible. Returns the
+// number of msgs that were sent, which is only less than len(msgs) along
+// with an error.
+func (bc *BatchConn) WriteBatch(msgs []BatchMessage) (int, error) {
+	sent := 0
+	for sent < len(msgs) {
+		hdrs := bc.tx.prepare(msgs[sent:], bc.family, true)
+		var n int
+		var opErr error
+		err := bc.raw.Write(func(fd uintptr) bool {
+			n, opErr = mmsg(unix.SYS_SENDMMSG, fd, hdrs, unix.MSG_DONTWAIT)
+			// Returning false waits for the socket to be writable
+			return opErr != unix.EAGAIN
+		})
+		if err == nil {
+			err = opErr
+		}
+		if err != nil {
+			return sent, &net.OpError{Op: "sendmmsg", Net: "udp",
+				Source: bc.conn.LocalAddr(), Err: err}
+		}
+		sent += n
+	}
+	return sent, nil
+}
+
+// mmsg makes a sendmmsg or recvmmsg syscall with the hdrs.
+func mmsg(trap uintptr, fd uintptr, hdrs []mmsghdr, flags int) (int, error) {
+	n, _, errno := unix.Syscall6(trap, fd,
+		uintptr(unsafe.Pointer(&hdrs[0])), uintptr(len(hdrs)),
+		uintptr(flags), 0, 0)
+	if errno != 0 {
+		return int(n), errno
+	}
+	return int(n), nil
+}
+
+// putSockaddr fills in name with addr for a socket of the family, and
+// returns its length. IPv4 addrs are mapped for IPv6 sockets.
+func putSockaddr(name *unix.RawSockaddrAny, addr *net.UDPAddr, family int) uint32 {
+	*name = unix.RawSockaddrAny{}
+	if family == unix.AF_INET {
+		sa := (*unix.RawSockaddrInet4)(unsafe.Pointer(name))
+		sa.Family = unix.AF_INET
+		putPort(&sa.Port, addr.Port)
+		copy(sa.Addr[:], addr.IP.To4())
+		return unix.SizeofSockaddrInet4
+	}
+	sa := (*unix.RawSockaddrInet6)(unsafe.Pointer(name))
+	sa.Family = unix.AF_INET6
+	putPort(&sa.Port, addr.Port)
+	copy(sa.Addr[:], addr.IP.To16())
+	if addr.Zone != "" {
+		if iface, err := net.InterfaceByName(addr.Zone); err == nil {
+			sa.Scope_id = uint32(iface.Index)
+		} else if index, err := strconv.Atoi(addr.Zone); err == nil {
+			sa.Scope_id = uint32(index)
+		}
+	}
+	return unix.SizeofSockaddrInet6
+}
+
+// putPort stores port in network byte order.
+func putPort(dst *uint16, port int) {
+	binary.BigEndian.PutUint16((*[2]byte)(unsafe.Pointer(dst))[:], uint16(port))
+}
+
+// sockaddrToUDPAddr converts a received name into a UDPAddr.
+func sockaddrToUDPAddr(name *unix.RawSockaddrAny) *net.UDPAddr {
+	switch name.Addr.Family {
+	case unix.AF_INET:
+		sa := (*unix.RawSockaddrInet4)(unsafe.Pointer(name))
+		port := binary.BigEndian.Uint16((*[2]byte)(unsafe.Pointer(&sa.Port))[:])
+		return &net.UDPAddr{
+			IP:   net.IPv4(sa.Addr[0], sa.Addr[1], sa.Addr[2], sa.Addr[3]),
+			Port: int(port),
+		}
+	case unix.AF_INET6:
+		sa := (*unix.RawSockaddrInet6)(unsafe.Pointer(name))
+		port := binary.BigEndian.Uint16((*[2]byte)(unsafe.Pointer(&sa.Port))[:])
+		addr := &net.UDPAddr{
+			IP:   make(net.IP, net.IPv6len),
+			Port: int(port),
+		}
+		copy(addr.IP, sa.Addr[:])
+		if sa.Scope_id != 0 {
+			addr.Zone = strconv.Itoa(int(sa.Scope_id))
+		}
+		return addr
+	}
+	return nil
+}
+
+// NewBatchConn creates a BatchConn for conn that handles up to size messages
+// at once.
+func NewBatchConn(conn *net.UDPConn, size int) (*BatchConn, error) {
+	if size < 1 {
+		size = 1
+	}
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	family, _, err := SocketFamily(conn)
+	if err != nil {
+		return nil, err
+	}
+	return &BatchConn{
+		conn:   conn,
+		raw:    raw,
+		family: family,
+		size:   size,
+		rx:     newMmsgBuffers(size),
+		tx:     newMmsgBuffers(size),
+	}, nil
+}
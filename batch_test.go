@@ -0,0 +1,105 @@
+package udprobe
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func testBatchConn(t *testing.T, network string, addrStr string) {
+	addr, _ := net.ResolveUDPAddr(network, addrStr)
+	conn, err := net.ListenUDP(network, addr)
+	if err != nil {
+		t.Skip(network, "not available:", err)
+	}
+	defer conn.Close()
+	dst, _ := net.ListenUDP(network, addr)
+	defer dst.Close()
+	sender, err := NewBatchConn(conn, 4)
+	if err != nil {
+		t.Fatal("Failed to create BatchConn:", err)
+	}
+	receiver, _ := NewBatchConn(dst, 8)
+
+	// More than the batch size, so it takes multiple syscalls
+	dstAddr := dst.LocalAddr().(*net.UDPAddr)
+	out := make([]BatchMessage, 6)
+	for i := range out {
+		out[i] = BatchMessage{Buf: []byte(fmt.Sprint("packet ", i)), Addr: dstAddr}
+	}
+	sent, err := sender.WriteBatch(out)
+	if err != nil || sent != len(out) {
+		t.Fatal("Failed to send batch. Sent", sent, "of", len(out), err)
+	}
+
+	in := make([]BatchMessage, receiver.Size())
+	for i := range in {
+		in[i].Buf = make([]byte, 64)
+	}
+	var received []string
+	dst.SetReadDeadline(time.Now().Add(time.Second))
+	for len(received) < len(out) {
+		n, err := receiver.ReadBatch(in)
+		if err != nil {
+			t.Fatal("Failed to receive batch:", err)
+		}
+		for _, msg := range in[:n] {
+			received = append(received, string(msg.Buf[:msg.N]))
+			src := conn.LocalAddr().(*net.UDPAddr)
+			if msg.Addr.Port != src.Port || !msg.Addr.IP.Equal(src.IP) {
+				t.Error("Incorrect source address. Got", msg.Addr, "expected",
+					conn.LocalAddr())
+			}
+		}
+	}
+	for i, data := range received {
+		if data != fmt.Sprint("packet ", i) {
+			t.Error("Incorrect data received. Got", data, "expected packet", i)
+		}
+	}
+
+	// Make sure timeouts look like the rest of net
+	dst.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, err = receiver.ReadBatch(in)
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Error("Expected a timeout error, got", err)
+	}
+}
+
+func TestBatchConnIPv4(t *testing.T) {
+	testBatchConn(t, "udp4", "127.0.0.1:0")
+}
+
+func TestBatchConnIPv6(t *testing.T) {
+	testBatchConn(t, "udp6", "[::1]:0")
+}
+
+func TestBatchConnDualStack(t *testing.T) {
+	// IPv4 addresses need to be mapped for an IPv6 socket
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if family, _, _ := SocketFamily(conn); family != unix.AF_INET6 {
+		t.Skip("Not a dual-stack socket")
+	}
+	dst, _ := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	defer dst.Close()
+	sender, _ := NewBatchConn(conn, 2)
+	_, err = sender.WriteBatch([]BatchMessage{
+		{Buf: []byte("mapped"), Addr: dst.LocalAddr().(*net.UDPAddr)},
+	})
+	if err != nil {
+		t.Fatal("Failed to send to IPv4 addr on IPv6 socket:", err)
+	}
+	buf := make([]byte, 64)
+	dst.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := dst.ReadFromUDP(buf)
+	if err != nil || string(buf[:n]) != "mapped" {
+		t.Error("Packet not received. Got", string(buf[:n]), err)
+	}
+}
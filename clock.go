@@ -0,0 +1,141 @@
+package udprobe
+
+import (
+	"math"
+	"sync"
+)
+
+// DefaultClockFilterSize is the number of samples kept per path, which
+// matches the NTP clock filter.
+const DefaultClockFilterSize = 8
+
+// ClockEstimate is an estimate of how far a reflector's clock is ahead of the
+// collector's.
+type ClockEstimate struct {
+	Offset      float64 // Reflector clock minus collector clock in ms
+	Uncertainty float64 // Bound on the error of Offset in ms
+}
+
+// ClockEstimator maintains NTP-style clock offset estimates between the
+// collector and each reflector.
+//
+// Estimates are kept per path to a reflector, rather than per reflector, so
+// a path with higher delays doesn't share samples with one to the same
+// reflector with lower delays, or from another source IP, which may not even
+// be on the same host. Paths that stop being updated for long enough are
+// removed by Prune.
+//
+// Each probe with reflector timestamps is an exchange of the four timestamps
+// NTP uses, so the offset is ((T2 - T1) + (T3 - T4)) / 2 and the delay is
+// (T4 - T1) - (T3 - T2). The offset is only exact if the forward and reverse
+// delays are equal, and is off by at most half of the delay otherwise. So,
+// like the NTP clock filter, the sample with the lowest delay out of the last
+// few is trusted, and half of its delay is the uncertainty.
+type ClockEstimator struct {
+	mutex   sync.Mutex
+	size    int
+	filters map[string]*clockFilter
+}
+
+// clockSample is a single offset/delay pair, in nanoseconds.
+type clockSample struct {
+	offset float64
+	delay  float64
+}
+
+// clockFilter is a fixed size ring of the most recent samples for a path.
+type clockFilter struct {
+	samples []clockSample
+	next    int
+	idle    int // Prunes since the last sample
+}
+
+// add saves the sample, replacing the oldest once full.
+func (cf *clockFilter) add(sample clockSample, size int) {
+	if len(cf.samples) < size {
+		cf.samples = append(cf.samples, sample)
+		return
+	}
+	cf.samples[cf.next] = sample
+	cf.next = (cf.next + 1) % size
+}
+
+// best returns the sample with the lowest delay.
+func (cf *clockFilter) best() clockSample {
+	best := cf.samples[0]
+	for _, s := range cf.samples[1:] {
+		if s.delay < best.delay {
+			best = s
+		}
+	}
+	return best
+}
+
+// Update adds the lowest delay sample from the provided results to the
+// filter for the path identified by key, and returns the resulting estimate.
+//
+// If none of the results have reflector timestamps, the filter is left as is
+// and false is returned.
+func (ce *ClockEstimator) Update(key string, results []*Result) (ClockEstimate, bool) {
+	sample := clockSample{delay: math.MaxFloat64}
+	found := false
+	for _, r := range results {
+		if !r.OneWay || r.Lost || r.Duplicate {
+			continue
+		}
+		// FwdDelay is T2 - T1 and RevDelay is T4 - T3
+		delay := float64(r.FwdDelay + r.RevDelay)
+		if delay < sample.delay {
+			sample = clockSample{
+				offset: float64(r.FwdDelay-r.RevDelay) / 2.0,
+				delay:  delay,
+			}
+			found = true
+		}
+	}
+	if !found {
+		return ClockEstimate{}, false
+	}
+	ce.mutex.Lock()
+	defer ce.mutex.Unlock()
+	filter, ok := ce.filters[key]
+	if !ok {
+		filter = &clockFilter{}
+		ce.filters[key] = filter
+	}
+	filter.add(sample, ce.size)
+	filter.idle = 0
+	best := filter.best()
+	return ClockEstimate{
+		Offset:      NsToMs(best.offset),
+		Uncertainty: NsToMs(best.delay / 2.0),
+	}, true
+}
+
+// Prune removes the filters for paths that haven't been updated for as many
+// calls as the samples kept per path, such as for targets that were removed,
+// so they don't accumulate. It's meant to be called once per summarization,
+// so a path that has an interval or two without samples, such as from loss,
+// keeps its history.
+func (ce *ClockEstimator) Prune() {
+	ce.mutex.Lock()
+	defer ce.mutex.Unlock()
+	for key, filter := range ce.filters {
+		filter.idle++
+		if filter.idle >= ce.size {
+			delete(ce.filters, key)
+		}
+	}
+}
+
+// NewClockEstimator creates a ClockEstimator that keeps size samples per
+// path.
+func NewClockEstimator(size int) *ClockEstimator {
+	if size < 1 {
+		size = 1
+	}
+	return &ClockEstimator{
+		size:    size,
+		filters: make(map[string]*clockFilter),
+	}
+}
@@ -0,0 +1,75 @@
+package udprobe
+
+import (
+	"testing"
+)
+
+func TestClockEstimatorUpdate(t *testing.T) {
+	ce := NewClockEstimator(2)
+	// Nothing with reflector timestamps, so no estimate
+	_, ok := ce.Update("1.2.3.4", []*Result{{RTT: 1000000}, {Lost: true}})
+	if ok {
+		t.Error("Got an estimate without any reflector timestamps")
+	}
+	// Reflector is 1ms ahead. Symmetric 2ms each way is the best sample, the
+	// other has 4ms of extra reverse queuing skewing its offset.
+	est, ok := ce.Update("1.2.3.4", []*Result{
+		{OneWay: true, FwdDelay: 3000000, RevDelay: 1000000},
+		{OneWay: true, FwdDelay: 3000000, RevDelay: 5000000},
+		{OneWay: true, Duplicate: true, FwdDelay: 1, RevDelay: 1},
+	})
+	if !ok {
+		t.Fatal("Expected an estimate")
+	}
+	if est.Offset != 1.0 || est.Uncertainty != 2.0 {
+		t.Error("Estimate bad. Got", est, "expected offset 1.0 and uncertainty 2.0")
+	}
+	// A worse sample doesn't change the estimate
+	est, _ = ce.Update("1.2.3.4", []*Result{
+		{OneWay: true, FwdDelay: 10000000, RevDelay: 2000000},
+	})
+	if est.Offset != 1.0 {
+		t.Error("Estimate changed from a worse sample. Got", est)
+	}
+	// But it does once the better sample falls out of the filter
+	est, _ = ce.Update("1.2.3.4", []*Result{
+		{OneWay: true, FwdDelay: 10000000, RevDelay: 4000000},
+	})
+	if est.Offset != 4.0 || est.Uncertainty != 6.0 {
+		t.Error("Estimate didn't age out the old sample. Got", est)
+	}
+	// Other reflectors are independent
+	est, _ = ce.Update("5.6.7.8", []*Result{
+		{OneWay: true, FwdDelay: 1000000, RevDelay: 3000000},
+	})
+	if est.Offset != -1.0 {
+		t.Error("Estimate for a new reflector bad. Got", est)
+	}
+}
+
+func TestClockEstimatorPrune(t *testing.T) {
+	ce := NewClockEstimator(3)
+	sample := []*Result{{OneWay: true, FwdDelay: 1000000, RevDelay: 1000000}}
+	ce.Update("a", sample)
+	ce.Update("b", sample)
+	// An interval or two without samples, like from loss, keeps the history
+	ce.Prune()
+	ce.Update("a", sample)
+	ce.Prune()
+	if len(ce.filters) != 2 {
+		t.Error("Recently updated filters pruned. Got", len(ce.filters),
+			"expected", 2)
+	}
+	ce.Update("a", sample)
+	ce.Prune()
+	if _, ok := ce.filters["b"]; ok || len(ce.filters) != 1 {
+		t.Error("Stale filter not pruned. Got", ce.filters)
+	}
+}
+
+func TestNewClockEstimator(t *testing.T) {
+	ce := NewClockEstimator(0)
+	if ce.size != 1 {
+		t.Error("Expected size to be at least 1, got", ce.size)
+	}
+}
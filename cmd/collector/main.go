@@ -1,10 +1,10 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"os"
 	"os/signal"
-	"time"
 
 	"github.com/nsw3550/udprobe"
 	"golang.org/x/sys/unix"
@@ -17,7 +17,8 @@ func main() {
 	collector := udprobe.Collector{}
 
 	// Perform setup
-	collector.Setup()
+	err := collector.Setup(context.Background())
+	udprobe.HandleFatalErrorMsg(err, "failed to set up collector")
 
 	// Let's do this
 	collector.Run()
@@ -26,16 +27,26 @@ func main() {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, unix.SIGINT, unix.SIGTERM, unix.SIGHUP)
 	for {
-		sig := <-sigChan
-		switch sig {
-		case unix.SIGINT, unix.SIGTERM:
-			udprobe.LogInfo("Received signal, shutting down")
-			collector.Stop()
-			time.Sleep(500 * time.Millisecond) // Grace period for goroutines to drain
-			return
-		case unix.SIGHUP:
-			udprobe.LogInfo("Received SIGHUP, reloading and reconfiguring")
-			collector.Reload()
+		select {
+		case err := <-collector.Errors():
+			// Something stopped working, so restart the whole process
+			udprobe.HandleFatalErrorMsg(err, "collector failed")
+		case sig := <-sigChan:
+			switch sig {
+			case unix.SIGINT, unix.SIGTERM:
+				udprobe.LogInfo("Received signal, shutting down")
+				ctx, cancel := context.WithTimeout(context.Background(),
+					udprobe.DefaultStopTimeout)
+				err := collector.Stop(ctx)
+				cancel()
+				udprobe.HandleFatalErrorMsg(err, "failed to stop cleanly")
+				return
+			case unix.SIGHUP:
+				udprobe.LogInfo("Received SIGHUP, reloading and reconfiguring")
+				// A bad config shouldn't take down what's already running
+				err := collector.Reload()
+				udprobe.HandleMinorErrorMsg(err, "failed to reload, keeping previous config")
+			}
 		}
 	}
 }
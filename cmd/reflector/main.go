@@ -4,14 +4,21 @@ import (
 	"context"
 	"flag"
 	"net"
+	"os/signal"
 	"strconv"
 
 	"github.com/nsw3550/udprobe"
+	"golang.org/x/sys/unix"
 	"golang.org/x/time/rate"
 )
 
 var port = flag.Int("port", 8100, "Port to listen on for probes")
 
+// By default, listen on all addresses, both IPv4 and IPv6 where available
+var ip = flag.String("ip", "", "IP to listen on for probes (default all)")
+var network = flag.String("network", "udp",
+	"Network to listen on for probes: udp (dual-stack), udp4, or udp6")
+
 // If this rate is exceeded, buffering will occur, and latency will
 // be impacted. If severe enough, there's a possibility of drops.
 // This exists to limit the reflector's ability to utilize CPU resources.
@@ -23,19 +30,34 @@ var apiBind = flag.String("api-bind", ":8200", "API server address for metrics/h
 // Disable HTTP API server for metrics and health checks
 var noAPI = flag.Bool("no-api", false, "Disable HTTP API server")
 
+// Kernel timestamps avoid including scheduling delay in the receive time
+var timestamps = flag.String("timestamps", string(udprobe.DefaultTimestampMode),
+	"Where receive timestamps come from: kernel, software, hardware, or userspace")
+
+// Batching reduces the syscalls, and so CPU, per packet at high rates
+var batch = flag.Int("batch", 1,
+	"Max packets per send/receive syscall, 1 disables batching")
+
 // 540672 bytes = 528KB
 var BUFFER_SIZE int = 540672
 
 func main() {
 	// Get command line args
 	flag.Parse()
+	// Stop reflecting cleanly when asked to
+	ctx, cancel := signal.NotifyContext(context.Background(), unix.SIGINT,
+		unix.SIGTERM)
+	defer cancel()
+	tsMode, err := udprobe.ParseTimestampMode(*timestamps)
+	udprobe.HandleError(err)
 
 	// Get the localhost address specified
-	myAddr, err := net.ResolveUDPAddr("udp", ":"+strconv.Itoa(*port))
+	myAddr, err := net.ResolveUDPAddr(*network,
+		net.JoinHostPort(*ip, strconv.Itoa(*port)))
 	udprobe.HandleError(err)
 
 	// Create a connection at the local address which is used for listening
-	conn, err := net.ListenUDP("udp", myAddr)
+	conn, err := net.ListenUDP(*network, myAddr)
 	udprobe.HandleError(err)
 	// Cleanup after
 	defer func(c *net.UDPConn) {
@@ -46,9 +68,10 @@ func main() {
 	}(conn)
 
 	// Tell the socket to get timestamps and increase buffer size
-	// NOTE(nwinemiller): We aren't actually using the socket timestamps yet
-	udprobe.EnableTimestamps(conn)
-	udprobe.SetRecvBufferSize(conn, BUFFER_SIZE)
+	err = udprobe.SetupTimestamps(conn, tsMode, false)
+	udprobe.HandleError(err)
+	err = udprobe.SetRecvBufferSize(conn, BUFFER_SIZE)
+	udprobe.HandleError(err)
 
 	// Create the rate limiter to be used in the reflector
 	// NOTE(nwinemiller): This has the potential to be spikey if there are gaps between
@@ -59,11 +82,22 @@ func main() {
 	// Start API server if enabled
 	var api *udprobe.ReflectorAPI
 	if !*noAPI {
-		api = udprobe.NewReflectorAPI(*apiBind)
+		errs := make(chan error, 1)
+		api = udprobe.NewReflectorAPI(ctx, *apiBind, errs)
 		api.Run()
+		defer api.Stop()
+		// Without the API, there's no way to monitor the reflector
+		go func() {
+			udprobe.HandleFatalErrorMsg(<-errs, "API failed")
+		}()
 		udprobe.LogInfo("API listening on " + *apiBind)
 	}
 
 	// Begin reflecting
-	udprobe.Reflect(context.Background(), conn, rateLimiter)
+	if *batch > 1 {
+		err = udprobe.ReflectBatch(ctx, conn, rateLimiter, tsMode, *batch)
+		udprobe.HandleError(err)
+		return
+	}
+	udprobe.Reflect(ctx, conn, rateLimiter, tsMode)
 }
@@ -0,0 +1,125 @@
+// udprobectl checks and converts collector configs, such as before deploying
+// them.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/nsw3550/udprobe"
+	"gopkg.in/yaml.v2"
+)
+
+const usage = `Usage: udprobectl <command> [flags] <config file>
+
+Commands:
+  validate   Check the config, and list every problem found
+  effective  Print the config as the collector uses it, with defaults filled
+             in, a legacy config converted, and targets resolved
+  migrate    Rewrite a legacy config in the full format
+
+Flags:
+`
+
+// The library's own flags, like udprobe.config, don't apply here
+var flags = flag.NewFlagSet("udprobectl", flag.ExitOnError)
+
+// Same as the collector's udprobe.dst-port
+var dstPort = flags.Int64("dst-port", 8100,
+	"Port to send probes to. Only applies if legacy config provided.")
+
+var commands = map[string]func(data []byte) error{
+	"validate":  validate,
+	"effective": effective,
+	"migrate":   migrate,
+}
+
+func main() {
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), usage)
+		flags.PrintDefaults()
+	}
+	if len(os.Args) < 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	command, ok := commands[os.Args[1]]
+	flags.Parse(os.Args[2:])
+	if !ok || flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	data, err := os.ReadFile(flags.Arg(0))
+	udprobe.HandleFatalErrorMsg(err, "failed to read config")
+	err = command(data)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// load parses and validates the config in data.
+func load(data []byte) (*udprobe.CollectorConfig, bool, error) {
+	cfg, legacy, err := udprobe.ParseCollectorConfig(data, *dstPort)
+	if err != nil {
+		return nil, legacy, err
+	}
+	err = cfg.Validate()
+	var problems udprobe.ConfigErrors
+	if errors.As(err, &problems) {
+		// One per line is easier to read than the joined message
+		for _, problem := range problems {
+			fmt.Fprintln(os.Stderr, problem)
+		}
+		return nil, legacy, fmt.Errorf("%d problems found", len(problems))
+	}
+	return cfg, legacy, err
+}
+
+func validate(data []byte) error {
+	_, legacy, err := load(data)
+	if err != nil {
+		return err
+	}
+	if legacy {
+		fmt.Println("OK (legacy format)")
+	} else {
+		fmt.Println("OK")
+	}
+	return nil
+}
+
+func effective(data []byte) error {
+	cfg, _, err := load(data)
+	if err != nil {
+		return err
+	}
+	cfg.SetDefaults()
+	cfg.Targets, err = cfg.Targets.Resolve()
+	if err != nil {
+		return err
+	}
+	return printYAML(cfg)
+}
+
+func migrate(data []byte) error {
+	cfg, legacy, err := load(data)
+	if err != nil {
+		return err
+	}
+	if !legacy {
+		return errors.New("config is already in the full format")
+	}
+	return printYAML(cfg)
+}
+
+func printYAML(cfg *udprobe.CollectorConfig) error {
+	out, err := yaml.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(out)
+	return err
+}
@@ -3,9 +3,12 @@
 package udprobe
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"net"
+	"os"
 	"time"
 
 	"golang.org/x/time/rate"
@@ -31,35 +34,69 @@ type Collector struct {
 	api *API
 	// TODO(nwinemiller): Might want these to be named, for clarity in logging
 	//      and doing any restarting.
-	runners []*TestRunner
+	runners    []*TestRunner
+	runnerKeys []string // RunnerKey from the config for each of the runners
+	// Keep the runners up to date with the targets, by target set name
+	watchers map[string]*TargetWatcher
 	// TODO(nwinemiller): Keeping cbc around here feels dirty and unneeded, as it's
 	//      only temporarily needed during setup. But it does the trick for
 	//      now. Perhaps find a cleaner way in the future.
-	cbc chan *InFlightProbe
-	s   *Summarizer
-	rh  []*ResultHandler
+	cbc  chan *InFlightProbe
+	s    *Summarizer
+	rh   []*ResultHandler
+	raw  *RawExporter // Nil unless raw results are exported
+	errs chan error   // Runtime errors from any of the components
+	// All components are stopped once this is done
+	ctx    context.Context
+	cancel context.CancelFunc
+	// Looks up hostname targets, net.DefaultResolver if nil
+	Resolver Resolver
+}
+
+// context provides the Context that all of the collector's components are
+// created with, as provided to Setup.
+func (c *Collector) context() context.Context {
+	if c.ctx == nil {
+		// Setup wasn't called, but the individual Setup* functions were
+		c.ctx, c.cancel = context.WithCancel(context.Background())
+	}
+	return c.ctx
+}
+
+// Errors provides a channel of errors that stop a component of the collector
+// from running. Setup must be called first.
+//
+// What to do about them is left to the caller, such as stopping, or calling
+// Reload to recreate the test runners.
+func (c *Collector) Errors() <-chan error {
+	return c.errs
 }
 
 // LoadConfig loads the collector's configuration from CLI flag if provided,
-// otherwise the default.
-func (c *Collector) LoadConfig() {
+// otherwise the default, and validates it.
+//
+// If an error is returned, the existing configuration is left in place.
+func (c *Collector) LoadConfig() error {
 	LogInfo("Loading collector config")
+	old := c.cfg
 	// Try loading from flag first
+	var err error
 	if *configFile != "" {
-		err := c.loadConfigFromFlag()
-		if err == nil {
-			return
-		}
-		HandleFatalErrorMsg(err, "Failed to load configuration")
+		err = c.loadConfigFromFlag()
 		// If that wasn't provided, load the default
 	} else {
 		LogInfo("No udprobe.config provided; loading default config")
-		err := c.loadConfigFromDefault()
-		if err == nil {
-			return
-		}
-		HandleFatalErrorMsg(err, "Failed to load configuration")
+		err = c.loadConfigFromDefault()
 	}
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+	err = c.cfg.Validate()
+	if err != nil {
+		c.cfg = old
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+	return nil
 }
 
 // loadConfigFromFlag attempts to parse and load the configuration file
@@ -99,21 +136,7 @@ func (c *Collector) loadConfigFromDefault() error {
 // loadConfigFromData attempts to parse and load a configuration from data
 // that is already in byte slice form, returning an error is unsuccessful.
 func (c *Collector) loadConfigFromData(data []byte) error {
-	// Try parsing as a legacy config first
-	lcfg, err := NewLegacyCollectorConfig(data)
-	// If it's a legacy config, convert to standard config
-	if err == nil {
-		cfg, err := lcfg.ToDefaultCollectorConfig(*dstPort)
-		// If that fails, bubble up
-		if err != nil {
-			return err
-		}
-		// Save it and we're done
-		c.cfg = cfg
-		return nil
-	}
-	// If it's not a legacy config, handle it like a standard one
-	cfg, err := NewCollectorConfig(data)
+	cfg, _, err := ParseCollectorConfig(data, *dstPort)
 	// If that fails, bubble up
 	if err != nil {
 		return err
@@ -130,93 +153,292 @@ func (c *Collector) SetupAPI() {
 	if c.s == nil {
 		c.SetupSummarizer()
 	}
-	c.api = NewAPI(c.s, c.ts, c.cfg.API.Bind)
+	c.api = NewAPI(c.context(), c.s, c.ts, c.cfg.API.Bind, c.errs)
 }
 
 // SetupTagSet loads the tags for targets, based on the config, that will be
-// applied to summarized results.
+// applied to summarized results. This includes the tags of targets that are
+// discovered, such as for hostnames, as of the latest refresh.
 func (c *Collector) SetupTagSet() {
 	LogInfo("Setting up tag set")
 	c.ts = c.cfg.Targets.TagSet(c.cfg.SrcHostname)
+	for _, name := range sortedKeys(c.watchers) {
+		for k, v := range c.watchers[name].TagSet() {
+			c.ts[k] = v
+		}
+	}
 }
 
 // SetupTestRunner takes parameters from the loaded config, and creates the
 // specified TestConfig.
-func (c *Collector) SetupTestRunner(test TestConfig) {
-	rl := c.createRateLimiter(test.RateLimit)
-	runner := NewTestRunner(c.cbc, rl)
-	if !c.cfg.Targets.Exists(test.Targets) {
-		HandleFatalErrorMsg(fmt.Errorf("target set %q not found in config", test.Targets), "failed to setup test runner")
+func (c *Collector) SetupTestRunner(test TestConfig) error {
+	if c.watchers == nil {
+		c.watchers = make(map[string]*TargetWatcher)
 	}
-	targets, err := c.cfg.Targets[test.Targets].ListResolvedTargets()
+	watcher, err := c.targetWatcher(c.watchers, test.Targets)
 	if err != nil {
-		HandleFatalErrorMsg(err, "failed to resolve targets")
+		return err
 	}
-	runner.Set(targets)
-	c.createPortGroupOnRunner(runner, test.PortGroup)
+	runner, err := c.newTestRunner(test, watcher.Addrs())
+	if err != nil {
+		return err
+	}
+	watcher.AddRunner(runner)
+	watcher.onTags = c.updateTagSet
+	key, _ := c.cfg.RunnerKey(test)
 	c.runners = append(c.runners, runner)
+	c.runnerKeys = append(c.runnerKeys, key)
+	return nil
+}
+
+// targetWatcher provides the TargetWatcher for the named target set from the
+// watchers, or creates it there and discovers the targets if it doesn't
+// exist yet.
+//
+// A new one doesn't update the API with its tags until its onTags is set to
+// updateTagSet, so that's left until the watchers are committed to.
+func (c *Collector) targetWatcher(watchers map[string]*TargetWatcher,
+	name string) (*TargetWatcher, error) {
+	if watcher, ok := watchers[name]; ok {
+		return watcher, nil
+	}
+	if !c.cfg.Targets.Exists(name) {
+		return nil, fmt.Errorf("target set %q not found in config", name)
+	}
+	resolver := c.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	watcher := NewTargetWatcher(c.context(), c.cfg.Targets[name],
+		c.cfg.SrcHostname, resolver, c.cfg.Discovery.IntervalDuration(), nil)
+	err := watcher.Refresh()
+	// A host that can't be found yet is tested once it can be
+	HandleMinorErrorMsg(err, fmt.Sprintf("failed to discover targets in %q",
+		name))
+	watchers[name] = watcher
+	return watcher, nil
+}
+
+// updateTagSet merges tags from a TargetWatcher into the API, once it exists.
+// Before then, they're included by SetupTagSet.
+func (c *Collector) updateTagSet(ts TagSet) {
+	if c.api != nil {
+		c.api.MergeUpdateTagSet(ts)
+	}
+}
+
+// newTestRunner creates a TestRunner for the TestConfig, based on the loaded
+// config, which starts with the targets.
+func (c *Collector) newTestRunner(test TestConfig,
+	targets []*net.UDPAddr) (*TestRunner, error) {
+	rl, err := c.createRateLimiter(test.RateLimit)
+	if err != nil {
+		return nil, err
+	}
+	runner := NewTestRunner(c.context(), c.cbc, c.errs, rl)
+	runner.Set(targets)
+	err = c.createPortGroupOnRunner(runner, test.PortGroup)
+	if err != nil {
+		// Release any ports that were created
+		runner.Stop()
+		return nil, err
+	}
+	return runner, nil
+}
+
+// SetupTestRunners creates all the `tests` that are defined in the config,
+// along with a TargetWatcher for each of the target sets they use.
+//
+// Existing test runners with the same RunnerKey as a test are kept for it,
+// with only their targets updated, so they keep probing without a gap. The
+// rest are only stopped and replaced once all of the new ones have been
+// created, so they're all left running as-is if an error is returned.
+//
+// The exception is those bound to a fixed source port that a new one needs,
+// since sockets can't share it. They're stopped before any are created, and
+// removed from the collector even if an error is returned.
+func (c *Collector) SetupTestRunners() error {
+	_, err := c.setupTestRunners()
+	return err
 }
 
-// SetupTestRunners creates all the `tests` that are defined in the config.
-func (c *Collector) SetupTestRunners() {
+// setupTestRunners is SetupTestRunners, but also provides the test runners
+// that were newly created, and so haven't been started yet.
+func (c *Collector) setupTestRunners() ([]*TestRunner, error) {
 	LogInfo("Setting up test runners")
 	// Don't recreate the channel on reload, only create once
 	if c.cbc == nil {
 		c.cbc = make(chan *InFlightProbe, DEFAULT_CHANNEL_SIZE)
 	}
-	// If there are already test runners, they should be removed
-	if len(c.runners) > 0 {
-		LogInfo("Found old test runners. Stopping and purging.")
-		for _, runner := range c.runners {
+	// Existing runners that can be reused, by key
+	old := make(map[string][]*TestRunner)
+	for i, runner := range c.runners {
+		old[c.runnerKeys[i]] = append(old[c.runnerKeys[i]], runner)
+	}
+	// By test, with the runners only filled in for those that are reused
+	runners := make([]*TestRunner, len(c.cfg.Tests))
+	keys := make([]string, len(c.cfg.Tests))
+	testWatchers := make([]*TargetWatcher, len(c.cfg.Tests))
+	// Targets for the reused runners, only set once everything succeeds
+	reused := make(map[*TestRunner][]*net.UDPAddr)
+	watchers := make(map[string]*TargetWatcher)
+	var created []*TestRunner
+	fail := func(i int, err error) ([]*TestRunner, error) {
+		for _, runner := range created {
 			runner.Stop()
 		}
-		// Clear out the slice
-		c.runners = nil
+		for _, watcher := range watchers {
+			watcher.Stop()
+		}
+		return nil, fmt.Errorf("failed to setup test runner for test %d: %w",
+			i, err)
+	}
+	// Source ports that the new runners bind to
+	fixed := make(map[int]bool)
+	for i, test := range c.cfg.Tests {
+		key, ok := c.cfg.RunnerKey(test)
+		watcher, err := c.targetWatcher(watchers, test.Targets)
+		if err != nil {
+			return fail(i, err)
+		}
+		keys[i], testWatchers[i] = key, watcher
+		if ok && len(old[key]) > 0 {
+			runners[i] = old[key][0]
+			old[key] = old[key][1:]
+			reused[runners[i]] = watcher.Addrs()
+			continue
+		}
+		for _, port := range c.cfg.fixedPorts(test) {
+			fixed[port] = true
+		}
 	}
-	for _, test := range c.cfg.Tests {
-		c.SetupTestRunner(test)
+	// Free those ports from the runners being replaced
+	freed := 0
+	for key, unused := range old {
+		var kept []*TestRunner
+		for _, runner := range unused {
+			if runner.BindsAny(fixed) {
+				runner.Stop()
+				freed++
+			} else {
+				kept = append(kept, runner)
+			}
+		}
+		old[key] = kept
+	}
+	if freed > 0 {
+		LogInfo(fmt.Sprintf("Stopped %d old test runners to free their ports",
+			freed))
+		c.removeStoppedRunners()
+	}
+	for i, test := range c.cfg.Tests {
+		if runners[i] != nil {
+			continue
+		}
+		runner, err := c.newTestRunner(test, testWatchers[i].Addrs())
+		if err != nil {
+			return fail(i, err)
+		}
+		runners[i] = runner
+		created = append(created, runner)
+	}
+	for i, runner := range runners {
+		testWatchers[i].AddRunner(runner)
+	}
+	// The new watchers take over updating the reused runners
+	for _, watcher := range c.watchers {
+		watcher.Stop()
+	}
+	for runner, targets := range reused {
+		runner.Set(targets)
+	}
+	// Any old test runners that weren't reused should be removed
+	stopped := len(c.runners) - len(reused)
+	if stopped > 0 {
+		LogInfo(fmt.Sprintf("Stopping %d old test runners", stopped))
+		for _, unused := range old {
+			for _, runner := range unused {
+				runner.Stop()
+			}
+		}
+	}
+	if len(c.runners) > 0 {
+		LogInfo(fmt.Sprintf("Kept %d test runners, created %d", len(reused),
+			len(created)))
+	}
+	c.runners, c.runnerKeys = runners, keys
+	c.watchers = watchers
+	// Their tags so far are added by SetupTagSet, and they aren't running yet
+	for _, watcher := range watchers {
+		watcher.onTags = c.updateTagSet
+	}
+	return created, nil
+}
+
+// removeStoppedRunners removes any test runners that have been stopped, along
+// with their keys.
+func (c *Collector) removeStoppedRunners() {
+	var runners []*TestRunner
+	var keys []string
+	for i, runner := range c.runners {
+		if !runner.isStopped() {
+			runners = append(runners, runner)
+			keys = append(keys, c.runnerKeys[i])
+		}
 	}
+	c.runners, c.runnerKeys = runners, keys
 }
 
 // createRateLimiter creates a TestRunner compliant RateLimter based on the
 // config for the named rate limiter.
-func (c *Collector) createRateLimiter(name string) *rate.Limiter {
+func (c *Collector) createRateLimiter(name string) (*rate.Limiter, error) {
 	if !c.cfg.RateLimits.Exists(name) {
-		HandleFatalErrorMsg(fmt.Errorf("rate limit %q not found in config", name), "failed to create rate limiter")
+		return nil, fmt.Errorf("rate limit %q not found in config", name)
 	}
 	rlConfig := c.cfg.RateLimits[name]
 	rl := rate.NewLimiter(rate.Limit(rlConfig.CPS), int(rlConfig.CPS))
-	return rl
+	return rl, nil
 }
 
 // createPortOnRunner creates a port on the provided TestRunner based on the
 // provided PortConfig.
-func (c *Collector) createPortOnRunner(runner *TestRunner, p PortConfig) {
+func (c *Collector) createPortOnRunner(runner *TestRunner, p PortConfig) error {
 	timeout := time.Duration(p.Timeout) * time.Millisecond
-	runner.AddNewPort(
-		fmt.Sprintf("%v:%v", p.IP, p.Port),
+	tsMode, err := ParseTimestampMode(p.Timestamps)
+	if err != nil {
+		return err
+	}
+	return runner.AddNewPort(
+		p.NetworkString(),
+		p.AddrString(),
 		byte(p.Tos),
 		timeout,
 		timeout,
 		timeout,
+		tsMode,
+		int(p.Batch),
 	)
 }
 
 // createPortGroupOnRunner creates the named port group from the config on the
 // provided TestRunner instance.
-func (c *Collector) createPortGroupOnRunner(runner *TestRunner, name string) {
+func (c *Collector) createPortGroupOnRunner(runner *TestRunner, name string) error {
 	if !c.cfg.PortGroups.Exists(name) {
-		HandleFatalErrorMsg(fmt.Errorf("port group %q not found in config", name), "failed to create port group on runner")
+		return fmt.Errorf("port group %q not found in config", name)
 	}
 	pg := c.cfg.PortGroups[name]
 	for _, pgc := range pg {
 		if !c.cfg.Ports.Exists(pgc.Port) {
-			HandleFatalErrorMsg(fmt.Errorf("port %q not found in config", pgc.Port), "failed to create port on runner")
+			return fmt.Errorf("port %q not found in config", pgc.Port)
 		}
 		for i := int64(0); i < pgc.Count; i++ {
-			c.createPortOnRunner(runner, c.cfg.Ports[pgc.Port])
+			err := c.createPortOnRunner(runner, c.cfg.Ports[pgc.Port])
+			if err != nil {
+				return fmt.Errorf("failed to create port %q: %w", pgc.Port, err)
+			}
 		}
 	}
+	return nil
 }
 
 // SetupSummarizer creates the Summarizer and ResultHandlers that will
@@ -225,9 +447,20 @@ func (c *Collector) SetupSummarizer() {
 	LogInfo("Setting up summarizer")
 	// Setup the summarizer and result handlers
 	resultChan := make(chan *Result, DEFAULT_CHANNEL_SIZE)
+	percentiles := c.cfg.Summarization.Percentiles
+	if len(percentiles) == 0 {
+		percentiles = DefaultPercentiles
+	}
+	buckets := c.cfg.Summarization.Buckets
+	if len(buckets) == 0 {
+		buckets = DefaultRTTBuckets
+	}
 	c.s = NewSummarizer(
+		c.context(),
 		resultChan,
 		time.Duration(c.cfg.Summarization.Interval)*time.Second,
+		percentiles,
+		buckets,
 	)
 	c.setupResultHandlers(resultChan)
 }
@@ -236,41 +469,140 @@ func (c *Collector) SetupSummarizer() {
 func (c *Collector) setupResultHandlers(resultChan chan *Result) {
 	LogInfo(fmt.Sprintf("Setting up %d result handlers", c.cfg.Summarization.Handlers))
 	for i := int64(0); i < c.cfg.Summarization.Handlers; i++ {
-		rh := NewResultHandler(c.cbc, resultChan)
+		rh := NewResultHandler(c.context(), c.cbc, resultChan)
 		c.rh = append(c.rh, rh)
 	}
 }
 
+// SetupSinks creates the SummarySinks in the config, which each set of
+// summaries is written to along with the tags from the API, and adds them to
+// the Summarizer.
+//
+// If any of them fail, those that were created are closed.
+func (c *Collector) SetupSinks() error {
+	LogInfo(fmt.Sprintf("Setting up %d summary sinks", len(c.cfg.Sinks)))
+	var sinks []SummarySink
+	for i, sc := range c.cfg.Sinks {
+		sink, err := c.newSink(sc)
+		if err != nil {
+			for _, sink := range sinks {
+				sink.Close()
+			}
+			return fmt.Errorf("failed to setup sink %d: %w", i, err)
+		}
+		sinks = append(sinks, sink)
+	}
+	for _, sink := range sinks {
+		c.s.AddSink(sink)
+	}
+	return nil
+}
+
+// newSink creates a SummarySink based on the sc.
+func (c *Collector) newSink(sc SinkConfig) (SummarySink, error) {
+	switch sc.Type {
+	case SinkStdout:
+		return NewJSONLinesSink(os.Stdout, c.api.Tags), nil
+	case SinkFile:
+		return NewFileSink(sc.FileConfig, c.s.percentiles, c.s.buckets,
+			c.api.Tags)
+	case SinkInflux:
+		pusher := NewInfluxPusher(c.context(), sc.InfluxConfig, c.api.Tags)
+		// Idle until summaries are written to it
+		pusher.Run()
+		return pusher, nil
+	}
+	return nil, fmt.Errorf("unknown sink type %q", sc.Type)
+}
+
+// SetupRaw creates the RawExporter that each Result is also written to, if
+// the config has somewhere to write them, and sets it on the ResultHandlers.
+func (c *Collector) SetupRaw() error {
+	if !c.cfg.Raw.Enabled() {
+		return nil
+	}
+	LogInfo("Setting up raw result exporter")
+	raw, err := NewRawExporter(c.context(), c.cfg.Raw)
+	if err != nil {
+		return err
+	}
+	c.raw = raw
+	for _, rh := range c.rh {
+		rh.SetRawExporter(raw)
+	}
+	return nil
+}
+
 // Setup is a generally wrapper around all of the other Setup* functions.
-func (c *Collector) Setup() {
+//
+// All of the collector's components stop once ctx is done, though Stop should
+// still be used to wait for them.
+func (c *Collector) Setup(ctx context.Context) error {
 	// Ordering is important here, as some of these depend on elements
 	// setup earlier in the process.
 	LogInfo("Setting up collector")
-	c.LoadConfig()
+	c.ctx, c.cancel = context.WithCancel(ctx)
+	if c.errs == nil {
+		c.errs = make(chan error, DEFAULT_CHANNEL_SIZE)
+	}
+	err := c.LoadConfig()
+	if err != nil {
+		return err
+	}
+	err = c.SetupTestRunners()
+	if err != nil {
+		return err
+	}
+	// Includes the tags of targets that were discovered for the runners
 	c.SetupTagSet()
-	c.SetupTestRunners()
 	c.SetupSummarizer()
 	c.SetupAPI()
+	err = c.SetupSinks()
+	if err != nil {
+		return err
+	}
+	err = c.SetupRaw()
+	if err != nil {
+		return err
+	}
 	LogInfo("Collector setup complete")
+	return nil
 }
 
-// Reload causes the config to be reread, and test runners recreated
-func (c *Collector) Reload() {
+// Reload causes the config to be reread, and test runners recreated if their
+// ports or rate limit changed. Otherwise, only their targets are updated.
+//
+// If an error is returned, the previous config and test runners are kept.
+func (c *Collector) Reload() error {
 	LogInfo("Reloading collector")
-	// This should be an atomic operation, so no prep needed
-	c.LoadConfig()
-	// Same here
+	old, running := c.cfg, len(c.runners)
+	err := c.LoadConfig()
+	if err != nil {
+		return err
+	}
+	// This will only purge existing test runners if the new ones are good,
+	// other than those stopped to free their fixed ports
+	created, err := c.setupTestRunners()
+	if err != nil {
+		c.cfg = old
+		if len(c.runners) < running {
+			c.restoreTestRunners()
+		}
+		return err
+	}
 	c.SetupTagSet()
-	// This will purge existing test runners and rebuild
-	c.SetupTestRunners()
 	// The summarizer and API should be untouched though
-	// We just need to start all the new test runners
+	// We just need to start all the new test runners, the reused ones are
+	// already running
 	// TODO(nwinemiller): This is redundant with part of Run() and
 	//             could be reorganized.
 	LogInfo("Starting new test runners")
-	for _, runner := range c.runners {
+	for _, runner := range created {
 		runner.Run()
 	}
+	for _, watcher := range c.watchers {
+		watcher.Run()
+	}
 	// Update the TagSet on the API to reflect the new config
 	// TODO(nwinemiller): This merges the new TagSet with the existing one to address the case
 	//   where outstanding test results are for a host that is no longer in the config.
@@ -282,6 +614,24 @@ func (c *Collector) Reload() {
 	LogInfo("Updating TagSet on API")
 	c.api.MergeUpdateTagSet(c.ts)
 	LogInfo("Collector reload complete")
+	return nil
+}
+
+// restoreTestRunners recreates and starts any test runners in the config that
+// were stopped by a failed reload, keeping those that are still running.
+func (c *Collector) restoreTestRunners() {
+	LogInfo("Restoring stopped test runners")
+	created, err := c.setupTestRunners()
+	if err != nil {
+		HandleMinorErrorMsg(err, "failed to restore test runners")
+		return
+	}
+	for _, runner := range created {
+		runner.Run()
+	}
+	for _, watcher := range c.watchers {
+		watcher.Run()
+	}
 }
 
 // Run starts all of the components of the collector and begins testing.
@@ -291,31 +641,63 @@ func (c *Collector) Run() {
 	c.api.Run()
 	// Start the Summarizer
 	c.s.Run()
+	// Start the RawExporter, before the ResultHandlers that feed it
+	if c.raw != nil {
+		c.raw.Run()
+	}
 	// Start the ResultHandlers
 	for _, rh := range c.rh {
 		rh.Run()
 	}
-	// Start the TestRunners
+	// Start the TestRunners, and following their targets
 	for _, runner := range c.runners {
 		runner.Run()
 	}
+	for _, watcher := range c.watchers {
+		watcher.Run()
+	}
 	LogInfo("All Collector components running")
 }
 
-// Stop will signal all collector components to stop.
-func (c *Collector) Stop() {
+// Stop will signal all collector components to stop, and wait for them to
+// exit and close their sockets.
+//
+// If ctx is done first, this returns its error without waiting any longer,
+// though the components will still continue stopping in the background.
+func (c *Collector) Stop(ctx context.Context) error {
 	LogInfo("Stopping Collector")
-	// Stop the TestRunners
-	for _, runner := range c.runners {
-		runner.Stop()
-	}
-	// Stop the ResultHandlers
-	for _, rh := range c.rh {
-		rh.Stop()
+	c.context() // In case Setup wasn't called
+	c.cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// Stop the TargetWatchers, before the TestRunners they update
+		for _, watcher := range c.watchers {
+			watcher.Stop()
+		}
+		// Stop the TestRunners
+		for _, runner := range c.runners {
+			runner.Stop()
+		}
+		// Stop the ResultHandlers
+		for _, rh := range c.rh {
+			rh.Stop()
+		}
+		// Stop the RawExporter, once the ResultHandlers are done with it
+		if c.raw != nil {
+			c.raw.Stop()
+		}
+		// Stop the Summarizer, and close its sinks
+		c.s.Stop()
+		// Stop the API
+		c.api.Stop()
+	}()
+	select {
+	case <-done:
+		LogInfo("All Collector components stopped")
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("timed out waiting for collector to stop: %w",
+			ctx.Err())
 	}
-	// Stop the Summarizer
-	c.s.Stop()
-	// Stop the API
-	c.api.Stop()
-	LogInfo("All Collector components signaled to stop")
 }
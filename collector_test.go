@@ -1,7 +1,13 @@
 package udprobe
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -165,6 +171,85 @@ summarization:
 	}
 }
 
+func TestSetupSinks(t *testing.T) {
+	c := &Collector{}
+	path := filepath.Join(t.TempDir(), "summaries.jsonl")
+	yamlData := `
+summarization:
+  interval: 10
+  handlers: 1
+sinks:
+  - type: stdout
+  - type: file
+    path: ` + path + `
+  - type: influx
+    url: http://127.0.0.1:1/write
+    retries: 0
+`
+	if err := c.loadConfigFromData([]byte(yamlData)); err != nil {
+		t.Fatal(err)
+	}
+	if retries := c.cfg.Sinks[2].Retries; retries == nil || *retries != 0 {
+		t.Error("Explicit retries not kept. Got", retries)
+	}
+	c.SetupAPI()
+	if err := c.SetupSinks(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.s.Stop()
+	if len(c.s.sinks) != 3 {
+		t.Error("Wrong number of sinks. Got", c.s.sinks)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Error("File sink didn't create its file:", err)
+	}
+
+	// Nothing is added if one fails
+	c.s.Stop() // Closes the sinks
+	c.cfg.Sinks = append(c.cfg.Sinks, SinkConfig{Type: SinkFile,
+		FileConfig: FileConfig{
+			Path: filepath.Join(path, "not-a-dir", "summaries.jsonl")}})
+	if err := c.SetupSinks(); err == nil {
+		t.Error("Expected an error for the file that can't be created")
+	}
+	if len(c.s.sinks) != 0 {
+		t.Error("Sinks added despite the error. Got", c.s.sinks)
+	}
+}
+
+func TestSetupRaw(t *testing.T) {
+	c := &Collector{}
+	path := filepath.Join(t.TempDir(), "results.bin")
+	yamlData := `
+summarization:
+  interval: 10
+  handlers: 2
+  percentiles: [50, 99]
+raw:
+  path: ` + path + `
+  format: binary
+`
+	if err := c.loadConfigFromData([]byte(yamlData)); err != nil {
+		t.Fatal(err)
+	}
+	c.SetupSummarizer()
+	if err := c.SetupRaw(); err != nil {
+		t.Fatal(err)
+	}
+	if c.raw == nil || c.raw.format != RawFormatBinary {
+		t.Fatal("RawExporter not setup from the config. Got", c.raw)
+	}
+	defer c.raw.Stop()
+	for i, rh := range c.rh {
+		if rh.raw != c.raw {
+			t.Error("RawExporter not set on ResultHandler", i)
+		}
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Error("RawExporter didn't create its file:", err)
+	}
+}
+
 func TestCreateRateLimiter(t *testing.T) {
 	c := &Collector{}
 	yamlData := `
@@ -173,9 +258,9 @@ rate_limits:
     cps: 50
 `
 	_ = c.loadConfigFromData([]byte(yamlData))
-	rl := c.createRateLimiter("test")
-	if rl == nil {
-		t.Fatal("createRateLimiter returned nil")
+	rl, err := c.createRateLimiter("test")
+	if err != nil {
+		t.Fatal("createRateLimiter failed:", err)
 	}
 	if rl.Limit() != 50 {
 		t.Errorf("Expected limit 50, got %v", rl.Limit())
@@ -184,14 +269,17 @@ rate_limits:
 
 func TestCreatePortOnRunner(t *testing.T) {
 	c := &Collector{}
-	runner := NewTestRunner(nil, nil)
+	runner := NewTestRunner(context.Background(), nil, nil, nil)
 	p := PortConfig{
 		IP:      "127.0.0.1",
 		Port:    0,
 		Tos:     0,
 		Timeout: 500,
 	}
-	c.createPortOnRunner(runner, p)
+	err := c.createPortOnRunner(runner, p)
+	if err != nil {
+		t.Error("createPortOnRunner failed:", err)
+	}
 	// We can't easily inspect runner's internal ports as they are not exported,
 	// but we can at least ensure it doesn't crash.
 }
@@ -211,8 +299,11 @@ ports:
     timeout: 1000
 `
 	_ = c.loadConfigFromData([]byte(yamlData))
-	runner := NewTestRunner(nil, nil)
-	c.createPortGroupOnRunner(runner, "pg1")
+	runner := NewTestRunner(context.Background(), nil, nil, nil)
+	err := c.createPortGroupOnRunner(runner, "pg1")
+	if err != nil {
+		t.Error("createPortGroupOnRunner failed:", err)
+	}
 }
 
 func TestSetupTestRunner(t *testing.T) {
@@ -243,7 +334,10 @@ rate_limits:
 		RateLimit: "rl1",
 	}
 	c.cbc = make(chan *InFlightProbe, 10)
-	c.SetupTestRunner(testCfg)
+	err := c.SetupTestRunner(testCfg)
+	if err != nil {
+		t.Fatal("SetupTestRunner failed:", err)
+	}
 	if len(c.runners) != 1 {
 		t.Errorf("Expected 1 runner, got %d", len(c.runners))
 	}
@@ -291,7 +385,20 @@ api:
 	c.Run()
 	// Let it run for a tiny bit
 	time.Sleep(10 * time.Millisecond)
-	c.Stop()
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultStopTimeout)
+	defer cancel()
+	err := c.Stop(ctx)
+	if err != nil {
+		t.Error("Stop failed:", err)
+	}
+	// Everything should be closed by now
+	for _, runner := range c.runners {
+		for p := range runner.pg.ports {
+			if _, err := p.conn.Write(nil); !errors.Is(err, net.ErrClosed) {
+				t.Error("Port conn not closed after Stop. Got", err)
+			}
+		}
+	}
 }
 
 func TestReload(t *testing.T) {
@@ -335,7 +442,404 @@ api:
 	// Since we can't easily mock it without refactoring, we'll ensure c.cfg is still valid.
 	// But Reload calls LoadConfig which might overwrite c.cfg.
 	// If no flags are set, it loads default.
-	c.Reload()
+	err := c.Reload()
+	if err != nil {
+		t.Error("Reload failed:", err)
+	}
+}
+
+func TestReloadError(t *testing.T) {
+	c := &Collector{}
+	yamlData := `
+targets:
+  t1:
+    - ip: 127.0.0.1
+      port: 8100
+tests:
+  - targets: t1
+    port_group: pg1
+    rate_limit: rl1
+port_groups:
+  pg1:
+    - port: p1
+      count: 1
+ports:
+  p1:
+    ip: 127.0.0.1
+    port: 0
+    timeout: 1000
+rate_limits:
+  rl1:
+    cps: 10
+api:
+  bind: "127.0.0.1:0"
+`
+	_ = c.loadConfigFromData([]byte(yamlData))
+	c.SetupTagSet()
+	if err := c.SetupTestRunners(); err != nil {
+		t.Fatal("SetupTestRunners failed:", err)
+	}
+	c.SetupSummarizer()
+	c.SetupAPI()
+	cfg, runners := c.cfg, c.runners
+
+	// The same, but with a port IP that isn't on this host
+	oldConfigFile := *configFile
+	defer func() { *configFile = oldConfigFile }()
+	tmpFile, _ := os.CreateTemp("", "udprobe-*.yaml")
+	defer os.Remove(tmpFile.Name())
+	tmpFile.Write([]byte(strings.Replace(yamlData, "127.0.0.1\n    port: 0",
+		"192.0.2.1\n    port: 0", 1)))
+	tmpFile.Close()
+	*configFile = tmpFile.Name()
+
+	err := c.Reload()
+	if err == nil {
+		t.Error("Expected Reload to fail with an invalid port")
+	}
+	if c.cfg != cfg {
+		t.Error("Config replaced despite failed Reload")
+	}
+	if len(c.runners) != 1 || c.runners[0] != runners[0] {
+		t.Error("Test runners replaced despite failed Reload")
+	}
+	if c.runners[0].isStopped() {
+		t.Error("Existing test runner stopped despite failed Reload")
+	}
+}
+
+func TestReloadErrorKeepsTags(t *testing.T) {
+	c := &Collector{Resolver: newFakeResolver()}
+	yamlData := `
+targets:
+  t1:
+    - ip: 127.0.0.1
+      port: 8100
+tests:
+  - targets: t1
+    port_group: pg1
+    rate_limit: rl1
+port_groups:
+  pg1:
+    - port: p1
+      count: 1
+ports:
+  p1:
+    ip: 127.0.0.1
+    port: 0
+    timeout: 1000
+rate_limits:
+  rl1:
+    cps: 10
+summarization:
+  interval: 10
+  handlers: 1
+api:
+  bind: "127.0.0.1:0"
+`
+	_ = c.loadConfigFromData([]byte(yamlData))
+	c.SetupTagSet()
+	if err := c.SetupTestRunners(); err != nil {
+		t.Fatal("SetupTestRunners failed:", err)
+	}
+	c.SetupSummarizer()
+	c.SetupAPI()
+	defer c.Stop(context.Background())
+
+	// A host target is discovered, but the port can't be created
+	oldConfigFile := *configFile
+	defer func() { *configFile = oldConfigFile }()
+	tmpFile, _ := os.CreateTemp("", "udprobe-*.yaml")
+	defer os.Remove(tmpFile.Name())
+	newData := strings.Replace(yamlData, "- ip: 127.0.0.1",
+		"- host: reflector.example", 1)
+	newData = strings.Replace(newData, "127.0.0.1\n    port: 0",
+		"192.0.2.1\n    port: 0", 1)
+	tmpFile.Write([]byte(newData))
+	tmpFile.Close()
+	*configFile = tmpFile.Name()
+
+	if err := c.Reload(); err == nil {
+		t.Fatal("Expected Reload to fail with an invalid port")
+	}
+	if tags := c.api.Tags("192.0.2.1"); len(tags) != 0 {
+		t.Error("Tags of the failed config merged into the API. Got", tags)
+	}
+}
+
+func TestReloadKeepsUnchangedRunners(t *testing.T) {
+	c := &Collector{}
+	yamlData := `
+targets:
+  t1:
+    - ip: 127.0.0.1
+      port: 8100
+tests:
+  - targets: t1
+    port_group: pg1
+    rate_limit: rl1
+  - targets: t1
+    port_group: pg1
+    rate_limit: rl2
+port_groups:
+  pg1:
+    - port: p1
+      count: 1
+ports:
+  p1:
+    ip: 127.0.0.1
+    port: 0
+    timeout: 1000
+rate_limits:
+  rl1:
+    cps: 10
+  rl2:
+    cps: 20
+summarization:
+  interval: 10
+  handlers: 1
+api:
+  bind: "127.0.0.1:0"
+`
+	_ = c.loadConfigFromData([]byte(yamlData))
+	c.SetupTagSet()
+	if err := c.SetupTestRunners(); err != nil {
+		t.Fatal("SetupTestRunners failed:", err)
+	}
+	c.SetupSummarizer()
+	c.SetupAPI()
+	c.Run()
+	defer c.Stop(context.Background())
+	runners := c.runners
+
+	// Change the targets, which shouldn't need a new runner, and the second
+	// rate limit, which should
+	oldConfigFile := *configFile
+	defer func() { *configFile = oldConfigFile }()
+	tmpFile, _ := os.CreateTemp("", "udprobe-*.yaml")
+	defer os.Remove(tmpFile.Name())
+	newData := strings.Replace(yamlData, "port: 8100", "port: 8101", 1)
+	newData = strings.Replace(newData, "cps: 20", "cps: 30", 1)
+	tmpFile.Write([]byte(newData))
+	tmpFile.Close()
+	*configFile = tmpFile.Name()
+
+	err := c.Reload()
+	if err != nil {
+		t.Fatal("Reload failed:", err)
+	}
+	if len(c.runners) != 2 {
+		t.Fatal("Wrong number of runners after Reload. Got", len(c.runners),
+			"expected", 2)
+	}
+	if c.runners[0] != runners[0] {
+		t.Error("Unchanged test runner was replaced")
+	}
+	if c.runners[0].isStopped() {
+		t.Error("Unchanged test runner was stopped")
+	}
+	c.runners[0].mutex.RLock()
+	if len(c.runners[0].targets) != 1 || c.runners[0].targets[0].Port != 8101 {
+		t.Error("Targets not updated on unchanged test runner. Got",
+			c.runners[0].targets)
+	}
+	c.runners[0].mutex.RUnlock()
+	if c.runners[1] == runners[1] {
+		t.Error("Test runner with a changed rate limit was kept")
+	}
+	if !runners[1].isStopped() {
+		t.Error("Replaced test runner wasn't stopped")
+	}
+	if c.runners[1].rl.Limit() != 30 {
+		t.Error("Wrong rate limit on new test runner. Got",
+			c.runners[1].rl.Limit(), "expected", 30)
+	}
+}
+
+// freeUDPPort provides a local UDP port that's free to bind to.
+func freeUDPPort(t *testing.T) int {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// fixedPortConfig is a config with a single test from a fixed source port.
+const fixedPortConfig = `
+targets:
+  t1:
+    - ip: 127.0.0.1
+      port: 8100
+tests:
+  - targets: t1
+    port_group: pg1
+    rate_limit: rl1
+port_groups:
+  pg1:
+    - port: p1
+      count: 1
+ports:
+  p1:
+    ip: 127.0.0.1
+    port: %d
+    tos: 0
+    timeout: 1000
+rate_limits:
+  rl1:
+    cps: 10
+summarization:
+  interval: 10
+  handlers: 1
+api:
+  bind: "127.0.0.1:0"
+`
+
+func TestReloadFixedPort(t *testing.T) {
+	c := &Collector{}
+	port := freeUDPPort(t)
+	yamlData := fmt.Sprintf(fixedPortConfig, port)
+	if err := c.loadConfigFromData([]byte(yamlData)); err != nil {
+		t.Fatal(err)
+	}
+	c.SetupTagSet()
+	if err := c.SetupTestRunners(); err != nil {
+		t.Fatal("SetupTestRunners failed:", err)
+	}
+	c.SetupSummarizer()
+	c.SetupAPI()
+	c.Run()
+	defer c.Stop(context.Background())
+	runners := c.runners
+
+	// A new ToS needs a new runner, bound to the same port
+	oldConfigFile := *configFile
+	defer func() { *configFile = oldConfigFile }()
+	tmpFile, _ := os.CreateTemp("", "udprobe-*.yaml")
+	defer os.Remove(tmpFile.Name())
+	tmpFile.Write([]byte(strings.Replace(yamlData, "tos: 0", "tos: 184", 1)))
+	tmpFile.Close()
+	*configFile = tmpFile.Name()
+
+	if err := c.Reload(); err != nil {
+		t.Fatal("Reload failed:", err)
+	}
+	if len(c.runners) != 1 || c.runners[0] == runners[0] {
+		t.Fatal("Test runner not replaced. Got", c.runners)
+	}
+	if !runners[0].isStopped() {
+		t.Error("Replaced test runner wasn't stopped")
+	}
+	if !c.runners[0].BindsAny(map[int]bool{port: true}) {
+		t.Error("New test runner not bound to port", port)
+	}
+}
+
+func TestReloadFixedPortError(t *testing.T) {
+	c := &Collector{}
+	port := freeUDPPort(t)
+	yamlData := fmt.Sprintf(fixedPortConfig, port)
+	if err := c.loadConfigFromData([]byte(yamlData)); err != nil {
+		t.Fatal(err)
+	}
+	c.SetupTagSet()
+	if err := c.SetupTestRunners(); err != nil {
+		t.Fatal("SetupTestRunners failed:", err)
+	}
+	c.SetupSummarizer()
+	c.SetupAPI()
+	c.Run()
+	defer c.Stop(context.Background())
+	cfg, runners := c.cfg, c.runners
+
+	// Frees the port, then fails to bind to an IP that isn't on this host
+	oldConfigFile := *configFile
+	defer func() { *configFile = oldConfigFile }()
+	tmpFile, _ := os.CreateTemp("", "udprobe-*.yaml")
+	defer os.Remove(tmpFile.Name())
+	newData := strings.Replace(yamlData, "tos: 0", "tos: 184", 1)
+	newData = strings.Replace(newData, "    ip: 127.0.0.1\n    port:",
+		"    ip: 192.0.2.1\n    port:", 1)
+	tmpFile.Write([]byte(newData))
+	tmpFile.Close()
+	*configFile = tmpFile.Name()
+
+	if err := c.Reload(); err == nil {
+		t.Fatal("Expected Reload to fail with an invalid port")
+	}
+	if c.cfg != cfg {
+		t.Error("Config replaced despite failed Reload")
+	}
+	if !runners[0].isStopped() {
+		t.Error("Test runner bound to the port wasn't stopped to free it")
+	}
+	// Recreated from the previous config
+	if len(c.runners) != 1 || c.runners[0].isStopped() ||
+		!c.runners[0].BindsAny(map[int]bool{port: true}) {
+		t.Error("Test runner not restored after failed Reload. Got", c.runners)
+	}
+}
+
+func TestSetupTestRunnersHost(t *testing.T) {
+	c := &Collector{Resolver: newFakeResolver()}
+	yamlData := `
+targets:
+  t1:
+    - host: reflector.example
+      port: 8100
+    - host: missing.example
+      port: 8100
+tests:
+  - targets: t1
+    port_group: pg1
+    rate_limit: rl1
+port_groups:
+  pg1:
+    - port: p1
+      count: 1
+ports:
+  p1:
+    ip: 127.0.0.1
+    timeout: 1000
+rate_limits:
+  rl1:
+    cps: 10
+`
+	_ = c.loadConfigFromData([]byte(yamlData))
+	// A host that can't be found doesn't stop the others
+	if err := c.SetupTestRunners(); err != nil {
+		t.Fatal("SetupTestRunners failed:", err)
+	}
+	defer c.runners[0].Stop()
+	if len(c.runners[0].targets) != 2 {
+		t.Error("Wrong targets for the host. Got", c.runners[0].targets)
+	}
+	c.SetupTagSet()
+	if c.ts["192.0.2.1"]["dst_hostname"] != "reflector.example" {
+		t.Error("Host not tagged. Got", c.ts["192.0.2.1"])
+	}
+}
+
+func TestSetupTestRunnersError(t *testing.T) {
+	c := &Collector{}
+	yamlData := `
+tests:
+  - targets: missing
+    port_group: pg1
+    rate_limit: rl1
+rate_limits:
+  rl1:
+    cps: 10
+`
+	_ = c.loadConfigFromData([]byte(yamlData))
+	err := c.SetupTestRunners()
+	if err == nil || !strings.Contains(err.Error(), `"missing"`) {
+		t.Error("Expected an error for the missing target set. Got", err)
+	}
+	if len(c.runners) != 0 {
+		t.Error("Runners added despite an error. Got", len(c.runners))
+	}
 }
 
 func TestLoadConfigWithFlag(t *testing.T) {
@@ -345,12 +849,12 @@ func TestLoadConfigWithFlag(t *testing.T) {
 
 	tmpFile, _ := os.CreateTemp("", "udprobe-*.yaml")
 	defer os.Remove(tmpFile.Name())
-	tmpFile.Write([]byte("targets: {}"))
+	tmpFile.Write([]byte(defaultCollectorConfigYAML))
 	tmpFile.Close()
 
 	*configFile = tmpFile.Name()
-	c.LoadConfig()
-	if c.cfg == nil {
+	err := c.LoadConfig()
+	if err != nil || c.cfg == nil {
 		t.Error("LoadConfig with flag failed to set c.cfg")
 	}
 }
@@ -359,7 +863,10 @@ func TestSetup(t *testing.T) {
 	c := &Collector{}
 	// Setup calls LoadConfig. If no flag is set, it loads default config.
 	// We'll ensure it doesn't crash.
-	c.Setup()
+	err := c.Setup(context.Background())
+	if err != nil {
+		t.Error("Setup failed:", err)
+	}
 }
 
 func TestLoadConfigFromFlag(t *testing.T) {
@@ -1,8 +1,11 @@
 package udprobe
 
 import (
+	"context"
 	"fmt"
 	"net"
+	"strconv"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
@@ -44,10 +47,28 @@ targets:
 
 // PortConfig describes the configuration for a single Port.
 type PortConfig struct {
-	IP      string `yaml:"ip"`
-	Port    int64  `yaml:"port"`
-	Tos     int64  `yaml:"tos"`
-	Timeout int64  `yaml:"timeout"`
+	IP         string `yaml:"ip"`
+	Port       int64  `yaml:"port"`
+	Network    string `yaml:"network"` // "udp" (default, dual-stack if IP is any), "udp4", or "udp6"
+	Tos        int64  `yaml:"tos"`
+	Timeout    int64  `yaml:"timeout"`
+	Timestamps string `yaml:"timestamps"` // "kernel" (default), "software", "hardware", or "userspace"
+	Batch      int64  `yaml:"batch"`      // Probes per send/receive syscall, 1 (default) disables
+}
+
+// AddrString converts the pc into a string formatted "IP:port" combo, with
+// brackets around IPv6 addresses.
+func (pc *PortConfig) AddrString() string {
+	return net.JoinHostPort(pc.IP, strconv.FormatInt(pc.Port, 10))
+}
+
+// NetworkString provides the network to listen on for the pc, filling in
+// DefaultNetwork if it isn't set.
+func (pc *PortConfig) NetworkString() string {
+	if pc.Network == "" {
+		return DefaultNetwork
+	}
+	return pc.Network
 }
 
 // PortsConfig is a mapping of port "name" to a PortConfig.
@@ -99,21 +120,111 @@ type TestConfig struct {
 	RateLimit string `yaml:"rate_limit"` // Should correspond with a RateLimitsConfig key
 }
 
+// runnerConfig is what a TestRunner is created from for a TestConfig, other
+// than its targets, with the named elements looked up.
+type runnerConfig struct {
+	RateLimit RateLimitConfig
+	Ports     []runnerPortConfig
+}
+
+// runnerPortConfig is a PortGroupConfig with its port looked up.
+type runnerPortConfig struct {
+	Port  PortConfig
+	Count int64
+}
+
+// RunnerKey provides a key for the TestRunner that would be created for the
+// test, which only changes if the ports or rate limit it uses do. It doesn't
+// depend on the names of those elements, or on the targets, since they can
+// be changed without recreating the TestRunner.
+//
+// Returns false if any of the named elements don't exist.
+func (cc *CollectorConfig) RunnerKey(test TestConfig) (string, bool) {
+	if !cc.RateLimits.Exists(test.RateLimit) ||
+		!cc.PortGroups.Exists(test.PortGroup) {
+		return "", false
+	}
+	rc := runnerConfig{RateLimit: cc.RateLimits[test.RateLimit]}
+	for _, pgc := range cc.PortGroups[test.PortGroup] {
+		if !cc.Ports.Exists(pgc.Port) {
+			return "", false
+		}
+		rc.Ports = append(rc.Ports, runnerPortConfig{
+			Port:  cc.Ports[pgc.Port],
+			Count: pgc.Count,
+		})
+	}
+	return fmt.Sprintf("%+v", rc), true
+}
+
+// fixedPorts provides the source ports that the port group of the test binds
+// to, other than those that are picked automatically.
+func (cc *CollectorConfig) fixedPorts(test TestConfig) []int {
+	var ports []int
+	for _, pgc := range cc.PortGroups[test.PortGroup] {
+		if pc, ok := cc.Ports[pgc.Port]; ok && pc.Port != 0 {
+			ports = append(ports, int(pc.Port))
+		}
+	}
+	return ports
+}
+
 // TestsConfig is a slice of TestConfig structs.
 type TestsConfig []TestConfig
 
 // TargetConfig describes a single target for testing, including tags that
 // are applied to the resulting summaries.
+//
+// One of IP, Host, SRV, File or URL is set. A Host is looked up periodically,
+// and every address it has is tested, tagged with the Host as dst_hostname.
+// An SRV is the same, for the host and port of each of its records. A File
+// lists targets, and is reread whenever it changes. A URL is polled for a
+// JSON list of targets. See Discover.
+//
+// The IP can also be a CIDR block or range of addresses, which stands for a
+// target for each address, less those in Exclude, and at most Limit of them.
 type TargetConfig struct {
-	IP   string `yaml:"ip"`
-	Port int64  `yaml:"port"`
-	Tags Tags   `yaml:"tags"`
+	IP      string   `yaml:"ip,omitempty"`      // Or "10.0.0.0/24", or "10.0.0.1-10.0.0.20"
+	Exclude []string `yaml:"exclude,omitempty"` // IPs, blocks or ranges left out of a range
+	Limit   int64    `yaml:"limit,omitempty"`   // Most targets sampled from a range, 0 for all
+	Host    string   `yaml:"host,omitempty"`
+	SRV     string   `yaml:"srv,omitempty"`      // Full name, like _udprobe._udp.example.com
+	TXTTags bool     `yaml:"txt_tags,omitempty"` // Tags from TXT records of SRV hosts
+	File    string   `yaml:"file,omitempty"`     // Path to a Prometheus file_sd file
+	URL     string   `yaml:"url,omitempty"`      // HTTP(S) endpoint listing targets
+	Timeout int64    `yaml:"timeout,omitempty"`  // Milliseconds for each lookup, 0 for the default
+	Port    int64    `yaml:"port,omitempty"`     // From the records for SRV, default for File and URL
+	Tags    Tags     `yaml:"tags"`
 }
 
-// AddrString converts the tc into a string formated "IP:port" combo.
+// AddrString converts the tc into a string formated "IP:port" combo, with
+// brackets around IPv6 addresses. The Host, SRV, File or URL is used in place
+// of the IP if it isn't set.
 func (tc *TargetConfig) AddrString() string {
-	str := fmt.Sprintf("%v:%v", tc.IP, tc.Port)
-	return str
+	host := tc.IP
+	if host == "" {
+		host = tc.Host
+	}
+	if host == "" {
+		host = tc.SRV
+	}
+	if host == "" {
+		host = tc.File
+	}
+	if host == "" {
+		host = tc.URL
+	}
+	return net.JoinHostPort(host, strconv.FormatInt(tc.Port, 10))
+}
+
+// TagKey provides the key for the tc's tags in a TagSet. This is the IP in
+// the same form as net.IP.String(), so it matches the summaries regardless of
+// how an IPv6 address is written in the config.
+func (tc *TargetConfig) TagKey() string {
+	if ip := net.ParseIP(tc.IP); ip != nil {
+		return ip.String()
+	}
+	return tc.IP
 }
 
 // ResolveUDPAddr converts the tc into a net.UDPAddr pointer.
@@ -124,6 +235,47 @@ func (tc *TargetConfig) ResolveUDPAddr() (*net.UDPAddr, error) {
 // TargetSet is a slice of TargetConfig structs.
 type TargetSet []TargetConfig
 
+// Resolve provides a copy of the ts with each target replaced by the ones it
+// provides via Discover, using the default resolver, and will return with an
+// error as soon as one fails. Each is given its LookupTimeout.
+func (ts TargetSet) Resolve() (TargetSet, error) {
+	resolved := make(TargetSet, 0, len(ts))
+	for _, target := range ts {
+		ctx, cancel := context.WithTimeout(context.Background(),
+			target.LookupTimeout())
+		discovered, err := target.Discover(ctx, net.DefaultResolver)
+		cancel()
+		if err != nil {
+			return resolved, err
+		}
+		resolved = append(resolved, discovered...)
+	}
+	return resolved, nil
+}
+
+// Dynamic reports if any of the targets in the ts can change while running,
+// and so need a TargetWatcher to follow them.
+func (ts TargetSet) Dynamic() bool {
+	for _, target := range ts {
+		if target.Host != "" || target.SRV != "" || target.File != "" ||
+			target.URL != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Files provides the paths of the files that targets in the ts are listed in.
+func (ts TargetSet) Files() []string {
+	var files []string
+	for _, target := range ts {
+		if target.File != "" {
+			files = append(files, target.File)
+		}
+	}
+	return files
+}
+
 // TagSet converts the ts into TagSet struct.
 func (ts TargetSet) TagSet(srcHostname string) TagSet {
 	tagset := make(TagSet)
@@ -139,7 +291,12 @@ func (ts TargetSet) TagSet(srcHostname string) TagSet {
 // multiple TargetSets with different tag values for the same key.
 func (ts TargetSet) IntoTagSet(tagset TagSet, srcHostname string, targetSetName string) {
 	for _, target := range ts {
-		key := target.IP
+		// Tags for hosts and ranges depend on their addresses, see
+		// TargetWatcher
+		if target.IP == "" || target.IsRange() {
+			continue
+		}
+		key := target.TagKey()
 		if tagset[key] == nil {
 			tagset[key] = make(Tags)
 		}
@@ -201,7 +358,8 @@ func (tc TargetsConfig) Exists(name string) bool {
 // within the tc.
 //
 // NOTE: If the same IP appears in multiple TargetSets with different tag values
-// for the same key, a warning is logged and the last TargetSet's values win.
+// for the same key, a warning is logged and the values from the TargetSet
+// with the last name, in sorted order, win.
 func (tc TargetsConfig) TagSet(srcHostname string) TagSet {
 	ts := make(TagSet)
 	tc.IntoTagSet(ts, srcHostname)
@@ -211,16 +369,155 @@ func (tc TargetsConfig) TagSet(srcHostname string) TagSet {
 // IntoTagSet is a wrapper about the same function for each contained TargetSet
 // and merges them into an existing ts.
 func (tc TargetsConfig) IntoTagSet(ts TagSet, srcHostname string) {
+	// Sorted, so conflicts are resolved the same way every time
+	for _, name := range sortedKeys(tc) {
+		tc[name].IntoTagSet(ts, srcHostname, name)
+	}
+}
+
+// Resolve provides a copy of the tc with all of the TargetSets resolved, as
+// with TargetSet.Resolve.
+func (tc TargetsConfig) Resolve() (TargetsConfig, error) {
+	resolved := make(TargetsConfig, len(tc))
 	for name, targetSet := range tc {
-		targetSet.IntoTagSet(ts, srcHostname, name)
+		targetSet, err := targetSet.Resolve()
+		if err != nil {
+			return resolved, fmt.Errorf("failed to resolve target set %q: %w",
+				name, err)
+		}
+		resolved[name] = targetSet
 	}
+	return resolved, nil
 }
 
 // SummarizationConfig describes the parameters for setting up a Summarizer
 // and related ResultHandlers.
 type SummarizationConfig struct {
-	Interval int64 `yaml:"interval"`
-	Handlers int64 `yaml:"handlers"`
+	Interval    int64     `yaml:"interval"`
+	Handlers    int64     `yaml:"handlers"`
+	Percentiles []float64 `yaml:"percentiles"` // RTT percentile ranks, out of 100
+	Buckets     []float64 `yaml:"buckets"`     // RTT histogram upper bounds in ms
+}
+
+// DiscoveryConfig describes how targets that can change, such as hostnames,
+// are followed.
+type DiscoveryConfig struct {
+	Interval int64 `yaml:"interval"` // Seconds between lookups, 0 for the default
+}
+
+// IntervalDuration provides the interval as a Duration, filling in
+// DefaultDiscoveryInterval if it isn't set.
+func (dc *DiscoveryConfig) IntervalDuration() time.Duration {
+	if dc.Interval == 0 {
+		return DefaultDiscoveryInterval
+	}
+	return time.Duration(dc.Interval) * time.Second
+}
+
+// InfluxConfig describes where summaries are pushed to in InfluxDB line
+// protocol.
+type InfluxConfig struct {
+	URL       string `yaml:"url,omitempty"`        // The /write URL
+	BatchSize int64  `yaml:"batch_size,omitempty"` // Lines per request, 0 for the default
+	Retries   *int64 `yaml:"retries,omitempty"`    // After the first attempt, nil for the default
+	Timeout   int64  `yaml:"timeout,omitempty"`    // Milliseconds per request, 0 for the default
+}
+
+// SetDefaults fills in the defaults for anything that isn't set, if the ic
+// has a URL.
+func (ic *InfluxConfig) SetDefaults() {
+	if ic.URL == "" {
+		return
+	}
+	if ic.BatchSize == 0 {
+		ic.BatchSize = DefaultInfluxBatchSize
+	}
+	// 0 is no retries, so only unset is the default
+	if ic.Retries == nil {
+		retries := int64(DefaultInfluxRetries)
+		ic.Retries = &retries
+	}
+	if ic.Timeout == 0 {
+		ic.Timeout = int64(DefaultInfluxTimeout / time.Millisecond)
+	}
+}
+
+// Formats of the files written by FileSink.
+const (
+	FileFormatJSONL = "jsonl" // The default
+	FileFormatCSV   = "csv"
+)
+
+// FileConfig describes the files that summaries are written to, and when
+// they're rotated.
+type FileConfig struct {
+	Path     string `yaml:"path,omitempty"`
+	Format   string `yaml:"format,omitempty"`    // jsonl or csv, empty for jsonl
+	MaxSize  int64  `yaml:"max_size,omitempty"`  // MiB before rotating, 0 for no limit
+	MaxAge   int64  `yaml:"max_age,omitempty"`   // Seconds before rotating, 0 for no limit
+	Compress bool   `yaml:"compress,omitempty"`  // Gzip rotated files
+	MaxFiles int64  `yaml:"max_files,omitempty"` // Rotated files kept, 0 to keep all
+}
+
+// FormatString provides the Format of the fc, or FileFormatJSONL if it isn't
+// set.
+func (fc *FileConfig) FormatString() string {
+	if fc.Format == "" {
+		return FileFormatJSONL
+	}
+	return fc.Format
+}
+
+// Types of SummarySink that can be configured.
+const (
+	SinkStdout = "stdout" // JSON lines, see JSONLinesSink
+	SinkFile   = "file"   // See FileSink
+	SinkInflux = "influx" // See InfluxPusher
+)
+
+// SinkConfig describes a SummarySink that each set of summaries is written
+// to. Only the fields for its Type are set.
+type SinkConfig struct {
+	Type         string `yaml:"type"`
+	FileConfig   `yaml:",inline"`
+	InfluxConfig `yaml:",inline"`
+}
+
+// SinksConfig is a slice of SinkConfig structs.
+type SinksConfig []SinkConfig
+
+// Formats of the results written by RawExporter.
+const (
+	RawFormatJSONL  = "jsonl" // The default
+	RawFormatBinary = "binary"
+)
+
+// RawConfig describes where every individual Result is exported to, if
+// anywhere. Only one of Path and Socket is set.
+type RawConfig struct {
+	Path       string  `yaml:"path,omitempty"`        // File to append to
+	Socket     string  `yaml:"socket,omitempty"`      // Unix socket to connect to
+	Format     string  `yaml:"format,omitempty"`      // jsonl or binary, empty for jsonl
+	SampleRate float64 `yaml:"sample_rate,omitempty"` // Fraction exported, 0 for all of them
+}
+
+// Enabled reports if the rc has somewhere to export results to.
+func (rc *RawConfig) Enabled() bool {
+	return rc.Path != "" || rc.Socket != ""
+}
+
+// SetDefaults fills in the defaults for anything that isn't set, if the rc
+// is Enabled.
+func (rc *RawConfig) SetDefaults() {
+	if !rc.Enabled() {
+		return
+	}
+	if rc.Format == "" {
+		rc.Format = RawFormatJSONL
+	}
+	if rc.SampleRate == 0 {
+		rc.SampleRate = 1
+	}
 }
 
 // APIConfig describes the parameters for the JSON HTTP API.
@@ -239,24 +536,77 @@ type CollectorConfig struct {
 	RateLimits    RateLimitsConfig    `yaml:"rate_limits"`
 	Tests         TestsConfig         `yaml:"tests"`
 	Targets       TargetsConfig       `yaml:"targets"`
+	Discovery     DiscoveryConfig     `yaml:"discovery"`
+	Sinks         SinksConfig         `yaml:"sinks"`
+	Raw           RawConfig           `yaml:"raw"`
+}
+
+// SetDefaults fills in the defaults that are otherwise applied when values
+// are left empty, so the cc shows what is actually used.
+func (cc *CollectorConfig) SetDefaults() {
+	if len(cc.Summarization.Percentiles) == 0 {
+		cc.Summarization.Percentiles = append([]float64(nil), DefaultPercentiles...)
+	}
+	if cc.Discovery.Interval == 0 {
+		cc.Discovery.Interval = int64(DefaultDiscoveryInterval / time.Second)
+	}
+	if len(cc.Summarization.Buckets) == 0 {
+		cc.Summarization.Buckets = append([]float64(nil), DefaultRTTBuckets...)
+	}
+	for name, pc := range cc.Ports {
+		pc.Network = pc.NetworkString()
+		if pc.Timestamps == "" {
+			pc.Timestamps = string(DefaultTimestampMode)
+		}
+		if pc.Batch == 0 {
+			pc.Batch = 1
+		}
+		cc.Ports[name] = pc
+	}
+	for i := range cc.Sinks {
+		switch cc.Sinks[i].Type {
+		case SinkFile:
+			cc.Sinks[i].Format = cc.Sinks[i].FormatString()
+		case SinkInflux:
+			cc.Sinks[i].InfluxConfig.SetDefaults()
+		}
+	}
+	cc.Raw.SetDefaults()
 }
 
 //
 // Config Creators
 //
 
+// ParseCollectorConfig provides a parsed CollectorConfig from data in either
+// the legacy or standard format, and whether it was in the legacy format.
+//
+// `legacyPort` is the port applied to targets in a legacy config.
+func ParseCollectorConfig(data []byte, legacyPort int64) (*CollectorConfig, bool, error) {
+	// Try parsing as a legacy config first
+	lcfg, err := NewLegacyCollectorConfig(data)
+	// If it's a legacy config, convert to standard config
+	if err == nil {
+		cfg, err := lcfg.ToDefaultCollectorConfig(legacyPort)
+		return cfg, true, err
+	}
+	// If it's not a legacy config, handle it like a standard one
+	cfg, err := NewCollectorConfig(data)
+	return cfg, false, err
+}
+
 // NewDefaultCollectorConfig provides a sensible default collector config.
 func NewDefaultCollectorConfig() (*CollectorConfig, error) {
 	return NewCollectorConfig([]byte(defaultCollectorConfigYAML))
 }
 
 // NewCollectorConfig provides a parsed CollectorConfig based on the provided
-// data.
+// data. Unknown fields are an error, but values aren't checked until Validate.
 //
 // `data` is expected to be a byte slice version of a YAML CollectorConfig.
 func NewCollectorConfig(data []byte) (*CollectorConfig, error) {
 	cc := &CollectorConfig{}
-	err := yaml.Unmarshal(data, cc)
+	err := yaml.UnmarshalStrict(data, cc)
 	if err != nil {
 		return cc, fmt.Errorf("failed to parse collector config: %s", err)
 	}
@@ -278,11 +628,12 @@ func (legacy *LegacyCollectorConfig) ToDefaultCollectorConfig(port int64) (*Coll
 	cc.Targets = make(TargetsConfig)
 	// Parse the targets from the old style into the new one.
 	// This requires the "default" options from above for now.
-	for addr, tags := range *legacy {
+	// Sorted, so the converted config is the same every time
+	for _, addr := range sortedKeys(*legacy) {
 		cc.Targets["default"] = append(cc.Targets["default"], TargetConfig{
 			IP:   addr,
 			Port: port,
-			Tags: tags,
+			Tags: (*legacy)[addr],
 		})
 	}
 	return cc, nil
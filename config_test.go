@@ -1,7 +1,10 @@
 package udprobe
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 )
 
 var exampleTargetConfig = TargetConfig{
@@ -51,6 +54,41 @@ func TestTargetConfigAddrString(t *testing.T) {
 	}
 }
 
+func TestTargetConfigIPv6(t *testing.T) {
+	tc := TargetConfig{IP: "2001:DB8::0:1", Port: 8100}
+	if tc.AddrString() != "[2001:DB8::0:1]:8100" {
+		t.Error("IPv6 target addr not formatted correctly. Got", tc.AddrString())
+	}
+	addr, err := tc.ResolveUDPAddr()
+	if err != nil {
+		t.Fatal("IPv6 target couldn't be converted to UDPAddr:", err)
+	}
+	// Tags need to line up with the summaries, which use net.IP.String()
+	if tc.TagKey() != addr.IP.String() {
+		t.Error("Tag key doesn't match the resolved IP. Got", tc.TagKey(),
+			"expected", addr.IP.String())
+	}
+	tagset := TargetSet{tc}.TagSet("")
+	if _, ok := tagset["2001:db8::1"]; !ok {
+		t.Error("IPv6 target not added to tagset with normalized key. Got",
+			tagset)
+	}
+}
+
+func TestPortConfigAddrString(t *testing.T) {
+	pc := PortConfig{IP: "::", Port: 0}
+	if pc.AddrString() != "[::]:0" {
+		t.Error("IPv6 port addr not formatted correctly. Got", pc.AddrString())
+	}
+	if pc.NetworkString() != DefaultNetwork {
+		t.Error("Expected default network. Got", pc.NetworkString())
+	}
+	pc.Network = "udp6"
+	if pc.NetworkString() != "udp6" {
+		t.Error("Network not used when provided. Got", pc.NetworkString())
+	}
+}
+
 func TestTargetConfigResolveUDPAddr(t *testing.T) {
 	_, err := exampleTargetConfig.ResolveUDPAddr()
 	if err != nil {
@@ -318,3 +356,128 @@ func TestTargetsConfigExists(t *testing.T) {
 		t.Error("Expected 'nonexistent' to not exist")
 	}
 }
+
+func TestCollectorConfigRunnerKey(t *testing.T) {
+	cc := &CollectorConfig{
+		Ports:      examplePortsConfig,
+		PortGroups: examplePortGroupsConfig,
+		RateLimits: exampleRateLimitsConfig,
+	}
+	key, ok := cc.RunnerKey(TestConfig{PortGroup: "default", RateLimit: "default"})
+	if !ok {
+		t.Fatal("RunnerKey failed for existing elements")
+	}
+	// Only the contents matter, not the names or targets
+	cc.PortGroups = PortGroupsConfig{"renamed": {{Port: "default", Count: 4}}}
+	renamed, _ := cc.RunnerKey(TestConfig{Targets: "example",
+		PortGroup: "renamed", RateLimit: "default"})
+	if renamed != key {
+		t.Error("RunnerKey changed with names. Got", renamed, "expected", key)
+	}
+	changed, _ := cc.RunnerKey(TestConfig{PortGroup: "renamed", RateLimit: "high"})
+	if changed == key {
+		t.Error("RunnerKey didn't change with the rate limit")
+	}
+	cc.PortGroups["renamed"][0].Count = 2
+	changed, _ = cc.RunnerKey(TestConfig{PortGroup: "renamed", RateLimit: "default"})
+	if changed == key {
+		t.Error("RunnerKey didn't change with the port count")
+	}
+	_, ok = cc.RunnerKey(TestConfig{PortGroup: "nonexistent", RateLimit: "default"})
+	if ok {
+		t.Error("RunnerKey succeeded for a nonexistent port group")
+	}
+}
+
+func TestParseCollectorConfig(t *testing.T) {
+	cc, legacy, err := ParseCollectorConfig([]byte(exampleLegacyConfig), 1234)
+	if err != nil || !legacy {
+		t.Fatal("Failed to parse legacy config. Got", legacy, err)
+	}
+	// Converted in order of IP
+	if len(cc.Targets["default"]) != 2 ||
+		cc.Targets["default"][0].IP != "1.2.3.4" ||
+		cc.Targets["default"][0].Port != 1234 {
+		t.Error("Wrong targets from legacy config. Got", cc.Targets)
+	}
+	_, legacy, err = ParseCollectorConfig([]byte(defaultCollectorConfigYAML), 1234)
+	if err != nil || legacy {
+		t.Error("Failed to parse standard config. Got", legacy, err)
+	}
+}
+
+func TestCollectorConfigSetDefaults(t *testing.T) {
+	cc := &CollectorConfig{Ports: PortsConfig{"p1": {IP: "127.0.0.1"}}}
+	cc.SetDefaults()
+	if len(cc.Summarization.Percentiles) != len(DefaultPercentiles) {
+		t.Error("Percentiles not defaulted. Got", cc.Summarization.Percentiles)
+	}
+	if len(cc.Summarization.Buckets) != len(DefaultRTTBuckets) {
+		t.Error("Buckets not defaulted. Got", cc.Summarization.Buckets)
+	}
+	pc := cc.Ports["p1"]
+	if pc.Network != DefaultNetwork || pc.Timestamps != string(DefaultTimestampMode) ||
+		pc.Batch != 1 {
+		t.Error("Port not defaulted. Got", pc)
+	}
+}
+
+func TestTargetsConfigResolve(t *testing.T) {
+	tc := TargetsConfig{"v6": {{IP: "2001:DB8::0:1", Port: 8100, Tags: Tags{"a": "b"}}}}
+	resolved, err := tc.Resolve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := resolved["v6"][0]
+	if target.IP != "2001:db8::1" || target.Port != 8100 || target.Tags["a"] != "b" {
+		t.Error("Wrong resolved target. Got", target)
+	}
+	// The original is left as-is
+	if tc["v6"][0].IP != "2001:DB8::0:1" {
+		t.Error("Original target changed. Got", tc["v6"][0].IP)
+	}
+}
+
+func TestTargetSetResolveTimeout(t *testing.T) {
+	done := make(chan struct{})
+	defer close(done)
+	// Never responds
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-done:
+			case <-r.Context().Done():
+			}
+		}))
+	defer srv.Close()
+	ts := TargetSet{{URL: srv.URL, Timeout: 50}}
+	start := time.Now()
+	if _, err := ts.Resolve(); err == nil {
+		t.Error("Expected an error for a target URL that never responds")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Error("Resolve didn't give up after the timeout. Took", elapsed)
+	}
+}
+
+func TestInfluxConfigSetDefaults(t *testing.T) {
+	ic := InfluxConfig{}
+	ic.SetDefaults()
+	if ic.BatchSize != 0 {
+		t.Error("Defaults set without a URL. Got", ic)
+	}
+	ic = InfluxConfig{URL: "http://localhost:8086/write?db=udprobe"}
+	ic.SetDefaults()
+	if ic.BatchSize != DefaultInfluxBatchSize || *ic.Retries != DefaultInfluxRetries ||
+		ic.Timeout != 5000 {
+		t.Error("Wrong defaults. Got", ic)
+	}
+	// No retries is kept, rather than replaced with the default
+	retries := int64(0)
+	ic = InfluxConfig{URL: "http://localhost:8086/write?db=udprobe",
+		Retries: &retries}
+	ic.SetDefaults()
+	if *ic.Retries != 0 {
+		t.Error("Explicit retries replaced. Got", *ic.Retries, "expected", 0)
+	}
+}
@@ -0,0 +1,314 @@
+package udprobe
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// ConfigError is a problem with a single value in a CollectorConfig.
+type ConfigError struct {
+	Path string // YAML path to the value, ex. "ports.default.tos"
+	Msg  string
+}
+
+func (e *ConfigError) Error() string {
+	return e.Path + ": " + e.Msg
+}
+
+// ConfigErrors is every problem found in a CollectorConfig by Validate.
+type ConfigErrors []*ConfigError
+
+func (errs ConfigErrors) Error() string {
+	msgs := make([]string, 0, len(errs))
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+	return fmt.Sprintf("%d problems in config: %s", len(errs),
+		strings.Join(msgs, "; "))
+}
+
+// add records a problem with the value at path.
+func (errs *ConfigErrors) add(path string, format string, args ...interface{}) {
+	*errs = append(*errs, &ConfigError{Path: path, Msg: fmt.Sprintf(format, args...)})
+}
+
+// Validate checks that all of the named references in the cc exist, and that
+// all of the values are usable, so that any problems are found before
+// anything is created from it.
+//
+// Returns nil if the cc is valid, otherwise ConfigErrors with every problem.
+func (cc *CollectorConfig) Validate() error {
+	var errs ConfigErrors
+	cc.Summarization.validate(&errs, "summarization")
+	if _, _, err := net.SplitHostPort(cc.API.Bind); err != nil {
+		errs.add("api.bind", "invalid address %q", cc.API.Bind)
+	}
+	for _, name := range sortedKeys(cc.Ports) {
+		pc := cc.Ports[name]
+		pc.validate(&errs, "ports."+name)
+	}
+	for _, name := range sortedKeys(cc.PortGroups) {
+		path := "port_groups." + name
+		if len(cc.PortGroups[name]) == 0 {
+			errs.add(path, "no ports in port group")
+		}
+		for i, pgc := range cc.PortGroups[name] {
+			path := fmt.Sprintf("%s[%d]", path, i)
+			if !cc.Ports.Exists(pgc.Port) {
+				errs.add(path+".port", "port %q not found in ports", pgc.Port)
+			}
+			if pgc.Count < 1 {
+				errs.add(path+".count", "must be at least 1, not %d", pgc.Count)
+			}
+		}
+	}
+	for _, name := range sortedKeys(cc.RateLimits) {
+		if cps := cc.RateLimits[name].CPS; cps <= 0 {
+			errs.add("rate_limits."+name+".cps", "must be positive, not %v", cps)
+		}
+	}
+	for i, test := range cc.Tests {
+		path := fmt.Sprintf("tests[%d]", i)
+		if !cc.Targets.Exists(test.Targets) {
+			errs.add(path+".targets", "target set %q not found in targets",
+				test.Targets)
+		}
+		if !cc.PortGroups.Exists(test.PortGroup) {
+			errs.add(path+".port_group", "port group %q not found in port_groups",
+				test.PortGroup)
+		}
+		if !cc.RateLimits.Exists(test.RateLimit) {
+			errs.add(path+".rate_limit", "rate limit %q not found in rate_limits",
+				test.RateLimit)
+		}
+	}
+	for _, name := range sortedKeys(cc.Targets) {
+		for i, tc := range cc.Targets[name] {
+			tc.validate(&errs, fmt.Sprintf("targets.%s[%d]", name, i))
+		}
+	}
+	if cc.Discovery.Interval < 0 {
+		errs.add("discovery.interval", "must not be negative, not %d",
+			cc.Discovery.Interval)
+	}
+	for i, sc := range cc.Sinks {
+		sc.validate(&errs, fmt.Sprintf("sinks[%d]", i))
+	}
+	cc.Raw.validate(&errs, "raw")
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// validate adds any problems with the sc to errs.
+func (sc *SummarizationConfig) validate(errs *ConfigErrors, path string) {
+	if sc.Interval < 1 {
+		errs.add(path+".interval", "must be at least 1 second, not %d",
+			sc.Interval)
+	}
+	if sc.Handlers < 1 {
+		errs.add(path+".handlers", "must be at least 1, not %d", sc.Handlers)
+	}
+	for i, p := range sc.Percentiles {
+		if p < 0 || p > 100 {
+			errs.add(fmt.Sprintf("%s.percentiles[%d]", path, i),
+				"must be between 0 and 100, not %v", p)
+		}
+	}
+	for i, b := range sc.Buckets {
+		if b <= 0 {
+			errs.add(fmt.Sprintf("%s.buckets[%d]", path, i),
+				"must be positive, not %v", b)
+		}
+	}
+}
+
+// validate adds any problems with the sc to errs.
+func (sc *SinkConfig) validate(errs *ConfigErrors, path string) {
+	switch sc.Type {
+	case SinkStdout, SinkFile, SinkInflux:
+	default:
+		errs.add(path+".type", "unknown sink type %q", sc.Type)
+		return
+	}
+	if sc.Type == SinkFile {
+		sc.FileConfig.validate(errs, path)
+	} else if sc.FileConfig != (FileConfig{}) {
+		errs.add(path, "path, format, max_size, max_age, compress and "+
+			"max_files only apply to a file sink")
+	}
+	if sc.Type == SinkInflux {
+		sc.InfluxConfig.validate(errs, path)
+	} else if sc.InfluxConfig != (InfluxConfig{}) {
+		errs.add(path, "url, batch_size, retries and timeout only apply to "+
+			"an influx sink")
+	}
+}
+
+// validate adds any problems with the fc to errs.
+func (fc *FileConfig) validate(errs *ConfigErrors, path string) {
+	if fc.Path == "" {
+		errs.add(path+".path", "required for a file sink")
+	}
+	switch fc.FormatString() {
+	case FileFormatJSONL, FileFormatCSV:
+	default:
+		errs.add(path+".format", "unknown format %q, expected %s or %s",
+			fc.Format, FileFormatJSONL, FileFormatCSV)
+	}
+	if fc.MaxSize < 0 {
+		errs.add(path+".max_size", "must not be negative, not %d", fc.MaxSize)
+	}
+	if fc.MaxAge < 0 {
+		errs.add(path+".max_age", "must not be negative, not %d", fc.MaxAge)
+	}
+	if fc.MaxFiles < 0 {
+		errs.add(path+".max_files", "must not be negative, not %d",
+			fc.MaxFiles)
+	}
+}
+
+// validate adds any problems with the rc to errs.
+func (rc *RawConfig) validate(errs *ConfigErrors, path string) {
+	if rc.Path != "" && rc.Socket != "" {
+		errs.add(path, "only one of path and socket can be set")
+	}
+	if !rc.Enabled() {
+		if rc.Format != "" || rc.SampleRate != 0 {
+			errs.add(path, "format and sample_rate need a path or socket")
+		}
+		return
+	}
+	switch rc.Format {
+	case "", RawFormatJSONL, RawFormatBinary:
+	default:
+		errs.add(path+".format", "unknown format %q, expected %s or %s",
+			rc.Format, RawFormatJSONL, RawFormatBinary)
+	}
+	if rc.SampleRate < 0 || rc.SampleRate > 1 {
+		errs.add(path+".sample_rate", "must be between 0 and 1, not %v",
+			rc.SampleRate)
+	}
+}
+
+// validate adds any problems with the ic to errs.
+func (ic *InfluxConfig) validate(errs *ConfigErrors, path string) {
+	if u, err := url.Parse(ic.URL); err != nil ||
+		(u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs.add(path+".url", "invalid HTTP URL %q", ic.URL)
+	}
+	if ic.BatchSize < 0 {
+		errs.add(path+".batch_size", "must not be negative, not %d",
+			ic.BatchSize)
+	}
+	if ic.Retries != nil && *ic.Retries < 0 {
+		errs.add(path+".retries", "must not be negative, not %d", *ic.Retries)
+	}
+	if ic.Timeout < 0 {
+		errs.add(path+".timeout", "must not be negative, not %d", ic.Timeout)
+	}
+}
+
+// validate adds any problems with the pc to errs.
+func (pc *PortConfig) validate(errs *ConfigErrors, path string) {
+	// Empty listens on all addresses
+	if pc.IP != "" && net.ParseIP(pc.IP) == nil {
+		errs.add(path+".ip", "invalid IP %q", pc.IP)
+	}
+	if pc.Port < 0 || pc.Port > 65535 {
+		errs.add(path+".port", "must be between 0 and 65535, not %d", pc.Port)
+	}
+	switch pc.Network {
+	case "", "udp", "udp4", "udp6":
+	default:
+		errs.add(path+".network", "unknown network %q", pc.Network)
+	}
+	if pc.Tos < 0 || pc.Tos > 255 {
+		errs.add(path+".tos", "must be between 0 and 255, not %d", pc.Tos)
+	}
+	if pc.Timeout < 1 {
+		errs.add(path+".timeout", "must be at least 1 ms, not %d", pc.Timeout)
+	}
+	if _, err := ParseTimestampMode(pc.Timestamps); err != nil {
+		errs.add(path+".timestamps", "%s", err)
+	}
+	if pc.Batch < 0 {
+		errs.add(path+".batch", "must not be negative, not %d", pc.Batch)
+	}
+}
+
+// validate adds any problems with the tc to errs.
+func (tc *TargetConfig) validate(errs *ConfigErrors, path string) {
+	set := 0
+	for _, s := range []string{tc.IP, tc.Host, tc.SRV, tc.File, tc.URL} {
+		if s != "" {
+			set++
+		}
+	}
+	switch {
+	case set != 1:
+		errs.add(path, "exactly one of ip, host, srv, file or url must be set")
+	case tc.IsRange():
+		tc.validateRange(errs, path)
+	case tc.IP != "" && net.ParseIP(tc.IP) == nil:
+		errs.add(path+".ip", "invalid IP %q", tc.IP)
+	}
+	if !tc.IsRange() {
+		if len(tc.Exclude) > 0 {
+			errs.add(path+".exclude", "only applies to a CIDR block or range")
+		}
+		if tc.Limit != 0 {
+			errs.add(path+".limit", "only applies to a CIDR block or range")
+		}
+	}
+	if tc.URL != "" {
+		if u, err := url.Parse(tc.URL); err != nil ||
+			(u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs.add(path+".url", "invalid HTTP URL %q", tc.URL)
+		}
+	}
+	if tc.TXTTags && tc.SRV == "" {
+		errs.add(path+".txt_tags", "only applies to srv")
+	}
+	if tc.Timeout < 0 {
+		errs.add(path+".timeout", "must not be negative, not %d", tc.Timeout)
+	}
+	switch {
+	case tc.SRV != "":
+		if tc.Port != 0 {
+			errs.add(path+".port", "comes from the SRV records, so can't be set")
+		}
+	case tc.File != "" || tc.URL != "":
+		// Only a default, for listed targets without one
+		if tc.Port < 0 || tc.Port > 65535 {
+			errs.add(path+".port", "must be between 0 and 65535, not %d",
+				tc.Port)
+		}
+	case tc.Port < 1 || tc.Port > 65535:
+		errs.add(path+".port", "must be between 1 and 65535, not %d", tc.Port)
+	}
+}
+
+// validateRange adds any problems with the CIDR block or range of the tc, and
+// what's left out of it, to errs.
+func (tc *TargetConfig) validateRange(errs *ConfigErrors, path string) {
+	r, err := parseIPRange(tc.IP)
+	if err != nil {
+		errs.add(path+".ip", "invalid CIDR block or range %q: %s", tc.IP, err)
+	} else if size := r.size(); size > MaxTargetRange {
+		errs.add(path+".ip", "%q has %d addresses, more than the limit of %d",
+			tc.IP, size, MaxTargetRange)
+	}
+	for i, s := range tc.Exclude {
+		if _, err := parseIPRange(s); err != nil {
+			errs.add(fmt.Sprintf("%s.exclude[%d]", path, i),
+				"invalid IP, CIDR block or range %q: %s", s, err)
+		}
+	}
+	if tc.Limit < 0 {
+		errs.add(path+".limit", "must not be negative, not %d", tc.Limit)
+	}
+}
@@ -0,0 +1,272 @@
+package udprobe
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+var exampleInvalidConfig = `
+summarization:
+  interval: 0
+  handlers: 1
+  percentiles: [50, 101]
+api:
+  bind: "127.0.0.1:0"
+ports:
+  p1:
+    ip: 0.0.0.300
+    port: 0
+    tos: 256
+    timeout: 0
+    timestamps: sundial
+port_groups:
+  pg1:
+    - port: p1
+      count: 0
+    - port: missing
+      count: 1
+rate_limits:
+  rl1:
+    cps: 0
+tests:
+  - targets: t1
+    port_group: pg2
+    rate_limit: rl1
+targets:
+  t1:
+    - ip: not-an-ip
+      port: 8100
+`
+
+func TestValidateDefault(t *testing.T) {
+	cc, err := NewDefaultCollectorConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cc.Validate()
+	if err != nil {
+		t.Error("Default config is invalid:", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cc, err := NewCollectorConfig([]byte(exampleInvalidConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cc.Validate()
+	var errs ConfigErrors
+	if !errors.As(err, &errs) {
+		t.Fatal("Expected ConfigErrors. Got", err)
+	}
+	expected := []string{
+		"summarization.interval",
+		"summarization.percentiles[1]",
+		"ports.p1.ip",
+		"ports.p1.tos",
+		"ports.p1.timeout",
+		"ports.p1.timestamps",
+		"port_groups.pg1[0].count",
+		"port_groups.pg1[1].port",
+		"rate_limits.rl1.cps",
+		"tests[0].port_group",
+		"targets.t1[0].ip",
+	}
+	if len(errs) != len(expected) {
+		t.Error("Wrong number of problems. Got", errs, "expected", expected)
+	}
+	for i := 0; i < len(errs) && i < len(expected); i++ {
+		if errs[i].Path != expected[i] {
+			t.Error("Wrong path for problem", i, "Got", errs[i].Path,
+				"expected", expected[i])
+		}
+	}
+}
+
+func TestNewCollectorConfigUnknownField(t *testing.T) {
+	_, err := NewCollectorConfig([]byte(`
+ports:
+  p1:
+    ip: 127.0.0.1
+    timout: 1000
+`))
+	if err == nil || !strings.Contains(err.Error(), "timout") {
+		t.Error("Expected an error for the unknown field. Got", err)
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	c := &Collector{}
+	if err := c.loadConfigFromDefault(); err != nil {
+		t.Fatal(err)
+	}
+	cfg := c.cfg
+	oldConfigFile := *configFile
+	defer func() { *configFile = oldConfigFile }()
+	tmpFile, _ := os.CreateTemp("", "udprobe-*.yaml")
+	defer os.Remove(tmpFile.Name())
+	tmpFile.Write([]byte(exampleInvalidConfig))
+	tmpFile.Close()
+	*configFile = tmpFile.Name()
+
+	err := c.LoadConfig()
+	if err == nil || !strings.Contains(err.Error(), "rate_limits.rl1.cps") {
+		t.Error("Expected an error with the invalid paths. Got", err)
+	}
+	if c.cfg != cfg {
+		t.Error("Config replaced by an invalid one")
+	}
+}
+
+func TestValidateTargetHost(t *testing.T) {
+	cc, _ := NewDefaultCollectorConfig()
+	cc.Targets["default"] = TargetSet{
+		{Host: "reflector.example", Port: 8100},
+		{IP: "127.0.0.1", Host: "reflector.example", Port: 8100},
+	}
+	err := cc.Validate()
+	var errs ConfigErrors
+	if !errors.As(err, &errs) || len(errs) != 1 ||
+		errs[0].Path != "targets.default[1]" {
+		t.Error("Expected only the target with both to be invalid. Got", err)
+	}
+}
+
+func TestValidateTargetFile(t *testing.T) {
+	cc, _ := NewDefaultCollectorConfig()
+	cc.Targets["default"] = TargetSet{
+		{File: "targets.json"},
+		{File: "targets.json", Port: 8100},
+		{File: "targets.json", Port: -1},
+	}
+	err := cc.Validate()
+	var errs ConfigErrors
+	if !errors.As(err, &errs) || len(errs) != 1 ||
+		errs[0].Path != "targets.default[2].port" {
+		t.Error("Expected only the negative port to be invalid. Got", err)
+	}
+}
+
+func TestValidateTargetURL(t *testing.T) {
+	cc, _ := NewDefaultCollectorConfig()
+	cc.Targets["default"] = TargetSet{
+		{URL: "https://registry.example/targets", Timeout: 5000},
+		{URL: "registry.example/targets"},
+		{URL: "http://registry.example/targets", Timeout: -1},
+	}
+	err := cc.Validate()
+	var errs ConfigErrors
+	if !errors.As(err, &errs) || len(errs) != 2 ||
+		errs[0].Path != "targets.default[1].url" ||
+		errs[1].Path != "targets.default[2].timeout" {
+		t.Error("Expected the URL without a scheme and negative timeout to be invalid. Got",
+			err)
+	}
+}
+
+func TestValidateTargetRange(t *testing.T) {
+	cc, _ := NewDefaultCollectorConfig()
+	cc.Targets["default"] = TargetSet{
+		{IP: "10.0.0.0/24", Exclude: []string{"10.0.0.1"}, Limit: 10, Port: 8100},
+		{IP: "10.0.0.0/8", Port: 8100},
+		{IP: "10.0.0.1-10.0.0.5", Exclude: []string{"nope"}, Port: 8100},
+		{IP: "10.0.0.1", Limit: 10, Port: 8100},
+	}
+	err := cc.Validate()
+	var errs ConfigErrors
+	if !errors.As(err, &errs) {
+		t.Fatal("Expected ConfigErrors. Got", err)
+	}
+	expected := []string{
+		"targets.default[1].ip",
+		"targets.default[2].exclude[0]",
+		"targets.default[3].limit",
+	}
+	if len(errs) != len(expected) {
+		t.Fatal("Wrong number of problems. Got", errs, "expected", expected)
+	}
+	for i := range errs {
+		if errs[i].Path != expected[i] {
+			t.Error("Wrong path for problem", i, "Got", errs[i].Path,
+				"expected", expected[i])
+		}
+	}
+}
+
+func TestValidateSinks(t *testing.T) {
+	cc, _ := NewDefaultCollectorConfig()
+	negative := int64(-1)
+	cc.Sinks = SinksConfig{
+		{Type: SinkStdout},
+		{Type: SinkFile, FileConfig: FileConfig{Path: "/var/log/udprobe.jsonl"}},
+		{Type: SinkInflux, InfluxConfig: InfluxConfig{URL: "http://influx:8086/write"}},
+		{Type: "kafka"},
+		{Type: SinkFile},
+		{Type: SinkStdout, FileConfig: FileConfig{Path: "/tmp/x"}},
+		{Type: SinkInflux, InfluxConfig: InfluxConfig{URL: "influx:8086", Retries: &negative}},
+		{Type: SinkStdout, InfluxConfig: InfluxConfig{Timeout: 10}},
+		{Type: SinkFile, FileConfig: FileConfig{Path: "/var/log/udprobe.csv",
+			Format: FileFormatCSV, MaxSize: 100, MaxAge: 3600, Compress: true,
+			MaxFiles: 10}},
+		{Type: SinkFile, FileConfig: FileConfig{Path: "/tmp/x", Format: "xml",
+			MaxSize: -1, MaxAge: -1, MaxFiles: -1}},
+	}
+	err := cc.Validate()
+	var errs ConfigErrors
+	if !errors.As(err, &errs) {
+		t.Fatal("Expected ConfigErrors. Got", err)
+	}
+	expected := []string{
+		"sinks[3].type",
+		"sinks[4].path",
+		"sinks[5]",
+		"sinks[6].url",
+		"sinks[6].retries",
+		"sinks[7]",
+		"sinks[9].format",
+		"sinks[9].max_size",
+		"sinks[9].max_age",
+		"sinks[9].max_files",
+	}
+	if len(errs) != len(expected) {
+		t.Fatal("Wrong number of problems. Got", errs, "expected", expected)
+	}
+	for i := range errs {
+		if errs[i].Path != expected[i] {
+			t.Error("Wrong path for problem", i, "Got", errs[i].Path,
+				"expected", expected[i])
+		}
+	}
+}
+
+func TestValidateRaw(t *testing.T) {
+	for _, test := range []struct {
+		rc       RawConfig
+		expected []string
+	}{
+		{RawConfig{}, nil},
+		{RawConfig{Path: "/var/log/udprobe/results.jsonl"}, nil},
+		{RawConfig{Socket: "/run/udprobe.sock", Format: RawFormatBinary,
+			SampleRate: 0.1}, nil},
+		{RawConfig{Path: "/tmp/x", Socket: "/tmp/y"}, []string{"raw"}},
+		{RawConfig{SampleRate: 0.5}, []string{"raw"}},
+		{RawConfig{Path: "/tmp/x", Format: "pcap", SampleRate: 2},
+			[]string{"raw.format", "raw.sample_rate"}},
+	} {
+		cc, _ := NewDefaultCollectorConfig()
+		cc.Raw = test.rc
+		var paths []string
+		var errs ConfigErrors
+		if err := cc.Validate(); errors.As(err, &errs) {
+			for _, e := range errs {
+				paths = append(paths, e.Path)
+			}
+		}
+		if strings.Join(paths, ",") != strings.Join(test.expected, ",") {
+			t.Error("Wrong problems for", test.rc, "Got", paths, "expected",
+				test.expected)
+		}
+	}
+}
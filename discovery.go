@@ -0,0 +1,466 @@
+package udprobe
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Resolver looks up the addresses of hostnames, and the records used to
+// discover them. *net.Resolver implements this, and it can be replaced for
+// testing.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// Discover provides the targets with IPs that the tc stands for. For a tc
+// with an IP, that's just the tc, with the IP in its usual form. For a CIDR
+// block or range, it's one for each address, with the address as the
+// dst_hostname tag unless that's already set. For a Host, it's one for each
+// of the IPv4 and IPv6 addresses that the resolver finds, with the Host as
+// the dst_hostname tag instead.
+//
+// For an SRV, it's the same for the target host of each SRV record, with the
+// port from the record. If TXTTags is set, "key=value" TXT records of each
+// host are added to its tags as well, replacing those from the tc.
+//
+// For a File, it's each of the targets listed in the file, which is in the
+// Prometheus file_sd format, with any hostnames looked up the same way. The
+// labels of each group of targets are added to their tags, replacing those
+// from the tc, and the Port of the tc is used for targets without one.
+//
+// For a URL, it's each of the targets in the JSON list that the URL responds
+// with, with any hostnames looked up, the same defaults as a File, and the
+// tags of each target replacing those from the tc.
+func (tc *TargetConfig) Discover(ctx context.Context, resolver Resolver) (TargetSet, error) {
+	switch {
+	case tc.Host != "":
+		return discoverHost(ctx, resolver, tc.Host, tc.Port, tc.Tags)
+	case tc.SRV != "":
+		return tc.discoverSRV(ctx, resolver)
+	case tc.File != "":
+		return tc.discoverFile(ctx, resolver)
+	case tc.URL != "":
+		return tc.discoverURL(ctx, resolver)
+	case tc.IsRange():
+		return tc.expandRange()
+	}
+	target := *tc
+	target.IP = target.TagKey()
+	return TargetSet{target}, nil
+}
+
+// discoverHost provides a target for each address of the host, as described
+// for Discover.
+func discoverHost(ctx context.Context, resolver Resolver, host string,
+	port int64, tags Tags) (TargetSet, error) {
+	addrs, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up %q: %w", host, err)
+	}
+	targets := make(TargetSet, 0, len(addrs))
+	for _, addr := range addrs {
+		targetTags := make(Tags, len(tags)+1)
+		for k, v := range tags {
+			targetTags[k] = v
+		}
+		if targetTags["dst_hostname"] == "" {
+			targetTags["dst_hostname"] = host
+		}
+		targets = append(targets, TargetConfig{
+			IP:   addr.IP.String(),
+			Port: port,
+			Tags: targetTags,
+		})
+	}
+	return targets, nil
+}
+
+// discoverSRV provides the targets for the SRV records of the tc, as
+// described for Discover.
+//
+// Hosts that can't be looked up are left out, but only after logging, so a
+// single stale record doesn't stop the rest from updating.
+func (tc *TargetConfig) discoverSRV(ctx context.Context, resolver Resolver) (TargetSet, error) {
+	_, records, err := resolver.LookupSRV(ctx, "", "", tc.SRV)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up SRV %q: %w", tc.SRV, err)
+	}
+	var targets TargetSet
+	for _, record := range records {
+		host := strings.TrimSuffix(record.Target, ".")
+		tags := tc.Tags
+		if tc.TXTTags {
+			tags, err = txtTags(ctx, resolver, record.Target, tc.Tags)
+			if err != nil {
+				return nil, err
+			}
+		}
+		discovered, err := discoverHost(ctx, resolver, host,
+			int64(record.Port), tags)
+		if err != nil {
+			HandleMinorErrorMsg(err, fmt.Sprintf("skipping target of SRV %q",
+				tc.SRV))
+			continue
+		}
+		targets = append(targets, discovered...)
+	}
+	return targets, nil
+}
+
+// fileTargetGroup is a group of targets in a Prometheus file_sd file, in
+// either JSON or YAML, which are "host:port" or just "host".
+type fileTargetGroup struct {
+	Targets []string `yaml:"targets"`
+	Labels  Tags     `yaml:"labels"`
+}
+
+// discoverFile provides the targets listed in the File of the tc, as
+// described for Discover.
+//
+// Hosts that can't be looked up are left out, after logging, the same as for
+// discoverSRV.
+func (tc *TargetConfig) discoverFile(ctx context.Context, resolver Resolver) (TargetSet, error) {
+	data, err := os.ReadFile(tc.File)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read targets file: %w", err)
+	}
+	// YAML is a superset of JSON, so this handles both
+	var groups []fileTargetGroup
+	err = yaml.Unmarshal(data, &groups)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse targets file %q: %w", tc.File,
+			err)
+	}
+	var targets TargetSet
+	for _, group := range groups {
+		tags := make(Tags, len(tc.Tags)+len(group.Labels))
+		for k, v := range tc.Tags {
+			tags[k] = v
+		}
+		for k, v := range group.Labels {
+			tags[k] = v
+		}
+		for _, addr := range group.Targets {
+			host, port, err := tc.splitFileTarget(addr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid target %q in %q: %w", addr,
+					tc.File, err)
+			}
+			if ip := net.ParseIP(host); ip != nil {
+				targets = append(targets, TargetConfig{IP: ip.String(),
+					Port: port, Tags: tags})
+				continue
+			}
+			discovered, err := discoverHost(ctx, resolver, host, port, tags)
+			if err != nil {
+				HandleMinorErrorMsg(err, fmt.Sprintf("skipping target in %q",
+					tc.File))
+				continue
+			}
+			targets = append(targets, discovered...)
+		}
+	}
+	return targets, nil
+}
+
+// splitFileTarget splits a target from a file into its host and port, using
+// the Port of the tc if it doesn't have one.
+func (tc *TargetConfig) splitFileTarget(addr string) (string, int64, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		// No port, which includes IPv6 addresses without brackets
+		host, portStr = addr, ""
+	}
+	if portStr == "" {
+		if tc.Port == 0 {
+			return "", 0, errors.New("no port, and no default port for the file")
+		}
+		return host, tc.Port, nil
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil || port == 0 {
+		return "", 0, fmt.Errorf("invalid port %q", portStr)
+	}
+	return host, int64(port), nil
+}
+
+// urlTarget is a target in the response from a URL.
+type urlTarget struct {
+	IP   string `json:"ip"`
+	Host string `json:"host"`
+	Port int64  `json:"port"` // 0 for the Port of the TargetConfig
+	Tags Tags   `json:"tags"`
+}
+
+// discoverURL provides the targets that the URL of the tc responds with, as
+// described for Discover.
+//
+// Hosts that can't be looked up are left out, after logging, the same as for
+// discoverSRV.
+func (tc *TargetConfig) discoverURL(ctx context.Context, resolver Resolver) (TargetSet, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, tc.URL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid targets URL: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get targets: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get targets from %q: %s", tc.URL,
+			resp.Status)
+	}
+	var listed []urlTarget
+	err = json.NewDecoder(resp.Body).Decode(&listed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse targets from %q: %w", tc.URL,
+			err)
+	}
+	var targets TargetSet
+	for i, target := range listed {
+		tags := make(Tags, len(tc.Tags)+len(target.Tags))
+		for k, v := range tc.Tags {
+			tags[k] = v
+		}
+		for k, v := range target.Tags {
+			tags[k] = v
+		}
+		port := target.Port
+		if port == 0 {
+			port = tc.Port
+		}
+		if port < 1 || port > 65535 {
+			return nil, fmt.Errorf("invalid port %d for target %d from %q",
+				port, i, tc.URL)
+		}
+		switch {
+		case target.IP != "" && target.Host == "":
+			ip := net.ParseIP(target.IP)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP %q for target %d from %q",
+					target.IP, i, tc.URL)
+			}
+			targets = append(targets, TargetConfig{IP: ip.String(), Port: port,
+				Tags: tags})
+		case target.Host != "" && target.IP == "":
+			discovered, err := discoverHost(ctx, resolver, target.Host, port,
+				tags)
+			if err != nil {
+				HandleMinorErrorMsg(err, fmt.Sprintf("skipping target from %q",
+					tc.URL))
+				continue
+			}
+			targets = append(targets, discovered...)
+		default:
+			return nil, fmt.Errorf(
+				"exactly one of ip or host must be set for target %d from %q",
+				i, tc.URL)
+		}
+	}
+	return targets, nil
+}
+
+// LookupTimeout provides how long each Discover of the tc can take.
+func (tc *TargetConfig) LookupTimeout() time.Duration {
+	if tc.Timeout == 0 {
+		return DefaultLookupTimeout
+	}
+	return time.Duration(tc.Timeout) * time.Millisecond
+}
+
+// txtTags provides a copy of tags with any "key=value" TXT records of the
+// host added. Having no TXT records isn't an error.
+func txtTags(ctx context.Context, resolver Resolver, host string,
+	tags Tags) (Tags, error) {
+	records, err := resolver.LookupTXT(ctx, host)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return tags, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to look up TXT %q: %w", host, err)
+	}
+	txt := make(Tags, len(tags)+len(records))
+	for k, v := range tags {
+		txt[k] = v
+	}
+	for _, record := range records {
+		k, v, ok := strings.Cut(record, "=")
+		if !ok || k == "" {
+			continue // Not meant as a tag
+		}
+		txt[k] = v
+	}
+	return txt, nil
+}
+
+// TargetWatcher follows the targets of a TargetSet as they change, such as
+// the addresses of hostnames, and keeps TestRunners testing the latest ones.
+type TargetWatcher struct {
+	targets     TargetSet
+	srcHostname string
+	resolver    Resolver
+	interval    time.Duration
+	runners     []*TestRunner // Updated with the addrs on each refresh
+	onTags      func(TagSet)  // Called with the tags on each refresh
+	discovered  []TargetSet   // Latest from each of the targets
+	mutex       sync.RWMutex  // For discovered
+	refreshing  sync.Mutex    // So each Refresh finishes before the next
+	ctx         context.Context
+	cancel      context.CancelFunc
+	wg          sync.WaitGroup
+}
+
+// AddRunner adds a TestRunner to be updated with the targets on each
+// refresh. It must be called before Run.
+func (tw *TargetWatcher) AddRunner(runner *TestRunner) {
+	tw.runners = append(tw.runners, runner)
+}
+
+// Refresh discovers the targets again, and updates the TestRunners and tags
+// with the results.
+//
+// If any targets fail, their previous results are kept, and the error
+// includes all of the failures.
+func (tw *TargetWatcher) Refresh() error {
+	tw.refreshing.Lock()
+	defer tw.refreshing.Unlock()
+	var errs []error
+	// Lookups can be slow, so readers only wait for the results to be
+	// swapped in, rather than for all of them
+	discovered := make(map[int]TargetSet, len(tw.targets))
+	for i, target := range tw.targets {
+		ctx, cancel := context.WithTimeout(tw.ctx, target.LookupTimeout())
+		targets, err := target.Discover(ctx, tw.resolver)
+		cancel()
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		discovered[i] = targets
+	}
+	tw.mutex.Lock()
+	for i, targets := range discovered {
+		tw.discovered[i] = targets
+	}
+	tw.mutex.Unlock()
+	addrs, tags := tw.Addrs(), tw.TagSet()
+	for _, runner := range tw.runners {
+		runner.Set(addrs)
+	}
+	if tw.onTags != nil {
+		tw.onTags(tags)
+	}
+	return errors.Join(errs...)
+}
+
+// Addrs provides the addrs of all of the targets from the latest refresh.
+func (tw *TargetWatcher) Addrs() []*net.UDPAddr {
+	tw.mutex.RLock()
+	defer tw.mutex.RUnlock()
+	var addrs []*net.UDPAddr
+	for _, targets := range tw.discovered {
+		for _, target := range targets {
+			addr, err := target.ResolveUDPAddr()
+			if err != nil {
+				// Only possible for IPs that didn't pass validation
+				HandleMinorErrorMsg(err, "invalid target")
+				continue
+			}
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// TagSet provides the tags for all of the targets from the latest refresh.
+func (tw *TargetWatcher) TagSet() TagSet {
+	tw.mutex.RLock()
+	defer tw.mutex.RUnlock()
+	tagset := make(TagSet)
+	for _, targets := range tw.discovered {
+		targets.IntoTagSet(tagset, tw.srcHostname, "")
+	}
+	return tagset
+}
+
+// Run starts refreshing the targets on the interval in a new goroutine. This
+// does nothing if the targets can't change.
+//
+// Targets from files are also refreshed as soon as the files change. If they
+// can't be watched for changes, they're only refreshed on the interval.
+func (tw *TargetWatcher) Run() {
+	if !tw.targets.Dynamic() {
+		return
+	}
+	var changed chan struct{} // Never ready if there aren't any files
+	if files := tw.targets.Files(); len(files) > 0 {
+		changed = make(chan struct{}, 1)
+		err := watchFiles(tw.ctx, &tw.wg, files, changed)
+		HandleMinorErrorMsg(err, "failed to watch target files, "+
+			"only refreshing them on the interval")
+	}
+	tw.wg.Add(1)
+	go func() {
+		defer tw.wg.Done()
+		ticker := time.NewTicker(tw.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-tw.ctx.Done():
+				return
+			case <-ticker.C:
+			case <-changed:
+			}
+			err := tw.Refresh()
+			// The previous targets are still being tested
+			HandleMinorErrorMsg(err, "failed to refresh targets")
+		}
+	}()
+}
+
+// Stop will stop the tw, and wait for it to exit.
+func (tw *TargetWatcher) Stop() {
+	tw.cancel()
+	tw.wg.Wait()
+}
+
+// NewTargetWatcher creates a TargetWatcher for the targets, which are looked
+// up with the resolver every interval once it's running. It stops once ctx is
+// done, or Stop is called.
+//
+// `srcHostname` is applied to the tags the same as TargetSet.TagSet.
+// `onTags` is called with the tags of the targets after each refresh, and
+// may be nil.
+//
+// Nothing is discovered until Refresh is called, or the first interval
+// passes while running.
+func NewTargetWatcher(ctx context.Context, targets TargetSet,
+	srcHostname string, resolver Resolver, interval time.Duration,
+	onTags func(TagSet)) *TargetWatcher {
+	ctx, cancel := context.WithCancel(ctx)
+	return &TargetWatcher{
+		targets:     targets,
+		srcHostname: srcHostname,
+		resolver:    resolver,
+		interval:    interval,
+		onTags:      onTags,
+		discovered:  make([]TargetSet, len(targets)),
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+}
@@ -0,0 +1,587 @@
+package udprobe
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeResolver provides addrs from a map instead of DNS, and fails for
+// anything that isn't in it. It has no SRV or TXT records, see dnsServer for
+// those.
+type fakeResolver struct {
+	mutex sync.Mutex
+	hosts map[string][]string
+}
+
+func (r *fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	ips, ok := r.hosts[host]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	var addrs []net.IPAddr
+	for _, ip := range ips {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	return addrs, nil
+}
+
+func (r *fakeResolver) LookupSRV(ctx context.Context, service, proto,
+	name string) (string, []*net.SRV, error) {
+	return "", nil, &net.DNSError{Err: "no such host", Name: name,
+		IsNotFound: true}
+}
+
+func (r *fakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *fakeResolver) set(host string, ips ...string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if ips == nil {
+		delete(r.hosts, host)
+		return
+	}
+	r.hosts[host] = ips
+}
+
+func newFakeResolver() *fakeResolver {
+	return &fakeResolver{hosts: map[string][]string{
+		"reflector.example": {"192.0.2.1", "2001:db8::1"},
+	}}
+}
+
+func TestTargetConfigDiscover(t *testing.T) {
+	tc := TargetConfig{Host: "reflector.example", Port: 8100,
+		Tags: Tags{"region": "west"}}
+	targets, err := tc.Discover(context.Background(), newFakeResolver())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 2 {
+		t.Fatal("Wrong number of targets. Got", targets, "expected", 2)
+	}
+	for i, ip := range []string{"192.0.2.1", "2001:db8::1"} {
+		target := targets[i]
+		if target.IP != ip || target.Port != 8100 {
+			t.Error("Wrong target. Got", target, "expected", ip)
+		}
+		if target.Tags["dst_hostname"] != "reflector.example" ||
+			target.Tags["region"] != "west" {
+			t.Error("Wrong tags. Got", target.Tags)
+		}
+	}
+	// The original tags are left alone
+	if _, ok := tc.Tags["dst_hostname"]; ok {
+		t.Error("Discover modified the original tags")
+	}
+
+	// An explicit dst_hostname is kept
+	tc.Tags = Tags{"dst_hostname": "reflector"}
+	targets, _ = tc.Discover(context.Background(), newFakeResolver())
+	if targets[0].Tags["dst_hostname"] != "reflector" {
+		t.Error("dst_hostname replaced. Got", targets[0].Tags["dst_hostname"])
+	}
+
+	tc.Host = "missing.example"
+	_, err = tc.Discover(context.Background(), newFakeResolver())
+	if err == nil {
+		t.Error("Expected an error for a missing host")
+	}
+}
+
+func TestTargetWatcherRefresh(t *testing.T) {
+	resolver := newFakeResolver()
+	targets := TargetSet{
+		{IP: "127.0.0.1", Port: 8100},
+		{Host: "reflector.example", Port: 8100},
+	}
+	var tags TagSet
+	tw := NewTargetWatcher(context.Background(), targets, "collector",
+		resolver, time.Hour, func(ts TagSet) { tags = ts })
+	defer tw.Stop()
+	runner := NewTestRunner(context.Background(), nil, nil, nil)
+	tw.AddRunner(runner)
+
+	err := tw.Refresh()
+	if err != nil {
+		t.Fatal("Refresh failed:", err)
+	}
+	if len(runner.targets) != 3 {
+		t.Error("Runner not updated. Got", runner.targets)
+	}
+	if tags["2001:db8::1"]["dst_hostname"] != "reflector.example" ||
+		tags["2001:db8::1"]["src_hostname"] != "collector" {
+		t.Error("Wrong tags for the host. Got", tags["2001:db8::1"])
+	}
+
+	// The host moves
+	resolver.set("reflector.example", "192.0.2.2")
+	tw.Refresh()
+	addrs := tw.Addrs()
+	if len(addrs) != 2 || addrs[1].IP.String() != "192.0.2.2" {
+		t.Error("Wrong addrs after the host moved. Got", addrs)
+	}
+
+	// Then can't be found, so the last addrs are kept
+	resolver.set("reflector.example")
+	err = tw.Refresh()
+	if err == nil {
+		t.Error("Expected an error for the missing host")
+	}
+	if len(runner.targets) != 2 || runner.targets[1].IP.String() != "192.0.2.2" {
+		t.Error("Previous addrs not kept. Got", runner.targets)
+	}
+}
+
+// slowResolver is a fakeResolver that waits for release before looking up
+// any addrs, and signals started when one is waiting.
+type slowResolver struct {
+	*fakeResolver
+	started chan struct{}
+	release chan struct{}
+}
+
+func (r *slowResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	select {
+	case r.started <- struct{}{}:
+	default:
+	}
+	<-r.release
+	return r.fakeResolver.LookupIPAddr(ctx, host)
+}
+
+func TestTargetWatcherRefreshUnlocked(t *testing.T) {
+	resolver := &slowResolver{fakeResolver: newFakeResolver(),
+		started: make(chan struct{}, 1), release: make(chan struct{})}
+	tw := NewTargetWatcher(context.Background(), TargetSet{
+		{IP: "127.0.0.1", Port: 8100},
+		{Host: "reflector.example", Port: 8100},
+	}, "", resolver, time.Hour, nil)
+	defer tw.Stop()
+	done := make(chan error)
+	go func() { done <- tw.Refresh() }()
+	<-resolver.started
+
+	// Reading the targets doesn't wait for the lookup
+	read := make(chan []*net.UDPAddr)
+	go func() { read <- tw.Addrs() }()
+	select {
+	case addrs := <-read:
+		if len(addrs) != 0 {
+			t.Error("Targets changed before the refresh finished. Got", addrs)
+		}
+	case <-time.After(time.Second):
+		t.Error("Addrs blocked on a lookup")
+	}
+	close(resolver.release)
+	if err := <-done; err != nil {
+		t.Fatal("Refresh failed:", err)
+	}
+	if addrs := tw.Addrs(); len(addrs) != 3 {
+		t.Error("Wrong addrs after the refresh. Got", addrs)
+	}
+}
+
+func TestTargetWatcherRun(t *testing.T) {
+	resolver := newFakeResolver()
+	targets := TargetSet{{Host: "reflector.example", Port: 8100}}
+	tw := NewTargetWatcher(context.Background(), targets, "", resolver,
+		time.Millisecond, nil)
+	runner := NewTestRunner(context.Background(), nil, nil, nil)
+	tw.AddRunner(runner)
+	tw.Run()
+	defer tw.Stop()
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		runner.mutex.RLock()
+		n := len(runner.targets)
+		runner.mutex.RUnlock()
+		if n == 2 {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Error("Runner targets never refreshed")
+}
+
+func TestTargetWatcherStop(t *testing.T) {
+	tw := NewTargetWatcher(context.Background(),
+		TargetSet{{Host: "reflector.example", Port: 8100}}, "",
+		newFakeResolver(), time.Millisecond, nil)
+	tw.Run()
+	tw.Stop()
+	if tw.ctx.Err() == nil {
+		t.Error("TargetWatcher context not canceled after Stop")
+	}
+}
+
+// dnsServer answers DNS queries over UDP from its records, so discovery can
+// be tested with a real net.Resolver. Names are fully qualified, with the
+// trailing dot.
+type dnsServer struct {
+	conn *net.UDPConn
+	ips  map[string][]string
+	srvs map[string][]net.SRV
+	txts map[string][]string
+}
+
+// resolver provides a Resolver that only queries the s.
+func (s *dnsServer) resolver() *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "udp", s.conn.LocalAddr().String())
+		},
+	}
+}
+
+func (s *dnsServer) serve() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			return // Closed
+		}
+		if resp := s.answer(buf[:n]); resp != nil {
+			s.conn.WriteToUDP(resp, addr)
+		}
+	}
+}
+
+// answer builds the response to the query, or returns nil if it isn't a
+// valid one.
+func (s *dnsServer) answer(query []byte) []byte {
+	// The header is followed by the question's name, type and class
+	if len(query) < 12 {
+		return nil
+	}
+	var name string
+	i := 12
+	for i < len(query) && query[i] != 0 {
+		l := int(query[i])
+		if i+1+l > len(query) {
+			return nil
+		}
+		name += string(query[i+1:i+1+l]) + "."
+		i += 1 + l
+	}
+	if i+5 > len(query) {
+		return nil
+	}
+	name = strings.ToLower(name)
+	qtype := binary.BigEndian.Uint16(query[i+1:])
+	question := query[12 : i+5]
+
+	var rdatas [][]byte
+	switch qtype {
+	case 1, 28: // A, AAAA
+		for _, ip := range s.ips[name] {
+			ip := net.ParseIP(ip)
+			if qtype == 1 && ip.To4() != nil {
+				rdatas = append(rdatas, ip.To4())
+			} else if qtype == 28 && ip.To4() == nil {
+				rdatas = append(rdatas, ip.To16())
+			}
+		}
+	case 33: // SRV
+		for _, srv := range s.srvs[name] {
+			rdata := binary.BigEndian.AppendUint16(nil, srv.Priority)
+			rdata = binary.BigEndian.AppendUint16(rdata, srv.Weight)
+			rdata = binary.BigEndian.AppendUint16(rdata, srv.Port)
+			for _, label := range strings.Split(strings.TrimSuffix(srv.Target, "."), ".") {
+				rdata = append(rdata, byte(len(label)))
+				rdata = append(rdata, label...)
+			}
+			rdatas = append(rdatas, append(rdata, 0))
+		}
+	case 16: // TXT
+		for _, txt := range s.txts[name] {
+			rdatas = append(rdatas, append([]byte{byte(len(txt))}, txt...))
+		}
+	}
+	// Authoritative, recursion desired and available
+	flags := uint16(0x8580)
+	_, ip := s.ips[name]
+	_, srv := s.srvs[name]
+	_, txt := s.txts[name]
+	if !ip && !srv && !txt {
+		flags |= 3 // NXDOMAIN
+	}
+	resp := append([]byte{}, query[0:2]...)
+	resp = binary.BigEndian.AppendUint16(resp, flags)
+	resp = binary.BigEndian.AppendUint16(resp, 1)
+	resp = binary.BigEndian.AppendUint16(resp, uint16(len(rdatas)))
+	resp = append(resp, 0, 0, 0, 0)
+	resp = append(resp, question...)
+	for _, rdata := range rdatas {
+		// Points back to the name in the question
+		resp = append(resp, 0xc0, 12)
+		resp = binary.BigEndian.AppendUint16(resp, qtype)
+		resp = binary.BigEndian.AppendUint16(resp, 1) // IN
+		resp = binary.BigEndian.AppendUint32(resp, 60)
+		resp = binary.BigEndian.AppendUint16(resp, uint16(len(rdata)))
+		resp = append(resp, rdata...)
+	}
+	return resp
+}
+
+func newDNSServer(t *testing.T) *dnsServer {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &dnsServer{
+		conn: conn,
+		ips: map[string][]string{
+			"r1.example.": {"192.0.2.1", "2001:db8::1"},
+			"r2.example.": {"192.0.2.2"},
+		},
+		srvs: map[string][]net.SRV{
+			"_udprobe._udp.example.": {
+				{Target: "r1.example.", Port: 8100, Priority: 10, Weight: 1},
+				{Target: "r2.example.", Port: 8101, Priority: 20, Weight: 1},
+				{Target: "gone.example.", Port: 8100, Priority: 30, Weight: 1},
+			},
+		},
+		txts: map[string][]string{
+			"r1.example.": {"region=west", "not a tag"},
+		},
+	}
+	go s.serve()
+	t.Cleanup(func() { conn.Close() })
+	return s
+}
+
+func TestTargetConfigDiscoverSRV(t *testing.T) {
+	resolver := newDNSServer(t).resolver()
+	tc := TargetConfig{SRV: "_udprobe._udp.example.", TXTTags: true,
+		Tags: Tags{"region": "east", "env": "prod"}}
+	targets, err := tc.Discover(context.Background(), resolver)
+	if err != nil {
+		t.Fatal("Discover failed:", err)
+	}
+	// The host without any addrs is left out
+	expected := []struct {
+		ip     string
+		port   int64
+		host   string
+		region string
+	}{
+		{"192.0.2.1", 8100, "r1.example", "west"},
+		{"2001:db8::1", 8100, "r1.example", "west"},
+		{"192.0.2.2", 8101, "r2.example", "east"},
+	}
+	if len(targets) != len(expected) {
+		t.Fatal("Wrong number of targets. Got", targets, "expected",
+			len(expected))
+	}
+	for i, e := range expected {
+		target := targets[i]
+		if target.IP != e.ip || target.Port != e.port {
+			t.Error("Wrong target. Got", target.AddrString(), "expected", e.ip,
+				e.port)
+		}
+		if target.Tags["dst_hostname"] != e.host ||
+			target.Tags["region"] != e.region || target.Tags["env"] != "prod" {
+			t.Error("Wrong tags for", target.IP, "Got", target.Tags)
+		}
+	}
+
+	// Without TXTTags, only the config's tags are used
+	tc.TXTTags = false
+	targets, _ = tc.Discover(context.Background(), resolver)
+	if len(targets) == 0 || targets[0].Tags["region"] != "east" {
+		t.Error("TXT tags used when disabled. Got", targets)
+	}
+
+	tc.SRV = "_missing._udp.example."
+	_, err = tc.Discover(context.Background(), resolver)
+	if err == nil {
+		t.Error("Expected an error for a missing SRV")
+	}
+}
+
+func TestTargetConfigDiscoverFile(t *testing.T) {
+	resolver := newFakeResolver()
+	dir := t.TempDir()
+	jsonFile := filepath.Join(dir, "targets.json")
+	os.WriteFile(jsonFile, []byte(`[
+  {"targets": ["127.0.0.1:8101", "reflector.example", "missing.example"],
+   "labels": {"site": "a"}},
+  {"targets": ["[::1]:8102"]}
+]`), 0644)
+	tc := TargetConfig{File: jsonFile, Port: 8100, Tags: Tags{"site": "b"}}
+	targets, err := tc.Discover(context.Background(), resolver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"127.0.0.1:8101", "192.0.2.1:8100", "[2001:db8::1]:8100",
+		"[::1]:8102"}
+	if len(targets) != len(expected) {
+		t.Fatal("Wrong number of targets. Got", targets, "expected", expected)
+	}
+	for i, target := range targets {
+		if addr := target.AddrString(); addr != expected[i] {
+			t.Error("Wrong target", i, "Got", addr, "expected", expected[i])
+		}
+	}
+	if site := targets[1].Tags["site"]; site != "a" {
+		t.Error("Labels didn't replace tags. Got", site, "expected a")
+	}
+	if host := targets[1].Tags["dst_hostname"]; host != "reflector.example" {
+		t.Error("Wrong dst_hostname. Got", host, "expected reflector.example")
+	}
+	if site := targets[3].Tags["site"]; site != "b" {
+		t.Error("Wrong tags without labels. Got", site, "expected b")
+	}
+
+	yamlFile := filepath.Join(dir, "targets.yaml")
+	os.WriteFile(yamlFile, []byte("- targets: [127.0.0.1]\n"), 0644)
+	tc = TargetConfig{File: yamlFile}
+	_, err = tc.Discover(context.Background(), resolver)
+	if err == nil {
+		t.Error("Expected an error for a target without a port")
+	}
+
+	tc = TargetConfig{File: filepath.Join(dir, "missing.json")}
+	_, err = tc.Discover(context.Background(), resolver)
+	if err == nil {
+		t.Error("Expected an error for a missing file")
+	}
+}
+
+func TestTargetWatcherRunFile(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "targets.yaml")
+	os.WriteFile(file, []byte("- targets: [127.0.0.1:8100]\n"), 0644)
+	targets := TargetSet{{File: file}}
+	// Only the file changing can refresh this in time
+	tw := NewTargetWatcher(context.Background(), targets, "",
+		newFakeResolver(), time.Hour, nil)
+	runner := NewTestRunner(context.Background(), nil, nil, nil)
+	tw.AddRunner(runner)
+	if err := tw.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	tw.Run()
+	defer tw.Stop()
+
+	// Replaced the way most tools do it, by renaming over the old file
+	tmp := filepath.Join(dir, "targets.yaml.tmp")
+	os.WriteFile(tmp, []byte(
+		"- targets: [127.0.0.1:8100, 127.0.0.2:8100]\n"), 0644)
+	if err := os.Rename(tmp, file); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		runner.mutex.RLock()
+		n := len(runner.targets)
+		runner.mutex.RUnlock()
+		if n == 2 {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Error("Runner targets never refreshed after the file changed")
+}
+
+func TestTargetConfigDiscoverURL(t *testing.T) {
+	var mutex sync.Mutex
+	status, body := http.StatusOK, `[
+  {"ip": "127.0.0.1", "port": 8101, "tags": {"site": "a"}},
+  {"host": "reflector.example"},
+  {"host": "missing.example"}
+]`
+	registry := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			w.WriteHeader(status)
+			w.Write([]byte(body))
+		}))
+	defer registry.Close()
+
+	targets := TargetSet{{URL: registry.URL, Port: 8100, Tags: Tags{"site": "b"}}}
+	tw := NewTargetWatcher(context.Background(), targets, "",
+		newFakeResolver(), time.Hour, nil)
+	defer tw.Stop()
+	err := tw.Refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"127.0.0.1:8101", "192.0.2.1:8100",
+		"[2001:db8::1]:8100"}
+	addrs := tw.Addrs()
+	if len(addrs) != len(expected) {
+		t.Fatal("Wrong number of addrs. Got", addrs, "expected", expected)
+	}
+	for i, addr := range addrs {
+		if addr.String() != expected[i] {
+			t.Error("Wrong addr", i, "Got", addr, "expected", expected[i])
+		}
+	}
+	tags := tw.TagSet()
+	if tags["127.0.0.1"]["site"] != "a" || tags["192.0.2.1"]["site"] != "b" {
+		t.Error("Wrong tags. Got", tags)
+	}
+
+	// The registry fails, then responds with nonsense, and the last good
+	// targets are kept
+	for _, resp := range []struct {
+		status int
+		body   string
+	}{
+		{http.StatusServiceUnavailable, ""},
+		{http.StatusOK, `{"targets": []}`},
+		{http.StatusOK, `[{"ip": "127.0.0.1", "port": 70000}]`},
+	} {
+		mutex.Lock()
+		status, body = resp.status, resp.body
+		mutex.Unlock()
+		err = tw.Refresh()
+		if err == nil {
+			t.Error("Expected an error for", resp)
+		}
+		if addrs := tw.Addrs(); len(addrs) != len(expected) {
+			t.Error("Last good targets not kept for", resp, "Got", addrs)
+		}
+	}
+}
+
+func TestTargetConfigLookupTimeout(t *testing.T) {
+	registry := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+		}))
+	defer registry.Close()
+
+	targets := TargetSet{{URL: registry.URL, Port: 8100, Timeout: 10}}
+	tw := NewTargetWatcher(context.Background(), targets, "",
+		newFakeResolver(), time.Hour, nil)
+	defer tw.Stop()
+	start := time.Now()
+	err := tw.Refresh()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("Expected the request to time out. Got", err)
+	}
+	if elapsed := time.Since(start); elapsed > DefaultLookupTimeout/2 {
+		t.Error("Timeout not applied. Took", elapsed)
+	}
+}
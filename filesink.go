@@ -0,0 +1,387 @@
+package udprobe
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The time a file was rotated, in the name it's rotated to. Sorts in order.
+const rotateTimeFormat = "20060102T150405.000"
+
+// FileSink is a SummarySink that appends summaries to a local file, as JSON
+// lines like JSONLinesSink, or as CSV, for sites where they can only be
+// collected later.
+//
+// The file is rotated before it would grow past MaxSize, or once it's been
+// open for MaxAge, by renaming it with the time that it was rotated, like
+// "summaries-20260102T150405.000.jsonl" for "summaries.jsonl". In the
+// background, rotated files are gzipped if Compress is set, and all but the
+// newest MaxFiles are removed.
+type FileSink struct {
+	cfg          FileConfig
+	tags         func(string) Tags
+	maxSize      int64 // Bytes
+	file         *os.File
+	size         int64     // Of file
+	opened       time.Time // When file was opened
+	header       []string  // CSV columns, from the percentiles and buckets
+	mutex        sync.Mutex
+	housekeeping sync.Mutex // So rotated files are compressed and pruned in turn
+	wg           sync.WaitGroup
+	now          func() time.Time
+}
+
+// WriteSummaries appends the summaries in the batch to the file, in a single
+// write, rotating it first if needed.
+func (s *FileSink) WriteSummaries(batch *SummaryBatch) error {
+	if len(batch.Summaries) == 0 {
+		return nil
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	// Failed to reopen after rotating, so try again
+	if s.file == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+	var buf []byte
+	var err error
+	isCSV := s.cfg.FormatString() == FileFormatCSV
+	if isCSV {
+		buf, err = s.appendCSVRows(nil, batch)
+	} else {
+		buf, err = appendSummaryLines(nil, batch, s.tags)
+	}
+	if err != nil {
+		return err
+	}
+	if s.shouldRotate(len(buf)) {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	if isCSV && s.size == 0 {
+		header, err := writeCSVRecord(nil, s.header)
+		if err != nil {
+			return err
+		}
+		buf = append(header, buf...)
+	}
+	n, err := s.file.Write(buf)
+	s.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to write summaries file: %w", err)
+	}
+	return nil
+}
+
+// shouldRotate reports if the file should be rotated before writing n more
+// bytes to it.
+func (s *FileSink) shouldRotate(n int) bool {
+	if s.size == 0 {
+		return false
+	}
+	if s.maxSize > 0 && s.size+int64(n) > s.maxSize {
+		return true
+	}
+	return s.cfg.MaxAge > 0 &&
+		s.now().Sub(s.opened) >= time.Duration(s.cfg.MaxAge)*time.Second
+}
+
+// open opens the file for appending, creating it if it doesn't exist.
+func (s *FileSink) open() error {
+	file, err := os.OpenFile(s.cfg.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE,
+		0644)
+	if err != nil {
+		return fmt.Errorf("failed to open summaries file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to open summaries file: %w", err)
+	}
+	s.file, s.size, s.opened = file, info.Size(), s.now()
+	return nil
+}
+
+// rotate renames the file, and opens a new one in its place. If the new one
+// can't be opened, it's tried again on the next write.
+func (s *FileSink) rotate() error {
+	err := s.file.Close()
+	s.file = nil
+	if err != nil {
+		return fmt.Errorf("failed to close summaries file: %w", err)
+	}
+	rotated := s.rotatedPath(s.now())
+	if err := os.Rename(s.cfg.Path, rotated); err != nil {
+		return fmt.Errorf("failed to rotate summaries file: %w", err)
+	}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.housekeep(rotated)
+	}()
+	return s.open()
+}
+
+// rotatedPath provides the path that the file is renamed to when rotated at
+// t.
+func (s *FileSink) rotatedPath(t time.Time) string {
+	ext := filepath.Ext(s.cfg.Path)
+	return strings.TrimSuffix(s.cfg.Path, ext) + "-" +
+		t.UTC().Format(rotateTimeFormat) + ext
+}
+
+// housekeep compresses the rotated file if enabled, then removes the oldest
+// rotated files beyond MaxFiles.
+func (s *FileSink) housekeep(rotated string) {
+	s.housekeeping.Lock()
+	defer s.housekeeping.Unlock()
+	if s.cfg.Compress {
+		// Already pruned if it was rotated before one that was pruned first
+		err := gzipFile(rotated)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			HandleMinorErrorMsg(err, "failed to compress rotated summaries file")
+		}
+	}
+	if s.cfg.MaxFiles > 0 {
+		if err := s.prune(); err != nil {
+			HandleMinorErrorMsg(err, "failed to remove old summaries files")
+		}
+	}
+}
+
+// rotatedFiles provides the paths of the rotated files, compressed or not,
+// from oldest to newest.
+func (s *FileSink) rotatedFiles() ([]string, error) {
+	dir, name := filepath.Split(s.cfg.Path)
+	ext := filepath.Ext(name)
+	prefix := strings.TrimSuffix(name, ext) + "-"
+	entries, err := os.ReadDir(filepath.Clean(dir))
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	// In order of name, which is in order of when they were rotated
+	for _, entry := range entries {
+		ts, ok := strings.CutPrefix(strings.TrimSuffix(entry.Name(), ".gz"),
+			prefix)
+		if !ok {
+			continue
+		}
+		ts, ok = strings.CutSuffix(ts, ext)
+		if !ok {
+			continue
+		}
+		if _, err := time.Parse(rotateTimeFormat, ts); err != nil {
+			continue
+		}
+		files = append(files, filepath.Join(dir, entry.Name()))
+	}
+	return files, nil
+}
+
+// prune removes the oldest rotated files, keeping MaxFiles.
+func (s *FileSink) prune() error {
+	files, err := s.rotatedFiles()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(files)-int(s.cfg.MaxFiles); i++ {
+		if err := os.Remove(files[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// gzipFile compresses the file at path into path.gz, and removes the
+// original.
+func gzipFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC,
+		0644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	zw.Name = filepath.Base(path)
+	_, err = io.Copy(zw, src)
+	if err == nil {
+		err = zw.Close()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		// Keep the original rather than a partial copy
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
+
+// Close waits for any rotated files to be compressed and pruned, then closes
+// the file.
+func (s *FileSink) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.wg.Wait()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// appendCSVRows appends a CSV row for each of the summaries in the batch to
+// buf, with the columns of s.header.
+func (s *FileSink) appendCSVRows(buf []byte, batch *SummaryBatch) ([]byte,
+	error) {
+	for _, summary := range batch.Summaries {
+		var tags Tags
+		if s.tags != nil {
+			tags = s.tags(summary.Pd.DstIP.String())
+		}
+		columns, values := csvFields(batch, summary, tags)
+		byColumn := make(map[string]string, len(columns))
+		for i, column := range columns {
+			byColumn[column] = values[i]
+		}
+		// Missing if nothing completed, so left empty
+		row := make([]string, len(s.header))
+		for i, column := range s.header {
+			row[i] = byColumn[column]
+		}
+		var err error
+		buf, err = writeCSVRecord(buf, row)
+		if err != nil {
+			return buf, err
+		}
+	}
+	return buf, nil
+}
+
+// writeCSVRecord appends the record to buf as a line of CSV.
+func writeCSVRecord(buf []byte, record []string) ([]byte, error) {
+	b := bytes.NewBuffer(buf)
+	w := csv.NewWriter(b)
+	w.Write(record)
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return buf, fmt.Errorf("failed to encode summary: %w", err)
+	}
+	return b.Bytes(), nil
+}
+
+// csvHeader provides the columns of the CSV rows for summaries with the
+// percentiles and buckets, including those a summary leaves out when none of
+// its probes completed.
+func csvHeader(percentiles []float64, buckets []float64) []string {
+	summary := &Summary{Pd: &PathDist{}}
+	for _, p := range percentiles {
+		summary.RTTPercentiles = append(summary.RTTPercentiles, Percentile{P: p})
+	}
+	for _, le := range buckets {
+		summary.RTTHistogram = append(summary.RTTHistogram,
+			HistogramBucket{Le: le})
+	}
+	columns, _ := csvFields(&SummaryBatch{}, summary, nil)
+	return columns
+}
+
+// csvFields provides the columns and values of a CSV row for the summary,
+// named the same as the JSON from the API, with percentiles and histogram
+// buckets named as they are for InfluxDB. The tags are joined as "k=v;k=v".
+func csvFields(batch *SummaryBatch, summary *Summary, tags Tags) ([]string,
+	[]string) {
+	var columns, values []string
+	str := func(name, v string) {
+		columns = append(columns, name)
+		values = append(values, v)
+	}
+	float := func(name string, v float64) {
+		str(name, strconv.FormatFloat(v, 'g', -1, 64))
+	}
+	integer := func(name string, v int64) {
+		str(name, strconv.FormatInt(v, 10))
+	}
+	pairs := make([]string, 0, len(tags))
+	for _, k := range sortedKeys(tags) {
+		pairs = append(pairs, k+"="+tags[k])
+	}
+
+	str("start", batch.Start.Format(time.RFC3339Nano))
+	str("end", batch.End.Format(time.RFC3339Nano))
+	str("src_ip", summary.Pd.SrcIP.String())
+	integer("src_port", int64(summary.Pd.SrcPort))
+	str("dst_ip", summary.Pd.DstIP.String())
+	integer("dst_port", int64(summary.Pd.DstPort))
+	str("proto", summary.Pd.Proto)
+	integer("tos", int64(summary.Tos))
+	str("tags", strings.Join(pairs, ";"))
+	float("rtt_avg", summary.RTTAvg)
+	float("rtt_min", summary.RTTMin)
+	float("rtt_max", summary.RTTMax)
+	for _, p := range summary.RTTPercentiles {
+		float("rtt_p"+formatFloatLabel(p.P), p.Value)
+	}
+	for _, b := range summary.RTTHistogram {
+		integer("rtt_le_"+formatFloatLabel(b.Le), int64(b.Count))
+	}
+	float("jitter", summary.Jitter)
+	float("ipdv_mean", summary.IPDVMean)
+	float("ipdv_max", summary.IPDVMax)
+	float("fwd_delay_avg", summary.FwdDelayAvg)
+	float("rev_delay_avg", summary.RevDelayAvg)
+	float("dwell_avg", summary.DwellAvg)
+	float("clock_offset", summary.ClockOffset)
+	float("clock_offset_err", summary.ClockOffsetErr)
+	integer("sent", int64(summary.Sent))
+	integer("lost", int64(summary.Lost))
+	float("loss", summary.Loss)
+	integer("duplicates", int64(summary.Duplicates))
+	integer("reordered", int64(summary.Reordered))
+	integer("reorder_extent", int64(summary.ReorderExtent))
+	return columns, values
+}
+
+// NewFileSink creates a FileSink based on the fc, with the tags provided by
+// tags for each of the destination IPs, such as API.Tags. tags may be nil.
+// percentiles and buckets are those the summaries are calculated with, which
+// are the CSV columns.
+//
+// A JSON lines file that already exists is appended to. A CSV file that
+// already exists is rotated first, since its header may not match.
+func NewFileSink(fc FileConfig, percentiles []float64, buckets []float64,
+	tags func(string) Tags) (*FileSink, error) {
+	s := &FileSink{cfg: fc, tags: tags, maxSize: fc.MaxSize << 20,
+		header: csvHeader(percentiles, buckets), now: time.Now}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	if fc.FormatString() == FileFormatCSV && s.size > 0 {
+		if err := s.rotate(); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
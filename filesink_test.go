@@ -0,0 +1,195 @@
+package udprobe
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeClock provides a time that's advanced by a millisecond each call, so
+// each rotation has a different name.
+func fakeClock(start time.Time) func() time.Time {
+	now := start
+	return func() time.Time {
+		now = now.Add(time.Millisecond)
+		return now
+	}
+}
+
+func TestFileSinkAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "summaries.jsonl")
+	os.WriteFile(path, []byte("existing\n"), 0644)
+	sink, err := NewFileSink(FileConfig{Path: path}, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch := &SummaryBatch{Summaries: exampleSummaries[:1]}
+	sink.WriteSummaries(batch)
+	sink.WriteSummaries(batch)
+	if err := sink.Close(); err != nil {
+		t.Error("Failed to close:", err)
+	}
+	data, _ := os.ReadFile(path)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 3 || lines[0] != "existing" {
+		t.Error("Lines not appended. Got", lines)
+	}
+}
+
+func TestFileSinkRotateSize(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "summaries.jsonl")
+	sink, err := NewFileSink(FileConfig{Path: path, Compress: true,
+		MaxFiles: 2}, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.now = fakeClock(time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC))
+	batch := &SummaryBatch{Summaries: exampleSummaries[:1]}
+	line, _ := appendSummaryLines(nil, batch, nil)
+	// Room for two batches per file
+	sink.maxSize = int64(len(line)*2 + 1)
+	for i := 0; i < 9; i++ {
+		if err := sink.WriteSummaries(batch); err != nil {
+			t.Fatal("Failed to write:", err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Error("Failed to close:", err)
+	}
+
+	// Rotated 4 times, with the 2 newest kept
+	files, _ := sink.rotatedFiles()
+	if len(files) != 2 {
+		t.Fatal("Wrong number of rotated files. Got", files, "expected 2")
+	}
+	for _, file := range files {
+		if !strings.HasPrefix(file, filepath.Join(dir, "summaries-20260102T0304")) ||
+			!strings.HasSuffix(file, ".jsonl.gz") {
+			t.Error("Wrong name for rotated file. Got", file)
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal("Rotated file not gzipped:", err)
+		}
+		data, _ := io.ReadAll(zr)
+		f.Close()
+		if string(data) != string(line)+string(line) {
+			t.Error("Wrong contents of", file, "Got", string(data))
+		}
+	}
+	if files[0] >= files[1] {
+		t.Error("Rotated files out of order. Got", files)
+	}
+	data, _ := os.ReadFile(path)
+	if string(data) != string(line) {
+		t.Error("Wrong contents of current file. Got", string(data))
+	}
+}
+
+func TestFileSinkRotateAge(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "summaries.jsonl")
+	sink, err := NewFileSink(FileConfig{Path: path, MaxAge: 60}, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	sink.now = func() time.Time { return now }
+	sink.opened = now
+	batch := &SummaryBatch{Summaries: exampleSummaries[:1]}
+	sink.WriteSummaries(batch)
+	now = now.Add(59 * time.Second)
+	sink.WriteSummaries(batch)
+	now = now.Add(time.Second)
+	sink.WriteSummaries(batch)
+	sink.Close()
+
+	files, _ := sink.rotatedFiles()
+	expected := filepath.Join(dir, "summaries-20260102T030505.000.jsonl")
+	if len(files) != 1 || files[0] != expected {
+		t.Fatal("Wrong rotated files. Got", files, "expected", expected)
+	}
+	data, _ := os.ReadFile(files[0])
+	if n := strings.Count(string(data), "\n"); n != 2 {
+		t.Error("Wrong number of lines in rotated file. Got", n, "expected", 2)
+	}
+}
+
+func TestFileSinkCSV(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "summaries.csv")
+	os.WriteFile(path, []byte("old,header\n"), 0644)
+	tags := func(ip string) Tags {
+		return Tags{"dst_hostname": "host-" + ip, "az": "b"}
+	}
+	sink, err := NewFileSink(FileConfig{Path: path, Format: FileFormatCSV},
+		[]float64{99}, []float64{5}, tags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	// The first has nothing completed, so no percentiles or buckets
+	batch := &SummaryBatch{Start: start, End: start.Add(10 * time.Second),
+		Summaries: []*Summary{exampleSummaries[1], exampleSummaries[0]}}
+	if err := sink.WriteSummaries(batch); err != nil {
+		t.Fatal("Failed to write:", err)
+	}
+	sink.Close()
+
+	// The existing file was rotated, as its header doesn't match
+	files, _ := sink.rotatedFiles()
+	if len(files) != 1 {
+		t.Fatal("Existing file not rotated. Got", files)
+	}
+	data, _ := os.ReadFile(files[0])
+	if string(data) != "old,header\n" {
+		t.Error("Wrong contents of rotated file. Got", string(data))
+	}
+
+	f, _ := os.Open(path)
+	defer f.Close()
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal("Invalid CSV:", err)
+	}
+	if len(records) != 3 {
+		t.Fatal("Wrong number of records. Got", len(records), "expected", 3)
+	}
+	header := strings.Join(records[0], ",")
+	expected := "start,end,src_ip,src_port,dst_ip,dst_port,proto,tos,tags," +
+		"rtt_avg,rtt_min,rtt_max,rtt_p99,rtt_le_5,jitter,ipdv_mean,ipdv_max," +
+		"fwd_delay_avg,rev_delay_avg,dwell_avg,clock_offset,clock_offset_err," +
+		"sent,lost,loss,duplicates,reordered,reorder_extent"
+	if header != expected {
+		t.Error("Wrong header. Got", header, "expected", expected)
+	}
+	if n := len(records[1]); n != len(records[0]) {
+		t.Error("Wrong number of fields without percentiles. Got", n)
+	}
+	row := make(map[string]string)
+	for i, column := range records[0] {
+		row[column] = records[2][i]
+	}
+	for column, value := range map[string]string{
+		"start":   "2026-01-02T03:04:05Z",
+		"end":     "2026-01-02T03:04:15Z",
+		"dst_ip":  "10.0.1.1",
+		"tags":    "az=b;dst_hostname=host-10.0.1.1",
+		"rtt_avg": "1.5",
+		"rtt_p99": "2",
+	} {
+		if row[column] != value {
+			t.Error("Wrong", column, "Got", row[column], "expected", value)
+		}
+	}
+}
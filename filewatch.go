@@ -0,0 +1,103 @@
+package udprobe
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Changes to a file in a watched directory that could change its contents.
+// Files are often replaced by renaming a new one over them, rather than
+// written in place, so the directory is watched rather than the file.
+const fileWatchMask = unix.IN_CLOSE_WRITE | unix.IN_MOVED_TO |
+	unix.IN_MOVED_FROM | unix.IN_CREATE | unix.IN_DELETE
+
+// watchFiles watches the files at paths with inotify, and sends to changed
+// whenever any of them might have changed, until ctx is done. The send never
+// blocks, so changed should be buffered, and one value can stand for many
+// changes.
+//
+// The watching runs in a goroutine tracked by wg. An error is returned if it
+// can't be set up, in which case nothing is started.
+func watchFiles(ctx context.Context, wg *sync.WaitGroup, paths []string,
+	changed chan<- struct{}) error {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return fmt.Errorf("failed to start inotify: %w", err)
+	}
+	// Non-blocking, so reads wait in the runtime poller, and Close stops them
+	file := os.NewFile(uintptr(fd), "inotify")
+	// Names of the watched files, for each watched directory
+	watched := make(map[int32]map[string]bool)
+	for _, path := range paths {
+		dir, name := filepath.Split(filepath.Clean(path))
+		if dir == "" {
+			dir = "."
+		}
+		wd, err := unix.InotifyAddWatch(fd, dir, fileWatchMask)
+		if err != nil {
+			file.Close()
+			return fmt.Errorf("failed to watch %q: %w", dir, err)
+		}
+		if watched[int32(wd)] == nil {
+			watched[int32(wd)] = make(map[string]bool)
+		}
+		watched[int32(wd)][name] = true
+	}
+	unblock := context.AfterFunc(ctx, func() { file.Close() })
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		// The read can fail while ctx is still live, in which case unblock
+		// stops the AfterFunc from ever closing it. A second Close after the
+		// AfterFunc's is harmless.
+		defer func() {
+			unblock()
+			file.Close()
+		}()
+		buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+		for {
+			n, err := file.Read(buf)
+			if err != nil {
+				if ctx.Err() == nil {
+					HandleMinorErrorMsg(err, "stopped watching target files")
+				}
+				return
+			}
+			if inotifyMatches(buf[:n], watched) {
+				select {
+				case changed <- struct{}{}:
+				default: // Already pending
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// inotifyMatches reports if any of the inotify events in data are for one of
+// the watched files.
+func inotifyMatches(data []byte, watched map[int32]map[string]bool) bool {
+	for len(data) >= unix.SizeofInotifyEvent {
+		event := (*unix.InotifyEvent)(unsafe.Pointer(&data[0]))
+		end := unix.SizeofInotifyEvent + int(event.Len)
+		if end > len(data) {
+			return false
+		}
+		// The name is padded with NULs
+		name := string(data[unix.SizeofInotifyEvent:end])
+		for len(name) > 0 && name[len(name)-1] == 0 {
+			name = name[:len(name)-1]
+		}
+		if event.Mask&unix.IN_Q_OVERFLOW != 0 || watched[event.Wd][name] {
+			return true
+		}
+		data = data[end:]
+	}
+	return false
+}
@@ -0,0 +1,257 @@
+package udprobe
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// InfluxMeasurement is the measurement that summaries are written as.
+const InfluxMeasurement = "udprobe"
+
+// Escapes tag keys and values in line protocol.
+var influxTagEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+// AppendInfluxLine appends the summary, with the tags of its destination, to
+// buf as a single line of InfluxDB line protocol, and returns the result.
+//
+// src_ip, dst_ip and tos are added as tags, replacing any of the same name.
+// Fields are named the same as the JSON from the API, with percentiles as
+// "rtt_p99" and histogram buckets as "rtt_le_5", and times are in ms.
+func AppendInfluxLine(buf []byte, summary *Summary, tags Tags) []byte {
+	lineTags := make(Tags, len(tags)+3)
+	for k, v := range tags {
+		lineTags[k] = v
+	}
+	lineTags["src_ip"] = summary.Pd.SrcIP.String()
+	lineTags["dst_ip"] = summary.Pd.DstIP.String()
+	lineTags["tos"] = strconv.Itoa(int(summary.Tos))
+
+	buf = append(buf, InfluxMeasurement...)
+	for _, k := range sortedKeys(lineTags) {
+		// Empty values aren't allowed
+		if k == "" || lineTags[k] == "" {
+			continue
+		}
+		buf = append(buf, ',')
+		buf = append(buf, influxTagEscaper.Replace(k)...)
+		buf = append(buf, '=')
+		buf = append(buf, influxTagEscaper.Replace(lineTags[k])...)
+	}
+
+	sep := byte(' ')
+	float := func(name string, v float64) {
+		// Neither are allowed, and shouldn't happen, but don't break the line
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return
+		}
+		buf = append(buf, sep)
+		buf = append(buf, name...)
+		buf = append(buf, '=')
+		buf = strconv.AppendFloat(buf, v, 'g', -1, 64)
+		sep = ','
+	}
+	integer := func(name string, v int64) {
+		buf = append(buf, sep)
+		buf = append(buf, name...)
+		buf = append(buf, '=')
+		buf = strconv.AppendInt(buf, v, 10)
+		buf = append(buf, 'i')
+		sep = ','
+	}
+	float("rtt_avg", summary.RTTAvg)
+	float("rtt_min", summary.RTTMin)
+	float("rtt_max", summary.RTTMax)
+	for _, p := range summary.RTTPercentiles {
+		float("rtt_p"+formatFloatLabel(p.P), p.Value)
+	}
+	for _, b := range summary.RTTHistogram {
+		integer("rtt_le_"+formatFloatLabel(b.Le), int64(b.Count))
+	}
+	float("jitter", summary.Jitter)
+	float("ipdv_mean", summary.IPDVMean)
+	float("ipdv_max", summary.IPDVMax)
+	float("fwd_delay_avg", summary.FwdDelayAvg)
+	float("rev_delay_avg", summary.RevDelayAvg)
+	float("dwell_avg", summary.DwellAvg)
+	float("clock_offset", summary.ClockOffset)
+	float("clock_offset_err", summary.ClockOffsetErr)
+	integer("sent", int64(summary.Sent))
+	integer("lost", int64(summary.Lost))
+	float("loss", summary.Loss)
+	integer("duplicates", int64(summary.Duplicates))
+	integer("reordered", int64(summary.Reordered))
+	integer("reorder_extent", int64(summary.ReorderExtent))
+
+	// Without one, the server uses the time it's received
+	if !summary.TS.IsZero() {
+		buf = append(buf, ' ')
+		buf = strconv.AppendInt(buf, summary.TS.UnixNano(), 10)
+	}
+	return append(buf, '\n')
+}
+
+// InfluxPusher is a SummarySink that writes summaries to an InfluxDB
+// compatible /write URL in the background, in batches of lines, retrying
+// batches that fail.
+type InfluxPusher struct {
+	url        string
+	tags       func(string) Tags
+	client     *http.Client
+	batchSize  int
+	retries    int
+	retryDelay time.Duration // Doubled after each retry
+	batches    chan []byte
+	ctx        context.Context
+	cancel     context.CancelFunc
+	wg         sync.WaitGroup
+}
+
+// WriteSummaries queues the summaries in the batch to be written.
+//
+// This doesn't block. If too many batches are already waiting to be written,
+// such as while the server is down, the summaries are dropped, and an error
+// returned.
+func (ip *InfluxPusher) WriteSummaries(batch *SummaryBatch) error {
+	var lines []byte
+	n, dropped := 0, 0
+	for i, summary := range batch.Summaries {
+		var tags Tags
+		if ip.tags != nil {
+			tags = ip.tags(summary.Pd.DstIP.String())
+		}
+		lines = AppendInfluxLine(lines, summary, tags)
+		n++
+		if n == ip.batchSize || i == len(batch.Summaries)-1 {
+			if !ip.queue(lines) {
+				dropped += n
+			}
+			lines, n = nil, 0
+		}
+	}
+	if dropped > 0 {
+		return fmt.Errorf("dropped %d summaries for InfluxDB, with %d "+
+			"batches already waiting", dropped, len(ip.batches))
+	}
+	return nil
+}
+
+// queue adds the lines to be written, and reports if there was room.
+func (ip *InfluxPusher) queue(lines []byte) bool {
+	select {
+	case ip.batches <- lines:
+		return true
+	default:
+		return false
+	}
+}
+
+// Run starts writing the pushed batches in a new goroutine.
+func (ip *InfluxPusher) Run() {
+	ip.wg.Add(1)
+	go func() {
+		defer ip.wg.Done()
+		for {
+			select {
+			case <-ip.ctx.Done():
+				return
+			case batch := <-ip.batches:
+				err := ip.writeWithRetries(batch)
+				if err != nil && ip.ctx.Err() == nil {
+					HandleMinorErrorMsg(err, "dropping summaries for InfluxDB")
+				}
+			}
+		}
+	}()
+}
+
+// writeWithRetries writes the batch, retrying up to the retry limit if it
+// fails in a way that could succeed later.
+func (ip *InfluxPusher) writeWithRetries(batch []byte) error {
+	delay := ip.retryDelay
+	for attempt := 0; ; attempt++ {
+		retry, err := ip.write(batch)
+		if err == nil || !retry || attempt >= ip.retries {
+			return err
+		}
+		HandleMinorErrorMsg(err, fmt.Sprintf(
+			"failed to write to InfluxDB, retrying in %v", delay))
+		select {
+		case <-ip.ctx.Done():
+			return ip.ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// write makes a single attempt at writing the batch, and reports if it's
+// worth retrying if it fails.
+func (ip *InfluxPusher) write(batch []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ip.ctx, http.MethodPost, ip.url,
+		bytes.NewReader(batch))
+	if err != nil {
+		return false, fmt.Errorf("invalid InfluxDB URL: %w", err)
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	resp, err := ip.client.Do(req)
+	if err != nil {
+		return true, fmt.Errorf("failed to write to InfluxDB: %w", err)
+	}
+	defer resp.Body.Close()
+	// Includes the reason for errors
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	switch {
+	case resp.StatusCode/100 == 2:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode/100 == 5:
+		return true, fmt.Errorf("InfluxDB responded with %s: %s", resp.Status,
+			bytes.TrimSpace(body))
+	default:
+		// The same lines would be rejected again
+		return false, fmt.Errorf("InfluxDB rejected summaries with %s: %s",
+			resp.Status, bytes.TrimSpace(body))
+	}
+}
+
+// Stop will stop the ip, and wait for it to exit. Batches that haven't been
+// written yet are dropped.
+func (ip *InfluxPusher) Stop() {
+	ip.cancel()
+	ip.wg.Wait()
+}
+
+// Close is the same as Stop, for SummarySink.
+func (ip *InfluxPusher) Close() error {
+	ip.Stop()
+	return nil
+}
+
+// NewInfluxPusher creates an InfluxPusher based on the ic, which stops once
+// ctx is done, or Stop is called.
+//
+// `tags` provides the tags for each of the destination IPs, such as API.Tags,
+// and may be nil.
+func NewInfluxPusher(ctx context.Context, ic InfluxConfig,
+	tags func(string) Tags) *InfluxPusher {
+	ctx, cancel := context.WithCancel(ctx)
+	ic.SetDefaults()
+	return &InfluxPusher{
+		url:        ic.URL,
+		tags:       tags,
+		client:     &http.Client{Timeout: time.Duration(ic.Timeout) * time.Millisecond},
+		batchSize:  int(ic.BatchSize),
+		retries:    int(*ic.Retries),
+		retryDelay: DefaultInfluxRetryDelay,
+		batches:    make(chan []byte, DEFAULT_CHANNEL_SIZE),
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+}
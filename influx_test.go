@@ -0,0 +1,160 @@
+package udprobe
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAppendInfluxLine(t *testing.T) {
+	summary := &Summary{
+		Pd: &PathDist{SrcIP: net.ParseIP("10.0.0.1"),
+			DstIP: net.ParseIP("10.0.1.1")},
+		RTTAvg:         1.5,
+		RTTPercentiles: []Percentile{{P: 99.9, Value: 2}},
+		RTTHistogram:   []HistogramBucket{{Le: 5, Count: 9}},
+		Sent:           10,
+		Lost:           1,
+		Loss:           10,
+		Tos:            184,
+		TS:             time.Unix(1700000000, 5),
+	}
+	tags := Tags{"dst_hostname": "reflector 1", "site": "a,b", "empty": "",
+		"dst_ip": "replaced"}
+	line := string(AppendInfluxLine([]byte("first\n"), summary, tags))
+	expected := `first
+udprobe,dst_hostname=reflector\ 1,dst_ip=10.0.1.1,site=a\,b,src_ip=10.0.0.1,tos=184 ` +
+		"rtt_avg=1.5,rtt_min=0,rtt_max=0,rtt_p99.9=2,rtt_le_5=9i,jitter=0," +
+		"ipdv_mean=0,ipdv_max=0,fwd_delay_avg=0,rev_delay_avg=0,dwell_avg=0," +
+		"clock_offset=0,clock_offset_err=0,sent=10i,lost=1i,loss=10," +
+		"duplicates=0i,reordered=0i,reorder_extent=0i 1700000000000000005\n"
+	if line != expected {
+		t.Error("Wrong line. Got", line, "expected", expected)
+	}
+}
+
+func TestInfluxHandler(t *testing.T) {
+	api := &API{
+		summarizer: &Summarizer{Cache: exampleSummaries},
+		ts:         TagSet{"10.0.1.2": {"dst_hostname": "reflector-2"}},
+	}
+	rw := httptest.NewRecorder()
+	api.InfluxHandler(rw, httptest.NewRequest("GET", "/influxdata", nil))
+	lines := strings.Split(strings.TrimSpace(rw.Body.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatal("Wrong number of lines. Got", lines)
+	}
+	if !strings.HasPrefix(lines[1], "udprobe,dst_hostname=reflector-2,") {
+		t.Error("Tags missing. Got", lines[1])
+	}
+
+	rw = httptest.NewRecorder()
+	api.InfluxHandler(rw, httptest.NewRequest("GET",
+		"/influxdata?dst_hostname=reflector-2", nil))
+	if n := strings.Count(rw.Body.String(), "\n"); n != 1 {
+		t.Error("Not filtered. Got", rw.Body.String())
+	}
+}
+
+// influxServer stands in for InfluxDB, responding to each write with the
+// next of its statuses, then 204 once they're used up.
+type influxServer struct {
+	*httptest.Server
+	mutex    sync.Mutex
+	statuses []int
+	writes   []string // Bodies of the successful writes
+	attempts int
+}
+
+func newInfluxServer(statuses ...int) *influxServer {
+	s := &influxServer{statuses: statuses}
+	s.Server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			s.mutex.Lock()
+			defer s.mutex.Unlock()
+			s.attempts++
+			status := http.StatusNoContent
+			if len(s.statuses) > 0 {
+				status, s.statuses = s.statuses[0], s.statuses[1:]
+			}
+			if status == http.StatusNoContent {
+				s.writes = append(s.writes, string(body))
+			}
+			w.WriteHeader(status)
+		}))
+	return s
+}
+
+// wait waits for the server to have n writes, and provides them.
+func (s *influxServer) wait(t *testing.T, n int) []string {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		s.mutex.Lock()
+		writes := append([]string(nil), s.writes...)
+		s.mutex.Unlock()
+		if len(writes) >= n {
+			return writes
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("Timed out waiting for", n, "writes")
+	return nil
+}
+
+func TestInfluxPusher(t *testing.T) {
+	// The first write is retried after it fails, and the second isn't after
+	// it's rejected
+	server := newInfluxServer(http.StatusServiceUnavailable,
+		http.StatusNoContent, http.StatusBadRequest)
+	defer server.Close()
+	tags := func(ip string) Tags { return Tags{"dst_hostname": "host-" + ip} }
+	pusher := NewInfluxPusher(context.Background(),
+		InfluxConfig{URL: server.URL + "/write?db=udprobe", BatchSize: 1}, tags)
+	pusher.retryDelay = time.Millisecond
+	pusher.Run()
+	defer pusher.Stop()
+
+	err := pusher.WriteSummaries(&SummaryBatch{Summaries: exampleSummaries})
+	if err != nil {
+		t.Error("Failed to queue summaries:", err)
+	}
+	writes := server.wait(t, 1)
+	if !strings.Contains(writes[0], "dst_hostname=host-10.0.1.1") ||
+		strings.Count(writes[0], "\n") != 1 {
+		t.Error("Wrong first batch. Got", writes[0])
+	}
+	// Then a third batch, once the second is dropped
+	pusher.WriteSummaries(&SummaryBatch{Summaries: exampleSummaries[:1]})
+	writes = server.wait(t, 2)
+	if !strings.Contains(writes[1], "dst_hostname=host-10.0.1.1") {
+		t.Error("Wrong third batch. Got", writes[1])
+	}
+	server.mutex.Lock()
+	if server.attempts != 4 {
+		t.Error("Wrong number of attempts. Got", server.attempts, "expected", 4)
+	}
+	server.mutex.Unlock()
+}
+
+func TestInfluxPusherFull(t *testing.T) {
+	// Never run, so nothing is taken from the queue
+	pusher := NewInfluxPusher(context.Background(),
+		InfluxConfig{URL: "http://127.0.0.1:1/write", BatchSize: 1}, nil)
+	batch := &SummaryBatch{Summaries: exampleSummaries[:1]}
+	for i := int64(0); i < DEFAULT_CHANNEL_SIZE; i++ {
+		if err := pusher.WriteSummaries(batch); err != nil {
+			t.Fatal("Failed to queue summaries:", err)
+		}
+	}
+	err := pusher.WriteSummaries(batch)
+	if err == nil || !strings.Contains(err.Error(), "dropped 1 summaries") {
+		t.Error("Expected an error for the full queue. Got", err)
+	}
+}
@@ -0,0 +1,151 @@
+package udprobe
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+	"net/netip"
+	"strings"
+)
+
+// MaxTargetRange is the most addresses that a CIDR block or range of a
+// single TargetConfig can cover, so a typo like a /8 can't be loaded.
+const MaxTargetRange = 65536
+
+// ipRange is an inclusive range of addresses of the same family.
+type ipRange struct {
+	start netip.Addr
+	end   netip.Addr
+}
+
+// parseIPRange parses a single IP, a CIDR block like "10.0.0.0/24", or a
+// range like "10.0.0.1-10.0.0.20".
+func parseIPRange(s string) (ipRange, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return ipRange{}, err
+		}
+		prefix = prefix.Masked()
+		start := prefix.Addr()
+		// Set all of the host bits for the last address
+		last := start.AsSlice()
+		for i := prefix.Bits(); i < start.BitLen(); i++ {
+			last[i/8] |= 0x80 >> (i % 8)
+		}
+		end, _ := netip.AddrFromSlice(last)
+		return ipRange{start, end}, nil
+	}
+	startStr, endStr, isRange := strings.Cut(s, "-")
+	start, err := netip.ParseAddr(strings.TrimSpace(startStr))
+	if err != nil {
+		return ipRange{}, err
+	}
+	if !isRange {
+		return ipRange{start.Unmap(), start.Unmap()}, nil
+	}
+	end, err := netip.ParseAddr(strings.TrimSpace(endStr))
+	if err != nil {
+		return ipRange{}, err
+	}
+	start, end = start.Unmap(), end.Unmap()
+	if start.Is4() != end.Is4() {
+		return ipRange{}, errors.New("range mixes IPv4 and IPv6")
+	}
+	if end.Less(start) {
+		return ipRange{}, errors.New("range ends before it starts")
+	}
+	return ipRange{start, end}, nil
+}
+
+// contains reports if the addr is in the r.
+func (r ipRange) contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.BitLen() == r.start.BitLen() &&
+		r.start.Compare(addr) <= 0 && addr.Compare(r.end) <= 0
+}
+
+// size provides the number of addresses in the r, up to math.MaxUint64.
+func (r ipRange) size() uint64 {
+	start, end := r.start.As16(), r.end.As16()
+	startHi := binary.BigEndian.Uint64(start[:8])
+	startLo := binary.BigEndian.Uint64(start[8:])
+	endHi := binary.BigEndian.Uint64(end[:8])
+	endLo := binary.BigEndian.Uint64(end[8:])
+	lo, borrow := bits.Sub64(endLo, startLo, 0)
+	hi, _ := bits.Sub64(endHi, startHi, borrow)
+	if hi > 0 || lo == math.MaxUint64 {
+		return math.MaxUint64
+	}
+	return lo + 1
+}
+
+// IsRange reports if the IP of the tc is a CIDR block or range, rather than
+// a single address.
+func (tc *TargetConfig) IsRange() bool {
+	return strings.ContainsAny(tc.IP, "/-")
+}
+
+// expandRange provides a target for each address in the CIDR block or range
+// of the tc, less any in Exclude, and sampled down to Limit if that's set.
+// Each has the tags of the tc, with the block or range as the dst_range tag
+// unless that's already set.
+//
+// The network and broadcast addresses of IPv4 blocks are left out, other
+// than for a /31 or /32, where there aren't any.
+func (tc *TargetConfig) expandRange() (TargetSet, error) {
+	r, err := parseIPRange(tc.IP)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target range %q: %w", tc.IP, err)
+	}
+	if size := r.size(); size > MaxTargetRange {
+		return nil, fmt.Errorf("target range %q has %d addresses, more than %d",
+			tc.IP, size, MaxTargetRange)
+	}
+	// Sending to the broadcast address fails with EACCES
+	if prefix, err := netip.ParsePrefix(tc.IP); err == nil &&
+		prefix.Addr().Is4() && prefix.Bits() < 31 {
+		r.start, r.end = r.start.Next(), r.end.Prev()
+	}
+	excludes := make([]ipRange, 0, len(tc.Exclude))
+	for _, s := range tc.Exclude {
+		exclude, err := parseIPRange(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exclude %q: %w", s, err)
+		}
+		excludes = append(excludes, exclude)
+	}
+	var addrs []netip.Addr
+next:
+	for addr := r.start; addr.IsValid() && addr.Compare(r.end) <= 0; addr = addr.Next() {
+		for _, exclude := range excludes {
+			if exclude.contains(addr) {
+				continue next
+			}
+		}
+		addrs = append(addrs, addr)
+	}
+	if tc.Limit > 0 && int64(len(addrs)) > tc.Limit {
+		// Spread evenly, so the same ones are picked every time
+		sampled := make([]netip.Addr, tc.Limit)
+		for i := range sampled {
+			sampled[i] = addrs[int64(i)*int64(len(addrs))/tc.Limit]
+		}
+		addrs = sampled
+	}
+	targets := make(TargetSet, 0, len(addrs))
+	for _, addr := range addrs {
+		tags := make(Tags, len(tc.Tags)+1)
+		for k, v := range tc.Tags {
+			tags[k] = v
+		}
+		if tags["dst_range"] == "" {
+			tags["dst_range"] = tc.IP
+		}
+		targets = append(targets, TargetConfig{IP: addr.String(),
+			Port: tc.Port, Tags: tags})
+	}
+	return targets, nil
+}
@@ -0,0 +1,97 @@
+package udprobe
+
+import (
+	"context"
+	"testing"
+)
+
+func TestParseIPRange(t *testing.T) {
+	for _, test := range []struct {
+		s     string
+		start string
+		end   string
+		size  uint64
+	}{
+		{"10.0.0.7", "10.0.0.7", "10.0.0.7", 1},
+		{"10.0.0.7/24", "10.0.0.0", "10.0.0.255", 256},
+		{"10.0.0.250-10.0.1.5", "10.0.0.250", "10.0.1.5", 12},
+		{"2001:db8::/120", "2001:db8::", "2001:db8::ff", 256},
+		{"::/0", "::", "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff", 1<<64 - 1},
+	} {
+		r, err := parseIPRange(test.s)
+		if err != nil {
+			t.Error("Failed to parse", test.s, err)
+			continue
+		}
+		if r.start.String() != test.start || r.end.String() != test.end ||
+			r.size() != test.size {
+			t.Error("Wrong range for", test.s, "Got", r.start, r.end, r.size(),
+				"expected", test.start, test.end, test.size)
+		}
+	}
+	for _, s := range []string{"10.0.0.0/33", "10.0.0.9-10.0.0.1",
+		"10.0.0.1-2001:db8::1", "10.0.0.1-"} {
+		if _, err := parseIPRange(s); err == nil {
+			t.Error("Expected an error for", s)
+		}
+	}
+}
+
+func TestTargetConfigDiscoverRange(t *testing.T) {
+	tc := TargetConfig{
+		IP:      "192.0.2.0/28",
+		Exclude: []string{"192.0.2.0", "192.0.2.8-192.0.2.15"},
+		Port:    8100,
+		Tags:    Tags{"rack": "r1"},
+	}
+	targets, err := tc.Discover(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 7 || targets[0].IP != "192.0.2.1" ||
+		targets[6].IP != "192.0.2.7" {
+		t.Fatal("Wrong targets. Got", targets.ListTargets())
+	}
+	if tags := targets[2].Tags; tags["rack"] != "r1" ||
+		tags["dst_range"] != "192.0.2.0/28" || tags["dst_hostname"] != "" {
+		t.Error("Wrong tags. Got", tags)
+	}
+	if tagset := (TargetSet{tc}).TagSet(""); len(tagset) != 0 {
+		t.Error("Range shouldn't have tags until expanded. Got", tagset)
+	}
+
+	tc.Limit = 3
+	targets, _ = tc.Discover(context.Background(), nil)
+	expected := []string{"192.0.2.1:8100", "192.0.2.3:8100", "192.0.2.5:8100"}
+	addrs := targets.ListTargets()
+	if len(addrs) != len(expected) {
+		t.Fatal("Wrong sample. Got", addrs, "expected", expected)
+	}
+	for i := range addrs {
+		if addrs[i] != expected[i] {
+			t.Error("Wrong sample", i, "Got", addrs[i], "expected", expected[i])
+		}
+	}
+
+	// No network or broadcast addresses, other than for a /31
+	for ip, expected := range map[string][]string{
+		"192.0.2.0/30":        {"192.0.2.1:8100", "192.0.2.2:8100"},
+		"192.0.2.0/31":        {"192.0.2.0:8100", "192.0.2.1:8100"},
+		"192.0.2.0-192.0.2.1": {"192.0.2.0:8100", "192.0.2.1:8100"},
+		"2001:db8::/127":      {"[2001:db8::]:8100", "[2001:db8::1]:8100"},
+		"192.0.2.255/32":      {"192.0.2.255:8100"},
+	} {
+		tc = TargetConfig{IP: ip, Port: 8100}
+		targets, _ = tc.Discover(context.Background(), nil)
+		addrs := targets.ListTargets()
+		if len(addrs) != len(expected) || addrs[0] != expected[0] ||
+			addrs[len(addrs)-1] != expected[len(expected)-1] {
+			t.Error("Wrong targets for", ip, "Got", addrs, "expected", expected)
+		}
+	}
+
+	tc = TargetConfig{IP: "10.0.0.0/8", Port: 8100}
+	if _, err := tc.Discover(context.Background(), nil); err == nil {
+		t.Error("Expected an error for a range over the limit")
+	}
+}
@@ -4,13 +4,16 @@ package udprobe
 import (
 	"context"
 	"errors"
+	"fmt"
 	"net"
-	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jellydator/ttlcache/v3"
 	pb "github.com/nsw3550/udprobe/proto"
+	"golang.org/x/sys/unix"
 	"google.golang.org/protobuf/proto"
 )
 
@@ -19,27 +22,46 @@ type Port struct {
 	tosend      chan *net.UDPAddr // A channel for receiving targets
 	conn        *net.UDPConn      // The socket on which to send/receive
 	cache       *ttlcache.Cache[string, *InFlightProbe]
-	stop        chan bool           // A signal to stop processing
-	cbc         chan *InFlightProbe // Callback channel for sending expired Probes
-	readTimeout time.Duration       // How long to wait for reads
-	basePD      *PathDist           // A partially filled PathDist based on conn
+	rcvd        *ttlcache.Cache[string, *InFlightProbe] // Recently received, for spotting duplicates
+	ctx         context.Context                         // Done once the Port is stopped
+	cancel      context.CancelFunc                      // Stops the Port
+	wg          sync.WaitGroup                          // Tracks all of the Port's goroutines
+	unsubscribe func()                                  // Stops passing expired probes to cbc
+	cbc         chan *InFlightProbe                     // Callback channel for sending expired Probes
+	errs        chan error                              // For reporting errors that stop the Port
+	readTimeout time.Duration                           // How long to wait for reads
+	basePD      *PathDist                               // A partially filled PathDist based on conn
+	seqs        map[string]uint64                       // Last sequence number sent per destination
+	tsMode      TimestampMode                           // Where send/receive timestamps come from
+	txMutex     sync.Mutex                              // Protects txKeys and txSent
+	txKeys      map[uint32]string                       // Cache keys by transmit timestamp ID
+	txSent      map[string]txStamps                     // Transmit timestamps by cache key, until applied
+	txNext      uint32                                  // Transmit timestamp ID of the next send
+	family      int                                     // Address family of the socket
+	v6only      bool                                    // If an IPv6 socket can't reach IPv4 targets
+	unreachable map[string]bool                         // Targets already warned about in send
+	batch       *BatchConn                              // For batched sending/receiving, if enabled
+	tos         atomic.Uint32                           // ToS byte last set on conn
+	keep        atomic.Pointer[map[string]bool]         // Targets to prune seqs and unreachable to in send
 }
 
-// srcPD creates a PathDist based on the known socket details for the port.
+// srcPD provides a PathDist based on the known socket details for the port.
 func (p *Port) srcPD() *PathDist {
-	if p.basePD != nil {
-		// Just return the saved base, so we don't waste time
-		return p.basePD
+	// This is filled in by NewPort, so we don't waste time on every probe
+	return p.basePD
+}
+
+// newSrcPD creates a PathDist based on the socket details for conn.
+func newSrcPD(conn *net.UDPConn) (*PathDist, error) {
+	udpAddr, network, err := LocalUDPAddr(conn)
+	if err != nil {
+		return nil, err
 	}
-	udpAddr, network, err := LocalUDPAddr(p.conn)
-	HandleError(err)
-	pd := PathDist{
+	return &PathDist{
 		SrcIP:   udpAddr.IP,
 		SrcPort: udpAddr.Port,
 		Proto:   network,
-	}
-	p.basePD = &pd // Save for future use
-	return &pd
+	}, nil
 }
 
 // pd will provide a completed PathDist based on the associated p.conn and
@@ -58,10 +80,55 @@ func (p *Port) pd(dst *net.UDPAddr) *PathDist {
 	return pathDist
 }
 
+// reaches checks if the Port's conn is able to send to the ip, based on the
+// IP version(s) of the socket and the address it's bound to.
+func (p *Port) reaches(ip net.IP) bool {
+	v4 := ip.To4() != nil
+	if src := p.srcPD().SrcIP; src != nil && !src.IsUnspecified() {
+		return v4 == (src.To4() != nil)
+	}
+	switch {
+	case p.family == unix.AF_INET:
+		return v4
+	case p.v6only:
+		return !v4
+	default:
+		return true
+	}
+}
+
+// SetBatch enables sending and receiving up to size probes per syscall, or
+// disables it if size is 1 or less. Must be called before Send and Recv.
+func (p *Port) SetBatch(size int) error {
+	if size <= 1 {
+		p.batch = nil
+		return nil
+	}
+	batch, err := NewBatchConn(p.conn, size)
+	if err != nil {
+		return err
+	}
+	p.batch = batch
+	return nil
+}
+
 // ToS provides the currently active ToS byte value for the port's conn.
+//
+// This is cached, so it doesn't cost a syscall for every probe. Use SetTos to
+// change it, rather than changing the socket directly.
 func (p *Port) Tos() byte {
-	val := GetTos(p.conn)
-	return val
+	return byte(p.tos.Load())
+}
+
+// SetTos changes the ToS byte value for the port's conn, which applies to
+// probes sent after this returns. The cached value is left alone if the
+// socket couldn't be updated.
+func (p *Port) SetTos(tos byte) error {
+	if err := SetTos(p.conn, tos); err != nil {
+		return err
+	}
+	p.tos.Store(uint32(tos))
+	return nil
 }
 
 // Send waits to get UDPAddr targets and sends probes to them using the
@@ -71,93 +138,247 @@ func (p *Port) Tos() byte {
 // used for retrieving later. The cache will also utilize a timeout to expire
 // probes that haven't returned in time.
 func (p *Port) Send() {
-	go p.send()
+	p.goRun(p.send)
 }
 
 func (p *Port) send() {
+	var msgs []BatchMessage
+	if p.batch != nil {
+		msgs = make([]BatchMessage, 0, p.batch.Size())
+	}
 	for {
 		select {
-		case <-p.stop:
+		case <-p.ctx.Done():
 			LogInfo("Stopping Port.send for " + p.conn.LocalAddr().String())
 			return // Discontinue sending
 		case addr := <-p.tosend:
-			if addr.IP == nil {
-				LogWarning("Skipping target with nil IP: " + addr.String())
-				continue
+			if keep := p.keep.Swap(nil); keep != nil {
+				p.prune(*keep)
 			}
-			pd := p.pd(addr)
-			tos := p.Tos()
-			key := NewID()
-			// NOTE: The more time spent before sending, the more stale
-			//       this will get. Not critical, but a consideration.
-			now := NowUint64()
-			probe := InFlightProbe{
-				Pd:    pd,
-				CSent: now,
-				Tos:   tos,
+			var err error
+			if p.batch != nil {
+				err = p.sendBatch(msgs, addr)
+			} else {
+				err = p.sendOne(addr)
 			}
-			// Add the probe to cache
-			// TODO(nwinemiller): Might want to make this async in the future to avoid
-			//             making `now` more stale as things are going on.
-			p.cache.Set(key, &probe, ttlcache.DefaultTTL)
-			signature := IDToBytes(key)
-			var padding [1000]byte
-			data := &pb.Probe{
-				Signature: signature[:],
-				Tos:       uint32(tos),
-				Sent:      now,
-				// TODO(nwinemiller): This should be customizable, and relative to
-				//			   to the rest of the probe. This should really
-				//             be used to fill to a maximum size.
-				//			   Likely based on the return from Marshal.
-				Padding: padding[:],
+			if errors.Is(err, net.ErrClosed) {
+				// Nothing more can be sent, so let the owner sort it out,
+				// unless it was closed by stopping
+				if p.ctx.Err() == nil {
+					reportError(p.errs, err)
+				}
+				return
 			}
-			packedData, err := proto.Marshal(data)
-			HandleError(err)
-			// Send the probe
-			_, err = p.conn.WriteToUDP(packedData, addr)
-			HandleError(err)
 			// TODO(nwinemiller): Log rate of `packets_sent`
 		}
 	}
 }
 
+// sendOne sends a probe to addr.
+//
+// Failing to send isn't fatal, the probe is just left to expire as a loss.
+func (p *Port) sendOne(addr *net.UDPAddr) error {
+	data, ok := p.probe(addr)
+	if !ok {
+		return nil
+	}
+	_, err := p.conn.WriteToUDP(data, addr)
+	if err != nil {
+		HandleMinorErrorMsg(err, "failed to send probe to "+addr.String())
+		p.unsent(1)
+	}
+	return err
+}
+
+// sendBatch sends probes to addr, and whatever other targets are already
+// waiting, up to the batch size, in a single syscall.
+//
+// Same as sendOne, any unsent probes are left to expire as losses.
+func (p *Port) sendBatch(msgs []BatchMessage, addr *net.UDPAddr) error {
+	for {
+		if data, ok := p.probe(addr); ok {
+			msgs = append(msgs, BatchMessage{Buf: data, Addr: addr})
+		}
+		if len(msgs) == cap(msgs) {
+			break
+		}
+		// Don't wait around for more, since that delays the ones we have
+		select {
+		case addr = <-p.tosend:
+			continue
+		default:
+		}
+		break
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+	sent, err := p.batch.WriteBatch(msgs)
+	if err != nil {
+		HandleMinorErrorMsg(err, "failed to send probes")
+		p.unsent(len(msgs) - sent)
+	}
+	return err
+}
+
+// SetTargets has the Port forget the sequence numbers and warnings for any
+// destinations that aren't one of the targets, once it next sends, so they
+// don't accumulate as targets change.
+func (p *Port) SetTargets(targets []*net.UDPAddr) {
+	keep := make(map[string]bool, len(targets))
+	for _, addr := range targets {
+		keep[addr.String()] = true
+	}
+	p.keep.Store(&keep)
+}
+
+// prune removes the sequence numbers and warnings for destinations that
+// aren't in keep. Only used from send, so no locking is needed.
+func (p *Port) prune(keep map[string]bool) {
+	for dst := range p.seqs {
+		if !keep[dst] {
+			delete(p.seqs, dst)
+		}
+	}
+	for dst := range p.unreachable {
+		if !keep[dst] {
+			delete(p.unreachable, dst)
+		}
+	}
+}
+
+// unsent accounts for the last count probes not actually being sent, so the
+// transmit timestamps of later probes are matched correctly.
+//
+// This assumes the kernel didn't count them either, which holds for errors
+// from before the packet is built, like unreachable routes.
+func (p *Port) unsent(count int) {
+	if !p.tsMode.transmit() {
+		return
+	}
+	p.txMutex.Lock()
+	defer p.txMutex.Unlock()
+	for i := 0; i < count; i++ {
+		p.txNext--
+		delete(p.txKeys, p.txNext)
+	}
+}
+
+// probe creates a probe for the addr, adds it to the cache, and returns the
+// data to send. Returns false if the addr should be skipped.
+func (p *Port) probe(addr *net.UDPAddr) ([]byte, bool) {
+	if addr.IP == nil {
+		LogWarning("Skipping target with nil IP: " + addr.String())
+		return nil, false
+	}
+	if !p.reaches(addr.IP) {
+		// Only used from send, so no locking is needed
+		if !p.unreachable[addr.String()] {
+			LogWarning("Skipping target with a different IP version than " +
+				p.conn.LocalAddr().String() + ": " + addr.String())
+			p.unreachable[addr.String()] = true
+		}
+		return nil, false
+	}
+	pd := p.pd(addr)
+	tos := p.Tos()
+	key := NewID()
+	// Only used from send, so no locking is needed
+	dst := addr.String()
+	seq := p.seqs[dst] + 1
+	// NOTE: The more time spent before sending, the more stale
+	//       this will get. Not critical, but a consideration.
+	now := NowUint64()
+	signature := IDToBytes(key)
+	var padding [1000]byte
+	data := &pb.Probe{
+		Signature: signature[:],
+		Tos:       uint32(tos),
+		Sent:      now,
+		Seq:       seq,
+		// TODO(nwinemiller): This should be customizable, and relative to
+		//			   to the rest of the probe. This should really
+		//             be used to fill to a maximum size.
+		//			   Likely based on the return from Marshal.
+		Padding: padding[:],
+	}
+	packedData, err := proto.Marshal(data)
+	if err != nil {
+		HandleMinorErrorMsg(err, "failed to marshal probe")
+		return nil, false
+	}
+	p.seqs[dst] = seq
+	probe := InFlightProbe{
+		Pd:    pd,
+		CSent: now,
+		Tos:   tos,
+		Seq:   seq,
+		txID:  p.txNext,
+	}
+	if p.tsMode.transmit() {
+		// The kernel counts every send, so failed sends need to be
+		// rolled back with unsent
+		p.txMutex.Lock()
+		p.txKeys[p.txNext] = key
+		p.txMutex.Unlock()
+		p.txNext++
+	}
+	// Add the probe to cache
+	// TODO(nwinemiller): Might want to make this async in the future to avoid
+	//             making `now` more stale as things are going on.
+	p.cache.Set(key, &probe, ttlcache.DefaultTTL)
+	return packedData, true
+}
+
 // Recv listens on the Port for returning probes and updates them in the cache.
 //
 // Once probes are received, they are located in the cache, updated, and then
 // set for immediate expiration. If a probe is received but has no entry in
-// the cache, it most likely exceeded the timeout.
+// the cache, it was either already received (a duplicate) or most likely
+// exceeded the timeout.
 func (p *Port) Recv() {
-	go p.recv()
+	p.goRun(p.recv)
 }
 
 func (p *Port) recv() {
-	dataBuf := make([]byte, 4096) // Reuse this for the received data
-	// This will be implemented for timestamps in the future
-	oobBuf := make([]byte, 4096) // Reuse this for the received oob data
+	size := 1
+	if p.batch != nil {
+		size = p.batch.Size()
+	}
+	// Reuse these for the received data and oob data
+	msgs := make([]BatchMessage, size)
+	for i := range msgs {
+		msgs[i].Buf = make([]byte, 4096)
+		msgs[i].OOB = make([]byte, 4096)
+	}
 	for {
 		select {
-		case <-p.stop:
+		case <-p.ctx.Done():
 			LogInfo("Stopping Port.recv for: " + p.conn.LocalAddr().String())
-			// Don't process expirations anymore
-			// This prevents outstanding probes from reporting as loss
-			p.cache.OnEviction(func(ctx context.Context, reason ttlcache.EvictionReason, item *ttlcache.Item[string, *InFlightProbe]) {})
 			return // Stop receiving
 		default:
 			// This is a specific point in time, so it needs to be refreshed
 			timeout := time.Now().Add(p.readTimeout)
 			err := p.conn.SetReadDeadline(timeout)
-			HandleError(err)
+			if err != nil {
+				reportError(p.errs, fmt.Errorf(
+					"failed to set read deadline on %s: %w",
+					p.conn.LocalAddr(), err))
+				return
+			}
 			// TODO(nwinemiller):
 			// This is very similar to `reflector.Receive` except for timeout
 			// handling. Should consolidate these at some point in UDP.
-			// Ignoring `oobLen` and `flags`for now
-			// We don't need `addr since we're matching on the signature
-			// NOTE(nwinemiller): For some reason, on stop, every once in a while,
-			//   A process will get stuck here. Specifically on the underlying
-			//   Recvmsg call in syscall. It seems to ignore the deadline, and
-			//   then stick around forever. Unsure of the cause.
-			dataLen, _, _, _, err := p.conn.ReadMsgUDP(dataBuf, oobBuf)
+			// Stopping closes the conn, so this won't get stuck here.
+			n, err := p.read(msgs)
+			if err != nil && p.ctx.Err() != nil {
+				// Expected, since stopping closes the conn
+				continue
+			}
+			// Transmit timestamps need to be in place before a probe is
+			// marked as received, and a reflected probe can't arrive before
+			// its transmit timestamp is queued.
+			stamped := p.patchSent()
 			if err != nil {
 				// Check if it's a networking error
 				netErr, ok := err.(net.Error)
@@ -168,50 +389,196 @@ func (p *Port) recv() {
 					"use of closed network connection") {
 					// This means the connection is closed, so we can't use it
 					// In lieu of better cleanup behavior (for whatever case
-					// might cause this) have it cause a restart of the process
-					HandleFatalErrorMsg(err, "Attempted to read from closed conn: "+
-						p.conn.LocalAddr().String())
+					// might cause this) leave it to the owner to restart
+					reportError(p.errs, fmt.Errorf(
+						"attempted to read from closed conn %s: %w",
+						p.conn.LocalAddr(), err))
+					return
+				} else if stamped {
+					// The runtime reports an error when the only event on
+					// the socket was a transmit timestamp on the error
+					// queue, which has been read above.
 					continue
 				} else {
 					// Some other problem
-					HandleFatalErrorMsg(err, "Failure while listening on "+p.conn.LocalAddr().String())
+					reportError(p.errs, fmt.Errorf(
+						"failure while listening on %s: %w",
+						p.conn.LocalAddr(), err))
+					return
 				}
 			}
-			data := dataBuf[0:dataLen]
-			udpData := &pb.Probe{}
-			err = proto.Unmarshal(data, udpData)
-			HandleMinorErrorMsg(err, "failed to unmarshal probe data")
-			id := string(udpData.Signature[:])
-			// TODO(nwinemiller): Should be doing something about this error
-			item := p.cache.Get(id)
-			if item == nil || item.IsExpired() {
-				// This means it expired already or doesn't exist
-				// so there's nothing to do.
-				// TODO(nwinemiller): Log/stat on occurrences of this
-				continue
+			for i := 0; i < n; i++ {
+				p.handle(msgs[i].Buf[0:msgs[i].N], msgs[i].OOB[0:msgs[i].NN])
 			}
-			// TODO(nwinemiller): Make wish to make a `ProbeCache` that does this
-			//             automatically under the hood.
-			probe, err := IfaceToInFlightProbe(item.Value())
-			HandleMinorErrorMsg(err, "failed to convert interface to InFlightProbe")
-			probe.CRcvd = NowUint64()
-			probe.ReflectorRcvd = udpData.Rcvd
-			// Error would be if the key didn't exist, meaning it expired
-			// since the Get above. Rare but possible. Acceptable for now.
-			// TODO(nwinemiller): Log/stat on occurrences of this
-			p.cache.Set(id, probe, ExpireNow)
-			// TODO(nwinemiller): Log rate of `packets_received`
 		}
 	}
 }
 
+// read receives into msgs, in a batch if enabled, and returns how many were
+// received.
+func (p *Port) read(msgs []BatchMessage) (int, error) {
+	if p.batch != nil {
+		return p.batch.ReadBatch(msgs)
+	}
+	// We don't need `addr` since we're matching on the signature
+	dataLen, oobLen, _, _, err := p.conn.ReadMsgUDP(msgs[0].Buf, msgs[0].OOB)
+	if err != nil {
+		return 0, err
+	}
+	msgs[0].N, msgs[0].NN = dataLen, oobLen
+	return 1, nil
+}
+
+// handle updates the probe in the cache for a received packet.
+func (p *Port) handle(data []byte, oob []byte) {
+	// Grab this as early as possible, in case it's from userspace
+	rcvd := RcvdTime(oob, p.tsMode)
+	var hwRcvd uint64
+	if p.tsMode == TimestampHardware {
+		hwRcvd, _ = HardwareTimestamp(oob)
+	}
+	udpData := &pb.Probe{}
+	err := proto.Unmarshal(data, udpData)
+	HandleMinorErrorMsg(err, "failed to unmarshal probe data")
+	id := string(udpData.Signature[:])
+	// TODO(nwinemiller): Should be doing something about this error
+	item := p.cache.Get(id)
+	if item == nil || item.IsExpired() {
+		// This means it expired already, doesn't exist, or we've
+		// already seen it. Only the last case needs reporting.
+		// TODO(nwinemiller): Log/stat on occurrences of the others
+		p.duplicate(id, rcvd, hwRcvd)
+		return
+	}
+	// TODO(nwinemiller): Make wish to make a `ProbeCache` that does this
+	//             automatically under the hood.
+	cached, err := IfaceToInFlightProbe(item.Value())
+	HandleMinorErrorMsg(err, "failed to convert interface to InFlightProbe")
+	// The cached one can expire and be passed on at any time, so it's
+	// replaced with an updated copy rather than changed
+	probe := p.applySent(id, cached)
+	probe.CRcvd = rcvd
+	probe.hwRcvd = hwRcvd
+	probe.ReflectorRcvd = udpData.Rcvd
+	probe.ReflectorSent = udpData.ReflectorSent
+	// Error would be if the key didn't exist, meaning it expired
+	// since the Get above. Rare but possible. Acceptable for now.
+	// TODO(nwinemiller): Log/stat on occurrences of this
+	p.cache.Set(id, probe, ExpireNow)
+	// Remember it for a bit, in case the network duplicates it
+	p.rcvd.Set(id, probe, ttlcache.DefaultTTL)
+	// TODO(nwinemiller): Log rate of `packets_received`
+}
+
+// patchSent reads any transmit timestamps for the Port's conn, and keeps
+// them for applySent to update the send time of the associated probes. It
+// reports if there were any.
+func (p *Port) patchSent() bool {
+	if !p.tsMode.transmit() {
+		return false
+	}
+	stamps, err := TxTimestamps(p.conn)
+	HandleMinorErrorMsg(err, "failed to read transmit timestamps")
+	p.txMutex.Lock()
+	defer p.txMutex.Unlock()
+	for _, stamp := range stamps {
+		// Left for applySent to remove, since there can be both a software
+		// and a hardware one
+		key, ok := p.txKeys[stamp.ID]
+		if !ok {
+			continue // The probe already expired
+		}
+		sent := p.txSent[key]
+		if stamp.Hardware {
+			sent.hardware = stamp.Time
+		} else {
+			sent.software = stamp.Time
+		}
+		p.txSent[key] = sent
+	}
+	return len(stamps) > 0
+}
+
+// txStamps are the transmit timestamps of a probe, which are 0 until read.
+type txStamps struct {
+	software uint64
+	hardware uint64
+}
+
+// applySent provides a copy of the probe with the cache key, with the send
+// time from its transmit timestamp if that's been read, and stops waiting for
+// it.
+func (p *Port) applySent(key string, probe *InFlightProbe) *InFlightProbe {
+	sent := *probe
+	if !p.tsMode.transmit() {
+		return &sent
+	}
+	p.txMutex.Lock()
+	defer p.txMutex.Unlock()
+	// In case the transmit timestamp never showed up
+	delete(p.txKeys, probe.txID)
+	if stamps, ok := p.txSent[key]; ok {
+		// Without one, the userspace send time is in the same clock anyways
+		if stamps.software != 0 {
+			sent.CSent = stamps.software
+		}
+		sent.hwSent = stamps.hardware
+		delete(p.txSent, key)
+	}
+	return &sent
+}
+
+// useHardware switches a received probe to its hardware timestamps, if it has
+// them for both sending and receiving. Otherwise it's left with its software
+// ones, since mixing the NIC's clock with the system's makes the RTT
+// meaningless, and is counted as a fallback.
+func (p *Port) useHardware(probe *InFlightProbe) {
+	if p.tsMode != TimestampHardware || probe.CRcvd == 0 {
+		return
+	}
+	if probe.hwSent == 0 || probe.hwRcvd == 0 {
+		udprobeTimestampFallbacks.Inc()
+		return
+	}
+	probe.CSent, probe.CRcvd = probe.hwSent, probe.hwRcvd
+}
+
+// duplicate checks if the probe with the provided id was already received,
+// and if so passes a copy marked as a Duplicate, and received at rcvd, or
+// hwRcvd by the NIC, to the Port's cbc.
+func (p *Port) duplicate(id string, rcvd uint64, hwRcvd uint64) {
+	item := p.rcvd.Get(id)
+	if item == nil {
+		return
+	}
+	dup := *item.Value()
+	dup.CRcvd = rcvd
+	dup.hwRcvd = hwRcvd
+	dup.Duplicate = true
+	p.useHardware(&dup)
+	select {
+	case p.cbc <- &dup:
+	case <-p.ctx.Done():
+	}
+}
+
 // done receives entries in the cache that have expired and passes them to
 // the Port's cbc (callback channel)
 //
 // This basically just exists to the do the type conversion and pass to the
 // channel.
 func (p *Port) done(ctx context.Context, reason ttlcache.EvictionReason, item *ttlcache.Item[string, *InFlightProbe]) {
-	p.cbc <- item.Value()
+	probe := item.Value()
+	if p.tsMode.transmit() {
+		// Such as for a lost probe, which handle didn't apply it to
+		probe = p.applySent(item.Key(), probe)
+		p.useHardware(probe)
+	}
+	// ctx is done once unsubscribed, in which case this isn't wanted anyways
+	select {
+	case p.cbc <- probe:
+	case <-ctx.Done():
+	}
 }
 
 // InFlightProbe represents a single UDP probe that was sent from, and (hopefully)
@@ -221,7 +588,13 @@ type InFlightProbe struct {
 	CSent         uint64
 	CRcvd         uint64
 	ReflectorRcvd uint64
+	ReflectorSent uint64
 	Tos           byte
+	Seq           uint64 // Sequence number, per Port and destination
+	Duplicate     bool   // If this is an extra copy of an already received probe
+	txID          uint32 // Transmit timestamp ID, if enabled
+	hwSent        uint64 // Hardware transmit timestamp, if there was one
+	hwRcvd        uint64 // Hardware receive timestamp, if there was one
 }
 
 // PathDist -> Path Distinguisher, uniquely IDs the components that determine
@@ -234,68 +607,174 @@ type PathDist struct {
 	Proto   string // 'udp' generally
 }
 
-// Cleanup will close the connection and release the cache.
-// This would be triggered as a result of garbage collection, and would likely
-// be better suited elsewhere. However, this seems like a fairly simple option
-// for now, to avoid needing locks and conflicts between send/recv.
-func cleanup(port *Port) {
-	LogInfo("Started closing port on: " + port.conn.LocalAddr().String())
-	err := port.conn.Close()
+// goRun runs f in a goroutine that Stop waits for.
+func (p *Port) goRun(f func()) {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		f()
+	}()
+}
+
+// Stop stops sending and receiving, closes the conn, and waits for all of the
+// Port's goroutines to exit. Outstanding probes aren't reported as lost.
+//
+// The Port is also stopped if the context it was created with is done, but
+// only Stop waits for that to finish.
+func (p *Port) Stop() {
+	if p.cancel == nil {
+		return // Never started, so nothing to stop
+	}
+	p.cancel()
+	p.wg.Wait()
+}
+
+// cleanup waits for the Port to be stopped, then closes the connection and
+// releases the caches.
+//
+// Closing the conn is what gets recv to stop, rather than waiting on the
+// read deadline.
+func (p *Port) cleanup() {
+	<-p.ctx.Done()
+	LogInfo("Started closing port on: " + p.conn.LocalAddr().String())
+	err := p.conn.Close()
 	HandleMinorErrorMsg(err, "failed to close port")
-	// This might not actually be necessary, if we've already stopped
-	// using this whole thing. But doesn't hurt either.
-	port.cache = nil // Dereference the cache
-	LogInfo("Finished closing port on: " + port.conn.LocalAddr().String())
+	// Don't process expirations anymore
+	// This prevents outstanding probes from reporting as loss
+	p.unsubscribe()
+	LogInfo("Finished closing port on: " + p.conn.LocalAddr().String())
+}
+
+// runCache runs the automatic expiration of items in cache until ctx is done.
+func runCache[K comparable, V any](ctx context.Context,
+	cache *ttlcache.Cache[K, V]) {
+	done := make(chan struct{})
+	go func() {
+		cache.Start()
+		close(done)
+	}()
+	<-ctx.Done()
+	// Stop does nothing if Start hasn't gotten going yet, so keep at it
+	for {
+		cache.Stop()
+		select {
+		case <-done:
+			return
+		case <-time.After(time.Millisecond):
+		}
+	}
 }
 
 // New creates and returns a new Port with associated inputs, outputs,
 // and caching mechanisms.
-func NewPort(conn *net.UDPConn, tosend chan *net.UDPAddr, stop chan bool,
-	cbc chan *InFlightProbe, cTimeout time.Duration, cCleanRate time.Duration,
-	readTimeout time.Duration,
-) *Port {
+//
+// tsMode determines how send and receive timestamps are taken. SetupTimestamps
+// should already have been called on conn with the same mode, and with
+// transmit timestamps.
+//
+// errs receives any errors that stop the Port from sending or receiving after
+// it's running. It may be nil, in which case those are only logged.
+//
+// The Port owns conn from here on, and closes it once stopped, either by Stop
+// or ctx being done.
+func NewPort(ctx context.Context, conn *net.UDPConn, tosend chan *net.UDPAddr,
+	cbc chan *InFlightProbe, errs chan error, cTimeout time.Duration,
+	cCleanRate time.Duration, readTimeout time.Duration, tsMode TimestampMode,
+) (*Port, error) {
+	// Get everything that needs the socket before starting anything up
+	basePD, err := newSrcPD(conn)
+	if err != nil {
+		return nil, err
+	}
+	family, v6only, err := SocketFamily(conn)
+	if err != nil {
+		return nil, err
+	}
+	// Whatever it was set to before now, after this it's only via SetTos
+	tos, err := GetTos(conn)
+	if err != nil {
+		return nil, err
+	}
 	// Create the cache
 	cache := ttlcache.New[string, *InFlightProbe](
 		ttlcache.WithTTL[string, *InFlightProbe](cTimeout),
 	)
+	// Duplicates should arrive within the same window as the original
+	rcvd := ttlcache.New[string, *InFlightProbe](
+		ttlcache.WithTTL[string, *InFlightProbe](cTimeout),
+	)
 	// Create the port
-	port := Port{
-		tosend: tosend, conn: conn, cache: cache,
-		stop: stop, cbc: cbc, readTimeout: readTimeout,
+	ctx, cancel := context.WithCancel(ctx)
+	port := &Port{
+		tosend: tosend, conn: conn, cache: cache, rcvd: rcvd,
+		ctx: ctx, cancel: cancel, cbc: cbc, errs: errs,
+		readTimeout: readTimeout, basePD: basePD,
+		seqs: make(map[string]uint64), tsMode: tsMode,
+		txKeys: make(map[uint32]string),
+		txSent: make(map[string]txStamps),
+		family: family, v6only: v6only, unreachable: make(map[string]bool),
 	}
+	port.tos.Store(uint32(tos))
 	// Used for wrapping the callback channel
-	port.cache.OnEviction(port.done)
-	go cache.Start()
+	port.unsubscribe = port.cache.OnEviction(port.done)
+	port.goRun(func() { runCache(ctx, cache) })
+	port.goRun(func() { runCache(ctx, rcvd) })
 	// Ensure that when the port is stopped, we cleanup.
-	// This happens on GC, so it may be delayed for a bit.
-	runtime.SetFinalizer(&port, cleanup)
-	return &port
+	port.goRun(port.cleanup)
+	return port, nil
 }
 
 // NewDefault creates a new Port using default settings.
-func NewDefault(tosend chan *net.UDPAddr, stop chan bool,
-	cbc chan *InFlightProbe,
-) *Port {
+func NewDefault(ctx context.Context, tosend chan *net.UDPAddr,
+	cbc chan *InFlightProbe, errs chan error,
+) (port *Port, err error) {
 	// Create a default UDPConn
-	udpAddr, err := net.ResolveUDPAddr("udp", DefaultAddrStr)
-	HandleError(err)
-	udpConn, err := net.ListenUDP("udp", udpAddr)
-	HandleError(err)
+	udpAddr, err := net.ResolveUDPAddr(DefaultNetwork, DefaultAddrStr)
+	if err != nil {
+		return nil, err
+	}
+	udpConn, err := net.ListenUDP(DefaultNetwork, udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	// Once the Port is created, it owns the conn, and closes it when stopped
+	owned := false
+	defer func() {
+		if err != nil && !owned {
+			udpConn.Close()
+		}
+	}()
 	// These two are unnecessary, but being explicit
 	err = udpConn.SetReadBuffer(DefaultRcvBuff)
-	HandleError(err)
-	SetTos(udpConn, DefaultTos)
+	if err != nil {
+		return nil, err
+	}
+	err = SetupTimestamps(udpConn, DefaultTimestampMode, true)
+	if err != nil {
+		return nil, err
+	}
 	// TODO(nwinemiller): Update to allow no args, and setting later if desired.
-	port := NewPort(
+	port, err = NewPort(
+		ctx,
 		udpConn,
 		tosend,
-		stop,
 		cbc,
+		errs,
 		DefaultCacheTimeout,
 		DefaultCacheCleanRate,
 		DefaultReadTimeout,
+		DefaultTimestampMode,
 	)
-	return port
+	if err != nil {
+		return nil, err
+	}
+	owned = true
+	err = port.SetTos(DefaultTos)
+	if err != nil {
+		port.Stop()
+		return nil, err
+	}
+	return port, nil
 }
 
 // IfaceToInFlightProbe attempts to convert an anonymous object to a InFlightProbe, and returns
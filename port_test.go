@@ -1,6 +1,8 @@
 package udprobe
 
 import (
+	"context"
+	"errors"
 	"net"
 	"testing"
 	"time"
@@ -15,7 +17,6 @@ var exampleProbe = InFlightProbe{
 
 var exampleUDPAddr, _ = net.ResolveUDPAddr("udp", "127.0.0.1:0")
 var exampleUDPAddrChan = make(chan *net.UDPAddr)
-var exampleBoolChan = make(chan bool)
 var exampleProbeChan = make(chan *InFlightProbe)
 
 /*
@@ -30,7 +31,24 @@ func TestPd(t *testing.T) {
 }
 
 func TestTos(t *testing.T) {
-	// This really is just a helper for `GetTos` and doesn't need testing
+	udpAddr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+	conn, _ := net.ListenUDP("udp", udpAddr)
+	// Picks up whatever was already set
+	SetTos(conn, 0x20)
+	port, err := NewPort(context.Background(), conn, nil, nil, nil,
+		time.Second, time.Second, time.Second, TimestampUserspace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer port.Stop()
+	if port.Tos() != 0x20 {
+		t.Error("Existing ToS not cached. Got", port.Tos(), "expected", 0x20)
+	}
+	port.SetTos(0xb8)
+	if tos, _ := GetTos(conn); port.Tos() != 0xb8 || tos != 0xb8 {
+		t.Error("ToS not updated on port and socket. Got", port.Tos(), tos,
+			"expected", 0xb8)
+	}
 }
 
 func TestSend(t *testing.T) {
@@ -49,52 +67,93 @@ func TestDone(t *testing.T) {
 func TestNewPort(t *testing.T) {
 	// Just test creating one
 	conn, _ := net.ListenUDP("udp", exampleUDPAddr)
-	_ = NewPort(
+	port, err := NewPort(
+		context.Background(),
 		conn,
 		exampleUDPAddrChan,
-		exampleBoolChan,
 		exampleProbeChan,
+		nil,
 		time.Second,
 		3*time.Second,
 		200*time.Millisecond,
+		TimestampUserspace,
 	)
+	if err != nil {
+		t.Fatal("Failed to create port:", err)
+	}
+	port.Stop()
 }
 
 func TestNewDefault(t *testing.T) {
 	// Just test creating one
-	_ = NewDefault(
+	port, err := NewDefault(
+		context.Background(),
 		exampleUDPAddrChan,
-		exampleBoolChan,
 		exampleProbeChan,
+		nil,
 	)
+	if err != nil {
+		t.Fatal("Failed to create default port:", err)
+	}
+	port.Stop()
 }
 
 /*
    End Port tests
 */
 
+func TestPortReaches(t *testing.T) {
+	v4 := net.ParseIP("127.0.0.1")
+	v6 := net.ParseIP("::1")
+	cases := []struct {
+		network string
+		addr    string
+		v4, v6  bool
+	}{
+		{"udp4", "0.0.0.0:0", true, false},
+		{"udp6", "[::]:0", false, true},
+		{"udp", "0.0.0.0:0", true, true},
+		{"udp", "127.0.0.1:0", true, false},
+	}
+	for _, c := range cases {
+		udpAddr, _ := net.ResolveUDPAddr(c.network, c.addr)
+		conn, err := net.ListenUDP(c.network, udpAddr)
+		if err != nil {
+			t.Log("Skipping", c.network, c.addr, err)
+			continue
+		}
+		port, _ := NewPort(context.Background(), conn, nil, nil, nil,
+			time.Second, time.Second, time.Second, TimestampUserspace)
+		if port.reaches(v4) != c.v4 || port.reaches(v6) != c.v6 {
+			t.Error("Incorrect reachability for", c.network, c.addr, "Got",
+				port.reaches(v4), port.reaches(v6), "expected", c.v4, c.v6)
+		}
+		port.Stop()
+	}
+}
+
 func TestSendValidation(t *testing.T) {
 	tosend := make(chan *net.UDPAddr)
-	stop := make(chan bool)
 	cbc := make(chan *InFlightProbe)
 
 	// Create a default UDPConn
 	udpAddr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:0")
 	conn, _ := net.ListenUDP("udp", udpAddr)
-	defer conn.Close()
 
-	port := NewPort(
+	port, _ := NewPort(
+		context.Background(),
 		conn,
 		tosend,
-		stop,
 		cbc,
+		nil,
 		time.Second,
 		3*time.Second,
 		200*time.Millisecond,
+		TimestampUserspace,
 	)
 
-	go port.send()
-	defer func() { stop <- true }()
+	port.Send()
+	defer port.Stop()
 
 	// 1. Test nil IP
 	nilAddr := &net.UDPAddr{Port: 1234, IP: nil}
@@ -119,6 +178,192 @@ func TestSendValidation(t *testing.T) {
 	}
 }
 
+func TestSendSequence(t *testing.T) {
+	tosend := make(chan *net.UDPAddr)
+	udpAddr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+	conn, _ := net.ListenUDP("udp", udpAddr)
+	port, _ := NewPort(context.Background(), conn, tosend,
+		make(chan *InFlightProbe), nil, time.Second, 3*time.Second,
+		200*time.Millisecond, TimestampUserspace)
+	port.Send()
+	defer port.Stop()
+
+	dstA, _ := net.ResolveUDPAddr("udp", "127.0.0.1:1234")
+	dstB, _ := net.ResolveUDPAddr("udp", "127.0.0.1:1235")
+	tosend <- dstA
+	tosend <- dstA
+	tosend <- dstB
+	time.Sleep(50 * time.Millisecond)
+
+	// Each destination gets its own sequence
+	seqs := make(map[int][]uint64)
+	for _, item := range port.cache.Items() {
+		probe := item.Value()
+		seqs[probe.Pd.DstPort] = append(seqs[probe.Pd.DstPort], probe.Seq)
+	}
+	if len(seqs[1234]) != 2 || seqs[1234][0]+seqs[1234][1] != 3 {
+		t.Error("Expected sequence 1 and 2 for first destination, got", seqs[1234])
+	}
+	if len(seqs[1235]) != 1 || seqs[1235][0] != 1 {
+		t.Error("Expected sequence 1 for second destination, got", seqs[1235])
+	}
+}
+
+func TestSendPrunesTargets(t *testing.T) {
+	tosend := make(chan *net.UDPAddr)
+	udpAddr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:0")
+	conn, _ := net.ListenUDP("udp4", udpAddr)
+	port, _ := NewPort(context.Background(), conn, tosend,
+		make(chan *InFlightProbe), nil, time.Second, 3*time.Second,
+		200*time.Millisecond, TimestampUserspace)
+	port.Send()
+
+	dstA, _ := net.ResolveUDPAddr("udp", "127.0.0.1:1234")
+	dstB, _ := net.ResolveUDPAddr("udp", "127.0.0.1:1235")
+	dstV6, _ := net.ResolveUDPAddr("udp", "[::1]:1234")
+	tosend <- dstA
+	tosend <- dstB
+	tosend <- dstV6
+	// Only applied on the next send
+	port.SetTargets([]*net.UDPAddr{dstA})
+	tosend <- dstA
+	// Waits for send to exit, so its maps can be checked
+	port.Stop()
+
+	if len(port.seqs) != 1 || port.seqs[dstA.String()] != 2 {
+		t.Error("Expected only the sequence for the kept target. Got", port.seqs)
+	}
+	if len(port.unreachable) != 0 {
+		t.Error("Expected removed unreachable target to be forgotten. Got",
+			port.unreachable)
+	}
+}
+
+func TestRecvDuplicate(t *testing.T) {
+	tosend := make(chan *net.UDPAddr)
+	cbc := make(chan *InFlightProbe, 10)
+	udpAddr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+	conn, _ := net.ListenUDP("udp", udpAddr)
+	EnableTimestamps(conn)
+	port, _ := NewPort(context.Background(), conn, tosend, cbc, nil,
+		200*time.Millisecond, 3*time.Second, 20*time.Millisecond, TimestampKernel)
+	port.Send()
+	port.Recv()
+	defer port.Stop()
+
+	// A "reflector" that always sends back two copies
+	refConn, _ := net.ListenUDP("udp", udpAddr)
+	defer refConn.Close()
+	go func() {
+		buf := make([]byte, 4096)
+		refConn.SetReadDeadline(time.Now().Add(time.Second))
+		n, addr, err := refConn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		refConn.WriteToUDP(buf[:n], addr)
+		refConn.WriteToUDP(buf[:n], addr)
+	}()
+	tosend <- refConn.LocalAddr().(*net.UDPAddr)
+
+	var probes []*InFlightProbe
+	for len(probes) < 2 {
+		select {
+		case probe := <-cbc:
+			probes = append(probes, probe)
+		case <-time.After(2 * time.Second):
+			t.Fatal("Expected the probe and its duplicate, got", len(probes))
+		}
+	}
+	dups := 0
+	for _, probe := range probes {
+		if probe.CRcvd == 0 {
+			t.Error("Probe was reported as lost")
+		} else if probe.CRcvd < probe.CSent {
+			t.Error("Kernel receive time before send time. Got", probe.CRcvd,
+				"sent", probe.CSent)
+		}
+		if probe.Duplicate {
+			dups++
+		}
+	}
+	if dups != 1 {
+		t.Error("Expected exactly one duplicate, got", dups)
+	}
+}
+
+func TestRecvTxTimestamps(t *testing.T) {
+	tosend := make(chan *net.UDPAddr)
+	cbc := make(chan *InFlightProbe, 10)
+	udpAddr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+	conn, _ := net.ListenUDP("udp", udpAddr)
+	SetupTimestamps(conn, TimestampSoftware, true)
+	port, _ := NewPort(context.Background(), conn, tosend, cbc, nil,
+		200*time.Millisecond, 3*time.Second, 20*time.Millisecond,
+		TimestampSoftware)
+	port.Send()
+	port.Recv()
+	defer port.Stop()
+
+	// A "reflector" that sends back the probe untouched
+	refConn, _ := net.ListenUDP("udp", udpAddr)
+	defer refConn.Close()
+	go func() {
+		buf := make([]byte, 4096)
+		refConn.SetReadDeadline(time.Now().Add(time.Second))
+		n, addr, err := refConn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		refConn.WriteToUDP(buf[:n], addr)
+	}()
+	before := NowUint64()
+	tosend <- refConn.LocalAddr().(*net.UDPAddr)
+
+	select {
+	case probe := <-cbc:
+		if probe.CRcvd == 0 {
+			t.Fatal("Probe was reported as lost")
+		}
+		// The kernel stamps it after marshalling, so it's always later
+		if probe.CSent <= before || probe.CSent > probe.CRcvd {
+			t.Error("Send time wasn't from the kernel. Got", probe.CSent,
+				"expected between", before, "and", probe.CRcvd)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Probe never came back")
+	}
+	port.txMutex.Lock()
+	defer port.txMutex.Unlock()
+	if len(port.txKeys) != 0 {
+		t.Error("Transmit timestamp IDs left behind:", port.txKeys)
+	}
+	if len(port.txSent) != 0 {
+		t.Error("Transmit timestamps left behind:", port.txSent)
+	}
+}
+
+func TestRecvClosedConn(t *testing.T) {
+	udpAddr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+	conn, _ := net.ListenUDP("udp", udpAddr)
+	errs := make(chan error, 1)
+	port, _ := NewPort(context.Background(), conn, nil, nil, errs,
+		time.Second, time.Second, time.Second, TimestampUserspace)
+	port.Recv()
+	defer port.Stop()
+	// Closed out from under it, rather than by stopping
+	conn.Close()
+	// This should be reported, rather than exiting
+	select {
+	case err := <-errs:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Error("Unexpected error. Got", err, "expected", net.ErrClosed)
+		}
+	case <-time.After(time.Second):
+		t.Error("No error reported for the closed conn")
+	}
+}
+
 func TestIfaceToInFlightProbe(t *testing.T) {
 	// Convert the example
 	converted, err := IfaceToInFlightProbe(&exampleProbe)
@@ -135,3 +380,59 @@ func TestIfaceToInFlightProbe(t *testing.T) {
 		t.Error("Expected an error current conversion, but didn't get one")
 	}
 }
+
+func BenchmarkPortSend(b *testing.B) {
+	tosend := make(chan *net.UDPAddr)
+	udpAddr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+	conn, _ := net.ListenUDP("udp", udpAddr)
+	// Nothing reads from this, the kernel just drops what doesn't fit
+	sink, _ := net.ListenUDP("udp", udpAddr)
+	defer sink.Close()
+	dst := sink.LocalAddr().(*net.UDPAddr)
+	port, _ := NewPort(context.Background(), conn, tosend,
+		make(chan *InFlightProbe), nil, time.Minute, time.Minute,
+		200*time.Millisecond, TimestampUserspace)
+	port.Send()
+	defer port.Stop()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tosend <- dst
+	}
+}
+
+func TestUseHardware(t *testing.T) {
+	port := &Port{tsMode: TimestampHardware}
+	// Both sending and receiving have them, so they're used
+	probe := &InFlightProbe{CSent: 10, CRcvd: 20, hwSent: 1, hwRcvd: 3}
+	port.useHardware(probe)
+	if probe.CSent != 1 || probe.CRcvd != 3 {
+		t.Error("Hardware timestamps not used. Got", probe.CSent, probe.CRcvd)
+	}
+	// Only one of them, so neither is used
+	for _, probe := range []*InFlightProbe{
+		{CSent: 10, CRcvd: 20, hwSent: 1},
+		{CSent: 10, CRcvd: 20, hwRcvd: 3},
+	} {
+		port.useHardware(probe)
+		if probe.CSent != 10 || probe.CRcvd != 20 {
+			t.Error("Software timestamps mixed with hardware. Got", probe.CSent,
+				probe.CRcvd)
+		}
+	}
+	// Lost, so there's nothing to switch
+	probe = &InFlightProbe{CSent: 10, hwSent: 1}
+	port.useHardware(probe)
+	if probe.CSent != 10 {
+		t.Error("Lost probe changed. Got", probe.CSent)
+	}
+	// Only in the hardware mode
+	port.tsMode = TimestampSoftware
+	probe = &InFlightProbe{CSent: 10, CRcvd: 20, hwSent: 1, hwRcvd: 3}
+	port.useHardware(probe)
+	if probe.CSent != 10 || probe.CRcvd != 20 {
+		t.Error("Hardware timestamps used in the software mode. Got",
+			probe.CSent, probe.CRcvd)
+	}
+}
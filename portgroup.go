@@ -3,15 +3,21 @@
 package udprobe
 
 import (
+	"context"
+	"fmt"
 	"net"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
 type PortGroup struct {
 	ports   map[*Port](chan *net.UDPAddr)
-	stop    chan bool
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
 	cbc     chan *InFlightProbe
+	errs    chan error
 	tosend  chan *net.UDPAddr
 	running atomic.Bool
 }
@@ -27,45 +33,88 @@ func (pg *PortGroup) Add(p *Port, c chan *net.UDPAddr) {
 }
 
 // AddNew will create a new Port and add it to the PortGroup via Add.
-func (pg *PortGroup) AddNew(portStr string, tos byte, cTimeout time.Duration,
+//
+// The network is as used by net.ListenUDP, so "udp4" or "udp6" restrict the
+// Port to a single IP version. See Port.SetBatch for batch.
+//
+// If an error is returned, the socket is closed and nothing is added.
+func (pg *PortGroup) AddNew(network string, portStr string, tos byte,
+	cTimeout time.Duration,
 	cCleanRate time.Duration,
-	readTimeout time.Duration) (
-	*Port, chan *net.UDPAddr) {
+	readTimeout time.Duration,
+	tsMode TimestampMode,
+	batch int) (
+	*Port, chan *net.UDPAddr, error) {
 	/* Because of typing and how net works, it's just cleaner to pass in a
 	   string that identifies the addr/port Oddly enough, passing in a
 	   port number and net.IP object would involve more conversions.
 	*/
 	// Create the address/port we want
-	addr, err := net.ResolveUDPAddr("udp", portStr)
-	HandleError(err)
+	addr, err := net.ResolveUDPAddr(network, portStr)
+	if err != nil {
+		return nil, nil, err
+	}
 	// Grab that socket
-	conn, err := net.ListenUDP("udp", addr)
-	HandleError(err)
-	// Update the ToS value for the socket
-	SetTos(conn, tos)
-	// Tell the socket to keep timestamps
-	// TODO(nwinemiller): Not using this yet, but enabling anyways
-	EnableTimestamps(conn)
+	conn, err := net.ListenUDP(network, addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	// TODO(nwinemiller): May want to set a global/default buffer size for use here
+	input := make(chan *net.UDPAddr, 10)
+	p, err := pg.newPort(conn, input, tos, cTimeout, cCleanRate, readTimeout,
+		tsMode, batch)
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("failed to set up port %s: %w",
+			portStr, err)
+	}
+	// Add it to the port group
+	pg.Add(p, input)
+	return p, input, nil
+}
+
+// newPort sets up conn and creates a Port for it, for AddNew.
+func (pg *PortGroup) newPort(conn *net.UDPConn, input chan *net.UDPAddr,
+	tos byte, cTimeout time.Duration, cCleanRate time.Duration,
+	readTimeout time.Duration, tsMode TimestampMode, batch int,
+) (*Port, error) {
+	// Tell the socket to keep timestamps, if we're going to use them
+	err := SetupTimestamps(conn, tsMode, true)
+	if err != nil {
+		return nil, err
+	}
 	// Increase the buffer size, since the default doesn't scale
 	// TODO(nwinemiller): This should be configurable higher up, as well want to be
 	//             able to tweak this behavior more easily in the config.
 	err = conn.SetReadBuffer(DefaultRcvBuff)
-	HandleError(err)
-	// TODO(nwinemiller): May want to set a global/default buffer size for use here
-	input := make(chan *net.UDPAddr, 10)
+	if err != nil {
+		return nil, err
+	}
 	// Create the port
-	p := NewPort(
+	p, err := NewPort(
+		pg.ctx,
 		conn,
 		input,
-		pg.stop,
 		pg.cbc,
+		pg.errs,
 		cTimeout,
 		cCleanRate,
 		readTimeout,
+		tsMode,
 	)
-	// Add it to the port group
-	pg.Add(p, input)
-	return p, input
+	if err != nil {
+		return nil, err
+	}
+	// Update the ToS value for the socket
+	err = p.SetTos(tos)
+	if err == nil {
+		err = p.SetBatch(batch)
+	}
+	if err != nil {
+		p.Stop()
+		return nil, err
+	}
+	return p, nil
 }
 
 // Del removes a Port from the PortGroup.
@@ -94,15 +143,18 @@ func (pg *PortGroup) Run() {
 		p.Send()
 	}
 	// Start the muxer itself
-	go pg.run()
+	pg.wg.Add(1)
+	go func() {
+		defer pg.wg.Done()
+		pg.run()
+	}()
 }
 
 func (pg *PortGroup) run() {
 	for {
 		select {
-		case <-pg.stop:
+		case <-pg.ctx.Done():
 			LogInfo("Stopping PortGroup")
-			pg.ports = nil
 			return // Stop sending and burn it all down
 		case addr := <-pg.tosend:
 			pg.mux(addr)
@@ -120,31 +172,49 @@ func (pg *PortGroup) mux(addr *net.UDPAddr) {
 		// TODO(nwinemiller): Update this with a select and default in the future
 		//     if we want to track cases where something breaks here.
 		//     Tried it before, but apparently hit some weird issues.
-		c <- addr
-		continue
+		select {
+		case c <- addr:
+		case <-pg.ctx.Done():
+			return
+		}
 	}
 }
 
-// Stop will signal all muxing to cease (if started) and stop all Ports.
+// SetTargets passes the targets to each of the Ports, so they can forget
+// about the destinations that were removed. See Port.SetTargets.
+func (pg *PortGroup) SetTargets(targets []*net.UDPAddr) {
+	for p := range pg.ports {
+		p.SetTargets(targets)
+	}
+}
+
+// Stop will signal all muxing to cease (if started) and stop all Ports,
+// waiting until they've all exited and closed their sockets.
 func (pg *PortGroup) Stop() {
-	// Generally, this would be done higher up, but might as well have a call
-	// here too for convenience.
-	close(pg.stop)
+	pg.cancel()
+	pg.wg.Wait()
+	for p := range pg.ports {
+		p.Stop()
+	}
 }
 
 // New creates a new PortGroup utilizing a set of input, output, and
 // signalling channels.
 //
-// stop is used to signal stopping of the PortGroup and all ports.
+// ctx being done stops the PortGroup and all ports, the same as Stop.
 // cbc is used as a callback for completed or timedout probes from all ports.
+// errs is used for reporting errors that stop any of the ports.
 // tosend is used to receive UDPAddr targets for sending to probes, and is
 // muxed across all Ports in the PortGroup.
-func NewPortGroup(stop chan bool, cbc chan *InFlightProbe,
-	tosend chan *net.UDPAddr) *PortGroup {
+func NewPortGroup(ctx context.Context, cbc chan *InFlightProbe,
+	errs chan error, tosend chan *net.UDPAddr) *PortGroup {
+	ctx, cancel := context.WithCancel(ctx)
 	pg := PortGroup{
 		ports:  make(map[*Port](chan *net.UDPAddr)),
-		stop:   stop,
+		ctx:    ctx,
+		cancel: cancel,
 		cbc:    cbc,
+		errs:   errs,
 		tosend: tosend,
 	}
 	return &pg
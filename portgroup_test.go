@@ -1,17 +1,18 @@
 package udprobe
 
 import (
+	"context"
+	"errors"
 	"net"
 	"testing"
 )
 
-var stopChan = make(chan bool)
 var cbChan = make(chan *InFlightProbe)
 var sendChan = make(chan *net.UDPAddr)
 
 func TestNewPortGroup(t *testing.T) {
 	// Create a new one
-	pg := NewPortGroup(stopChan, cbChan, sendChan)
+	pg := NewPortGroup(context.Background(), cbChan, nil, sendChan)
 	if pg == nil {
 		t.Error("New didn't return a PortGroup")
 	}
@@ -19,7 +20,7 @@ func TestNewPortGroup(t *testing.T) {
 }
 
 func TestAdd(t *testing.T) {
-	pg := NewPortGroup(stopChan, cbChan, sendChan)
+	pg := NewPortGroup(context.Background(), cbChan, nil, sendChan)
 	// Create the port and chan
 	p := Port{}
 	c := make(chan *net.UDPAddr)
@@ -32,19 +33,36 @@ func TestAdd(t *testing.T) {
 }
 
 func TestAddNew(t *testing.T) {
-	pg := NewPortGroup(stopChan, cbChan, sendChan)
+	pg := NewPortGroup(context.Background(), cbChan, nil, sendChan)
 	// Add a new port
-	p, c := pg.AddNew(DefaultAddrStr, DefaultTos,
+	p, c, err := pg.AddNew(DefaultNetwork, DefaultAddrStr, DefaultTos,
 		DefaultCacheTimeout, DefaultCacheCleanRate,
-		DefaultReadTimeout)
+		DefaultReadTimeout, DefaultTimestampMode, 1)
+	if err != nil {
+		t.Fatal("Failed to add new port:", err)
+	}
 	// Make sure it's in the PortGroup
 	if pg.ports[p] != c {
 		t.Error("New port/channel was not added correctly")
 	}
 }
 
+func TestAddNewError(t *testing.T) {
+	pg := NewPortGroup(context.Background(), cbChan, nil, sendChan)
+	// Not an address that can be resolved
+	_, _, err := pg.AddNew(DefaultNetwork, "not-an-addr", DefaultTos,
+		DefaultCacheTimeout, DefaultCacheCleanRate,
+		DefaultReadTimeout, DefaultTimestampMode, 1)
+	if err == nil {
+		t.Error("Expected an error for an invalid address")
+	}
+	if len(pg.ports) != 0 {
+		t.Error("Port added despite an error. Got", len(pg.ports), "expected", 0)
+	}
+}
+
 func TestDel(t *testing.T) {
-	pg := NewPortGroup(stopChan, cbChan, sendChan)
+	pg := NewPortGroup(context.Background(), cbChan, nil, sendChan)
 	// Create the port and chan
 	p := Port{}
 	c := make(chan *net.UDPAddr)
@@ -63,7 +81,7 @@ func TestPortGroupRun(t *testing.T) {
 }
 
 func TestMux(t *testing.T) {
-	pg := NewPortGroup(stopChan, cbChan, sendChan)
+	pg := NewPortGroup(context.Background(), cbChan, nil, sendChan)
 	// Create the port and chan
 	p1 := Port{}
 	p2 := Port{}
@@ -101,18 +119,34 @@ func TestMux(t *testing.T) {
 }
 
 func TestPortGroupStop(t *testing.T) {
-	pg := NewPortGroup(stopChan, cbChan, sendChan)
+	pg := NewPortGroup(context.Background(), cbChan, nil, sendChan)
 	pg.Stop()
-	// Make sure stop actually closes it
-	select {
-	case <-stopChan:
-	default:
-		t.Error("Channel wasn't closed after calling Stop")
+	// Make sure stop actually cancels it
+	if pg.ctx.Err() == nil {
+		t.Error("Context wasn't cancelled after calling Stop")
+	}
+}
+
+func TestPortGroupStopClosesPorts(t *testing.T) {
+	pg := NewPortGroup(context.Background(), cbChan, nil, sendChan)
+	p, _, err := pg.AddNew(DefaultNetwork, "127.0.0.1:0", DefaultTos,
+		DefaultCacheTimeout, DefaultCacheCleanRate,
+		DefaultReadTimeout, DefaultTimestampMode, 1)
+	if err != nil {
+		t.Fatal("Failed to add new port:", err)
+	}
+	pg.Run()
+	pg.Stop()
+	// The socket should be closed by the time Stop returns
+	_, err = p.conn.WriteToUDP([]byte("x"), p.conn.LocalAddr().(*net.UDPAddr))
+	if !errors.Is(err, net.ErrClosed) {
+		t.Error("Port conn not closed after Stop. Got", err, "expected",
+			net.ErrClosed)
 	}
 }
 
 func TestAddAfterRunPanics(t *testing.T) {
-	pg := NewPortGroup(stopChan, cbChan, sendChan)
+	pg := NewPortGroup(context.Background(), cbChan, nil, sendChan)
 	pg.running.Store(true)
 	defer func() {
 		if r := recover(); r == nil {
@@ -123,7 +157,7 @@ func TestAddAfterRunPanics(t *testing.T) {
 }
 
 func TestDelAfterRunPanics(t *testing.T) {
-	pg := NewPortGroup(stopChan, cbChan, sendChan)
+	pg := NewPortGroup(context.Background(), cbChan, nil, sendChan)
 	pg.running.Store(true)
 	defer func() {
 		if r := recover(); r == nil {
@@ -2,6 +2,7 @@ package udprobe
 
 import (
 	"fmt"
+	"strconv"
 	"sync"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -11,6 +12,14 @@ var (
 	// Labels we want to include in our metrics. Update if we want to add extra tags / labels.
 	udprobeLabels = []string{"src_ip", "dst_ip", "src_hostname", "dst_hostname", "tos"}
 
+	// Probes that fell back to software timestamps in the hardware mode
+	udprobeTimestampFallbacks = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "udprobe_hardware_timestamp_fallbacks_total",
+			Help: "Received probes without hardware timestamps for both sending and receiving, which used software ones instead.",
+		},
+	)
+
 	// Packet Loss Percentage
 	udprobePacketLoss = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
@@ -47,6 +56,121 @@ var (
 		udprobeLabels,
 	)
 
+	// RFC 3550 interarrival jitter
+	udprobeJitter = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "udprobe_jitter",
+			Help: "RFC 3550 interarrival jitter of RTT for packets sent during a given measurement period.",
+		},
+		udprobeLabels,
+	)
+
+	// Mean IP packet delay variation
+	udprobeIPDVMean = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "udprobe_ipdv_mean",
+			Help: "Mean absolute RTT difference between consecutive packets during a given measurement period.",
+		},
+		udprobeLabels,
+	)
+
+	// Max IP packet delay variation
+	udprobeIPDVMax = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "udprobe_ipdv_max",
+			Help: "Max absolute RTT difference between consecutive packets during a given measurement period.",
+		},
+		udprobeLabels,
+	)
+
+	// Packets received after one with a higher sequence number
+	udprobePacketsReordered = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "udprobe_packets_reordered",
+			Help: "Number of packets received out of order for a given measurement period.",
+		},
+		udprobeLabels,
+	)
+
+	// Largest sequence displacement of a reordered packet
+	udprobeReorderExtent = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "udprobe_reorder_extent",
+			Help: "Largest sequence number displacement of a reordered packet for a given measurement period.",
+		},
+		udprobeLabels,
+	)
+
+	// Extra copies of packets that were already received
+	udprobePacketsDuplicated = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "udprobe_packets_duplicated",
+			Help: "Number of duplicate packets received for a given measurement period.",
+		},
+		udprobeLabels,
+	)
+
+	// One-way delays, which rely on the collector and reflector clocks agreeing
+	udprobeForwardDelay = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "udprobe_forward_delay",
+			Help: "Average collector to reflector delay for a given measurement period. Corrected by the estimated clock offset.",
+		},
+		udprobeLabels,
+	)
+
+	udprobeReverseDelay = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "udprobe_reverse_delay",
+			Help: "Average reflector to collector delay for a given measurement period. Corrected by the estimated clock offset.",
+		},
+		udprobeLabels,
+	)
+
+	// Time spent in the reflector
+	udprobeReflectorDwell = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "udprobe_reflector_dwell",
+			Help: "Average time between the reflector receiving and sending packets for a given measurement period.",
+		},
+		udprobeLabels,
+	)
+
+	// Estimated clock offset of the reflector from the collector
+	udprobeClockOffset = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "udprobe_clock_offset",
+			Help: "Estimated offset of the reflector clock from the collector clock.",
+		},
+		udprobeLabels,
+	)
+
+	udprobeClockOffsetUncertainty = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "udprobe_clock_offset_uncertainty",
+			Help: "Bound on the error of the estimated reflector clock offset.",
+		},
+		udprobeLabels,
+	)
+
+	// RTT at configured percentiles
+	udprobeRTTPercentile = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "udprobe_rtt_percentile",
+			Help: "RTT at the given percentile for packets sent during a given measurement period.",
+		},
+		append(udprobeLabels, "percentile"),
+	)
+
+	// Cumulative RTT distribution
+	udprobeRTTHistogram = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "udprobe_rtt_histogram",
+			Help: "Number of packets with an RTT less than or equal to le during a given measurement period.",
+		},
+		append(udprobeLabels, "le"),
+	)
+
 	registerOnce sync.Once
 )
 
@@ -56,6 +180,19 @@ type MetricSetter interface {
 	SetPacketsSent(labels map[string]string, value float64)
 	SetPacketsLost(labels map[string]string, value float64)
 	SetRTT(labels map[string]string, value float64)
+	SetJitter(labels map[string]string, value float64)
+	SetIPDVMean(labels map[string]string, value float64)
+	SetIPDVMax(labels map[string]string, value float64)
+	SetPacketsReordered(labels map[string]string, value float64)
+	SetReorderExtent(labels map[string]string, value float64)
+	SetPacketsDuplicated(labels map[string]string, value float64)
+	SetForwardDelay(labels map[string]string, value float64)
+	SetReverseDelay(labels map[string]string, value float64)
+	SetReflectorDwell(labels map[string]string, value float64)
+	SetClockOffset(labels map[string]string, value float64)
+	SetClockOffsetUncertainty(labels map[string]string, value float64)
+	SetRTTPercentile(labels map[string]string, value float64)
+	SetRTTHistogram(labels map[string]string, value float64)
 }
 
 type PrometheusMetricSetter struct{}
@@ -76,6 +213,58 @@ func (p *PrometheusMetricSetter) SetRTT(labels map[string]string, value float64)
 	udprobeRTT.With(labels).Set(value)
 }
 
+func (p *PrometheusMetricSetter) SetJitter(labels map[string]string, value float64) {
+	udprobeJitter.With(labels).Set(value)
+}
+
+func (p *PrometheusMetricSetter) SetIPDVMean(labels map[string]string, value float64) {
+	udprobeIPDVMean.With(labels).Set(value)
+}
+
+func (p *PrometheusMetricSetter) SetIPDVMax(labels map[string]string, value float64) {
+	udprobeIPDVMax.With(labels).Set(value)
+}
+
+func (p *PrometheusMetricSetter) SetPacketsReordered(labels map[string]string, value float64) {
+	udprobePacketsReordered.With(labels).Set(value)
+}
+
+func (p *PrometheusMetricSetter) SetReorderExtent(labels map[string]string, value float64) {
+	udprobeReorderExtent.With(labels).Set(value)
+}
+
+func (p *PrometheusMetricSetter) SetPacketsDuplicated(labels map[string]string, value float64) {
+	udprobePacketsDuplicated.With(labels).Set(value)
+}
+
+func (p *PrometheusMetricSetter) SetForwardDelay(labels map[string]string, value float64) {
+	udprobeForwardDelay.With(labels).Set(value)
+}
+
+func (p *PrometheusMetricSetter) SetReverseDelay(labels map[string]string, value float64) {
+	udprobeReverseDelay.With(labels).Set(value)
+}
+
+func (p *PrometheusMetricSetter) SetReflectorDwell(labels map[string]string, value float64) {
+	udprobeReflectorDwell.With(labels).Set(value)
+}
+
+func (p *PrometheusMetricSetter) SetClockOffset(labels map[string]string, value float64) {
+	udprobeClockOffset.With(labels).Set(value)
+}
+
+func (p *PrometheusMetricSetter) SetClockOffsetUncertainty(labels map[string]string, value float64) {
+	udprobeClockOffsetUncertainty.With(labels).Set(value)
+}
+
+func (p *PrometheusMetricSetter) SetRTTPercentile(labels map[string]string, value float64) {
+	udprobeRTTPercentile.With(labels).Set(value)
+}
+
+func (p *PrometheusMetricSetter) SetRTTHistogram(labels map[string]string, value float64) {
+	udprobeRTTHistogram.With(labels).Set(value)
+}
+
 // EmitMetricsFromSummaries updates the Prometheus metrics based on the summaries with the necessary tags
 func EmitMetricsFromSummaries(summaries []*Summary, t TagSet, setter MetricSetter) {
 	for _, summary := range summaries {
@@ -91,11 +280,53 @@ func EmitMetricsFromSummaries(summaries []*Summary, t TagSet, setter MetricSette
 		setter.SetPacketsSent(labels, float64(summary.Sent))
 		setter.SetPacketsLost(labels, float64(summary.Lost))
 		setter.SetRTT(labels, summary.RTTAvg)
+		setter.SetJitter(labels, summary.Jitter)
+		setter.SetIPDVMean(labels, summary.IPDVMean)
+		setter.SetIPDVMax(labels, summary.IPDVMax)
+		setter.SetPacketsReordered(labels, float64(summary.Reordered))
+		setter.SetReorderExtent(labels, float64(summary.ReorderExtent))
+		setter.SetPacketsDuplicated(labels, float64(summary.Duplicates))
+		setter.SetForwardDelay(labels, summary.FwdDelayAvg)
+		setter.SetReverseDelay(labels, summary.RevDelayAvg)
+		setter.SetReflectorDwell(labels, summary.DwellAvg)
+		setter.SetClockOffset(labels, summary.ClockOffset)
+		setter.SetClockOffsetUncertainty(labels, summary.ClockOffsetErr)
+		for _, p := range summary.RTTPercentiles {
+			setter.SetRTTPercentile(withLabel(labels, "percentile", formatFloatLabel(p.P)), p.Value)
+		}
+		for _, b := range summary.RTTHistogram {
+			setter.SetRTTHistogram(withLabel(labels, "le", formatFloatLabel(b.Le)), float64(b.Count))
+		}
+		if len(summary.RTTHistogram) > 0 {
+			// Everything that completed fits in the implicit +Inf bucket
+			setter.SetRTTHistogram(withLabel(labels, "le", "+Inf"), float64(summary.Sent-summary.Lost))
+		}
+	}
+}
+
+// withLabel returns a copy of labels with the additional label set.
+func withLabel(labels prometheus.Labels, name string, value string) prometheus.Labels {
+	l := make(prometheus.Labels, len(labels)+1)
+	for k, v := range labels {
+		l[k] = v
 	}
+	l[name] = value
+	return l
+}
+
+// formatFloatLabel formats a float label value in its shortest form (99.9, not
+// 99.900000).
+func formatFloatLabel(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
 }
 
 func RegisterPrometheus() {
 	registerOnce.Do(func() {
-		prometheus.MustRegister(udprobePacketLoss, udprobePacketsSent, udprobePacketsLost, udprobeRTT)
+		prometheus.MustRegister(udprobePacketLoss, udprobePacketsSent, udprobePacketsLost, udprobeRTT,
+			udprobeJitter, udprobeIPDVMean, udprobeIPDVMax,
+			udprobePacketsReordered, udprobeReorderExtent, udprobePacketsDuplicated,
+			udprobeForwardDelay, udprobeReverseDelay, udprobeReflectorDwell,
+			udprobeClockOffset, udprobeClockOffsetUncertainty,
+			udprobeRTTPercentile, udprobeRTTHistogram, udprobeTimestampFallbacks)
 	})
 }
@@ -42,6 +42,98 @@ func (m *MockMetricSetter) SetRTT(labels map[string]string, value float64) {
 	}{"RTT", labels, value})
 }
 
+func (m *MockMetricSetter) SetJitter(labels map[string]string, value float64) {
+	m.CalledWith = append(m.CalledWith, struct {
+		Metric string
+		Labels map[string]string
+		Value  float64
+	}{"Jitter", labels, value})
+}
+func (m *MockMetricSetter) SetIPDVMean(labels map[string]string, value float64) {
+	m.CalledWith = append(m.CalledWith, struct {
+		Metric string
+		Labels map[string]string
+		Value  float64
+	}{"IPDVMean", labels, value})
+}
+func (m *MockMetricSetter) SetIPDVMax(labels map[string]string, value float64) {
+	m.CalledWith = append(m.CalledWith, struct {
+		Metric string
+		Labels map[string]string
+		Value  float64
+	}{"IPDVMax", labels, value})
+}
+func (m *MockMetricSetter) SetPacketsReordered(labels map[string]string, value float64) {
+	m.CalledWith = append(m.CalledWith, struct {
+		Metric string
+		Labels map[string]string
+		Value  float64
+	}{"PacketsReordered", labels, value})
+}
+func (m *MockMetricSetter) SetReorderExtent(labels map[string]string, value float64) {
+	m.CalledWith = append(m.CalledWith, struct {
+		Metric string
+		Labels map[string]string
+		Value  float64
+	}{"ReorderExtent", labels, value})
+}
+func (m *MockMetricSetter) SetPacketsDuplicated(labels map[string]string, value float64) {
+	m.CalledWith = append(m.CalledWith, struct {
+		Metric string
+		Labels map[string]string
+		Value  float64
+	}{"PacketsDuplicated", labels, value})
+}
+func (m *MockMetricSetter) SetForwardDelay(labels map[string]string, value float64) {
+	m.CalledWith = append(m.CalledWith, struct {
+		Metric string
+		Labels map[string]string
+		Value  float64
+	}{"ForwardDelay", labels, value})
+}
+func (m *MockMetricSetter) SetReverseDelay(labels map[string]string, value float64) {
+	m.CalledWith = append(m.CalledWith, struct {
+		Metric string
+		Labels map[string]string
+		Value  float64
+	}{"ReverseDelay", labels, value})
+}
+func (m *MockMetricSetter) SetReflectorDwell(labels map[string]string, value float64) {
+	m.CalledWith = append(m.CalledWith, struct {
+		Metric string
+		Labels map[string]string
+		Value  float64
+	}{"ReflectorDwell", labels, value})
+}
+func (m *MockMetricSetter) SetClockOffset(labels map[string]string, value float64) {
+	m.CalledWith = append(m.CalledWith, struct {
+		Metric string
+		Labels map[string]string
+		Value  float64
+	}{"ClockOffset", labels, value})
+}
+func (m *MockMetricSetter) SetClockOffsetUncertainty(labels map[string]string, value float64) {
+	m.CalledWith = append(m.CalledWith, struct {
+		Metric string
+		Labels map[string]string
+		Value  float64
+	}{"ClockOffsetUncertainty", labels, value})
+}
+func (m *MockMetricSetter) SetRTTPercentile(labels map[string]string, value float64) {
+	m.CalledWith = append(m.CalledWith, struct {
+		Metric string
+		Labels map[string]string
+		Value  float64
+	}{"RTTPercentile", labels, value})
+}
+func (m *MockMetricSetter) SetRTTHistogram(labels map[string]string, value float64) {
+	m.CalledWith = append(m.CalledWith, struct {
+		Metric string
+		Labels map[string]string
+		Value  float64
+	}{"RTTHistogram", labels, value})
+}
+
 func TestEmitMetricsFromSummary(t *testing.T) {
 	m := &MockMetricSetter{}
 
@@ -51,11 +143,22 @@ func TestEmitMetricsFromSummary(t *testing.T) {
 	}
 
 	mockSummary := &Summary{
-		Pd:     mockPD,
-		Loss:   10.0,
-		Sent:   100,
-		Lost:   10,
-		RTTAvg: 10.5,
+		Pd:             mockPD,
+		Loss:           10.0,
+		Sent:           100,
+		Lost:           10,
+		RTTAvg:         10.5,
+		Jitter:         1.25,
+		IPDVMean:       2.5,
+		IPDVMax:        4.0,
+		Reordered:      3,
+		ReorderExtent:  2,
+		Duplicates:     1,
+		FwdDelayAvg:    4.5,
+		RevDelayAvg:    5.5,
+		DwellAvg:       0.5,
+		ClockOffset:    -1.5,
+		ClockOffsetErr: 0.25,
 	}
 
 	mockTagSet := TagSet{
@@ -83,6 +186,17 @@ func TestEmitMetricsFromSummary(t *testing.T) {
 		{"PacketsSent", float64(100)},
 		{"PacketsLost", float64(10)},
 		{"RTT", 10.5},
+		{"Jitter", 1.25},
+		{"IPDVMean", 2.5},
+		{"IPDVMax", 4.0},
+		{"PacketsReordered", 3},
+		{"ReorderExtent", 2},
+		{"PacketsDuplicated", 1},
+		{"ForwardDelay", 4.5},
+		{"ReverseDelay", 5.5},
+		{"ReflectorDwell", 0.5},
+		{"ClockOffset", -1.5},
+		{"ClockOffsetUncertainty", 0.25},
 	}
 
 	for i, expectedCall := range expected {
@@ -106,6 +220,60 @@ func TestEmitMetricsFromSummary(t *testing.T) {
 	}
 }
 
+func TestEmitDistributionMetricsFromSummary(t *testing.T) {
+	m := &MockMetricSetter{}
+	mockSummary := &Summary{
+		Pd: &PathDist{
+			SrcIP: net.ParseIP("1.1.1.1"),
+			DstIP: net.ParseIP("2.2.2.2"),
+		},
+		Sent:           10,
+		Lost:           2,
+		RTTPercentiles: []Percentile{{P: 50, Value: 1.5}, {P: 99.9, Value: 7.25}},
+		RTTHistogram:   []HistogramBucket{{Le: 1, Count: 3}, {Le: 2.5, Count: 6}},
+	}
+
+	EmitMetricsFromSummaries([]*Summary{mockSummary}, TagSet{}, m)
+
+	expected := []struct {
+		Metric string
+		Label  string
+		LValue string
+		Value  float64
+	}{
+		{"RTTPercentile", "percentile", "50", 1.5},
+		{"RTTPercentile", "percentile", "99.9", 7.25},
+		{"RTTHistogram", "le", "1", 3},
+		{"RTTHistogram", "le", "2.5", 6},
+		{"RTTHistogram", "le", "+Inf", 8},
+	}
+	// Only look at the distribution metrics, the rest are covered above
+	var calls []struct {
+		Metric string
+		Labels map[string]string
+		Value  float64
+	}
+	for _, c := range m.CalledWith {
+		if c.Metric == "RTTPercentile" || c.Metric == "RTTHistogram" {
+			calls = append(calls, c)
+		}
+	}
+	if len(calls) != len(expected) {
+		t.Fatalf("Expected %d distribution calls, got %d", len(expected), len(calls))
+	}
+	for i, e := range expected {
+		if calls[i].Metric != e.Metric || calls[i].Value != e.Value {
+			t.Errorf("Call %d: expected %s=%f, got %s=%f", i, e.Metric, e.Value, calls[i].Metric, calls[i].Value)
+		}
+		if calls[i].Labels[e.Label] != e.LValue {
+			t.Errorf("Call %d: expected label %s=%q, got %q", i, e.Label, e.LValue, calls[i].Labels[e.Label])
+		}
+		if calls[i].Labels["dst_ip"] != "2.2.2.2" {
+			t.Errorf("Call %d: base labels missing, got %v", i, calls[i].Labels)
+		}
+	}
+}
+
 // mapsEqual is a helper function to compare string maps for deep equality
 func mapsEqual(a, b map[string]string) bool {
 	if len(a) != len(b) {
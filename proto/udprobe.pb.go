@@ -30,6 +30,8 @@ type Probe struct {
 	Rtt           uint64                 `protobuf:"varint,5,opt,name=rtt,proto3" json:"rtt,omitempty"`
 	Lost          bool                   `protobuf:"varint,6,opt,name=lost,proto3" json:"lost,omitempty"`
 	Padding       []byte                 `protobuf:"bytes,7,opt,name=padding,proto3" json:"padding,omitempty"`
+	Seq           uint64                 `protobuf:"varint,8,opt,name=seq,proto3" json:"seq,omitempty"`
+	ReflectorSent uint64                 `protobuf:"varint,9,opt,name=reflector_sent,json=reflectorSent,proto3" json:"reflector_sent,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -113,11 +115,25 @@ func (x *Probe) GetPadding() []byte {
 	return nil
 }
 
+func (x *Probe) GetSeq() uint64 {
+	if x != nil {
+		return x.Seq
+	}
+	return 0
+}
+
+func (x *Probe) GetReflectorSent() uint64 {
+	if x != nil {
+		return x.ReflectorSent
+	}
+	return 0
+}
+
 var File_proto_udprobe_proto protoreflect.FileDescriptor
 
 const file_proto_udprobe_proto_rawDesc = "" +
 	"\n" +
-	"\x13proto/udprobe.proto\x12\x05proto\"\x9f\x01\n" +
+	"\x13proto/udprobe.proto\x12\x05proto\"\xd8\x01\n" +
 	"\x05Probe\x12\x1c\n" +
 	"\tsignature\x18\x01 \x01(\fR\tsignature\x12\x10\n" +
 	"\x03tos\x18\x02 \x01(\rR\x03tos\x12\x12\n" +
@@ -125,7 +141,9 @@ const file_proto_udprobe_proto_rawDesc = "" +
 	"\x04rcvd\x18\x04 \x01(\x04R\x04rcvd\x12\x10\n" +
 	"\x03rtt\x18\x05 \x01(\x04R\x03rtt\x12\x12\n" +
 	"\x04lost\x18\x06 \x01(\bR\x04lost\x12\x18\n" +
-	"\apadding\x18\a \x01(\fR\apaddingB\"Z github.com/nsw3550/udprobe/protob\x06proto3"
+	"\apadding\x18\a \x01(\fR\apadding\x12\x10\n" +
+	"\x03seq\x18\b \x01(\x04R\x03seq\x12%\n" +
+	"\x0ereflector_sent\x18\t \x01(\x04R\rreflectorSentB\"Z github.com/nsw3550/udprobe/protob\x06proto3"
 
 var (
 	file_proto_udprobe_proto_rawDescOnce sync.Once
@@ -0,0 +1,343 @@
+package udprobe
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The size and version of each Result in the binary format.
+const (
+	RawRecordSize    = 96
+	RawRecordVersion = 1
+)
+
+// Flags of a Result in the binary format.
+const (
+	RawFlagLost      = 1 << 0
+	RawFlagDuplicate = 1 << 1
+	RawFlagOneWay    = 1 << 2
+)
+
+// AppendRawResult appends the result to buf in the binary format, and returns
+// the result. Each is a fixed RawRecordSize bytes, with integers in network
+// byte order:
+//
+//	0:  version (RawRecordVersion)
+//	1:  flags (RawFlagLost, RawFlagDuplicate, RawFlagOneWay)
+//	2:  tos
+//	3:  reserved
+//	4:  source port (uint16)
+//	6:  destination port (uint16)
+//	8:  sequence number (uint64)
+//	16: sent time in ns since the epoch (uint64)
+//	24: received time in ns since the epoch, 0 if lost (uint64)
+//	32: RTT in ns (uint64)
+//	40: forward delay in ns (int64)
+//	48: reverse delay in ns (int64)
+//	56: dwell in ns (uint64)
+//	64: source IP, as 16 bytes with IPv4 mapped to IPv6
+//	80: destination IP, the same
+//
+// The protocol isn't included, as it's always UDP.
+func AppendRawResult(buf []byte, result *Result) []byte {
+	var flags byte
+	if result.Lost {
+		flags |= RawFlagLost
+	}
+	if result.Duplicate {
+		flags |= RawFlagDuplicate
+	}
+	if result.OneWay {
+		flags |= RawFlagOneWay
+	}
+	buf = append(buf, RawRecordVersion, flags, result.Tos, 0)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(result.Pd.SrcPort))
+	buf = binary.BigEndian.AppendUint16(buf, uint16(result.Pd.DstPort))
+	buf = binary.BigEndian.AppendUint64(buf, result.Seq)
+	buf = binary.BigEndian.AppendUint64(buf, result.Sent)
+	buf = binary.BigEndian.AppendUint64(buf, result.Done)
+	buf = binary.BigEndian.AppendUint64(buf, result.RTT)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(result.FwdDelay))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(result.RevDelay))
+	buf = binary.BigEndian.AppendUint64(buf, result.Dwell)
+	buf = appendIP16(buf, result.Pd.SrcIP)
+	return appendIP16(buf, result.Pd.DstIP)
+}
+
+// appendIP16 appends the ip as 16 bytes, or all zeros if it isn't valid.
+func appendIP16(buf []byte, ip net.IP) []byte {
+	if ip16 := ip.To16(); ip16 != nil {
+		return append(buf, ip16...)
+	}
+	return append(buf, make([]byte, net.IPv6len)...)
+}
+
+// ParseRawResult parses a Result from the first RawRecordSize bytes of b, as
+// written by AppendRawResult.
+func ParseRawResult(b []byte) (*Result, error) {
+	if len(b) < RawRecordSize {
+		return nil, fmt.Errorf("raw result is %d bytes, expected %d", len(b),
+			RawRecordSize)
+	}
+	if b[0] != RawRecordVersion {
+		return nil, fmt.Errorf("unknown raw result version %d", b[0])
+	}
+	pd := &PathDist{
+		SrcIP:   net.IP(append([]byte(nil), b[64:80]...)),
+		SrcPort: int(binary.BigEndian.Uint16(b[4:])),
+		DstIP:   net.IP(append([]byte(nil), b[80:96]...)),
+		DstPort: int(binary.BigEndian.Uint16(b[6:])),
+		Proto:   "udp",
+	}
+	return &Result{
+		Pd:        pd,
+		Lost:      b[1]&RawFlagLost != 0,
+		Duplicate: b[1]&RawFlagDuplicate != 0,
+		OneWay:    b[1]&RawFlagOneWay != 0,
+		Tos:       b[2],
+		Seq:       binary.BigEndian.Uint64(b[8:]),
+		Sent:      binary.BigEndian.Uint64(b[16:]),
+		Done:      binary.BigEndian.Uint64(b[24:]),
+		RTT:       binary.BigEndian.Uint64(b[32:]),
+		FwdDelay:  int64(binary.BigEndian.Uint64(b[40:])),
+		RevDelay:  int64(binary.BigEndian.Uint64(b[48:])),
+		Dwell:     binary.BigEndian.Uint64(b[56:]),
+	}, nil
+}
+
+// RawResultJSON is a Result in the JSON lines format. Times are all in ns,
+// and the one-way delays are only set if the reflector provided timestamps.
+type RawResultJSON struct {
+	SrcIP     string `json:"src_ip"`
+	SrcPort   int    `json:"src_port"`
+	DstIP     string `json:"dst_ip"`
+	DstPort   int    `json:"dst_port"`
+	Proto     string `json:"proto"`
+	Tos       byte   `json:"tos"`
+	Seq       uint64 `json:"seq"`
+	Sent      uint64 `json:"sent"`     // Since the epoch
+	Received  uint64 `json:"received"` // Since the epoch, 0 if lost
+	RTT       uint64 `json:"rtt"`
+	Lost      bool   `json:"lost"`
+	Duplicate bool   `json:"duplicate"`
+	FwdDelay  int64  `json:"fwd_delay,omitempty"`
+	RevDelay  int64  `json:"rev_delay,omitempty"`
+	Dwell     uint64 `json:"dwell,omitempty"`
+}
+
+// NewRawResultJSON converts the result into a RawResultJSON.
+func NewRawResultJSON(result *Result) *RawResultJSON {
+	return &RawResultJSON{
+		SrcIP:     result.Pd.SrcIP.String(),
+		SrcPort:   result.Pd.SrcPort,
+		DstIP:     result.Pd.DstIP.String(),
+		DstPort:   result.Pd.DstPort,
+		Proto:     result.Pd.Proto,
+		Tos:       result.Tos,
+		Seq:       result.Seq,
+		Sent:      result.Sent,
+		Received:  result.Done,
+		RTT:       result.RTT,
+		Lost:      result.Lost,
+		Duplicate: result.Duplicate,
+		FwdDelay:  result.FwdDelay,
+		RevDelay:  result.RevDelay,
+		Dwell:     result.Dwell,
+	}
+}
+
+// RawExporter writes every individual Result from the ResultHandlers, or a
+// sample of them, to a file or Unix socket, for timelines of each probe that
+// summaries hide.
+//
+// Results are written in the background, so if the file or socket can't keep
+// up, or the socket isn't connected, they're dropped rather than delaying the
+// ResultHandlers, and the number dropped is logged.
+type RawExporter struct {
+	format     string
+	sampleRate float64
+	open       func() (io.WriteCloser, error) // Opens w
+	w          io.WriteCloser                 // Nil until opened, or after failing
+	bw         *bufio.Writer                  // Buffers w
+	buf        []byte                         // Reused for each Result
+	retryAt    time.Time                      // When opening w is next tried
+	results    chan *Result
+	dropped    atomic.Uint64 // Since last logged
+	ctx        context.Context
+	cancel     context.CancelFunc
+	wg         sync.WaitGroup
+}
+
+// Export queues the result to be written, if it's sampled. This doesn't
+// block, so it's dropped if too many are already waiting to be written.
+func (re *RawExporter) Export(result *Result) {
+	if re.sampleRate < 1 && rand.Float64() >= re.sampleRate {
+		return
+	}
+	select {
+	case re.results <- result:
+	default:
+		re.dropped.Add(1)
+	}
+}
+
+// Run starts writing the exported results in a new goroutine.
+func (re *RawExporter) Run() {
+	re.wg.Add(1)
+	go func() {
+		defer re.wg.Done()
+		re.run()
+	}()
+}
+
+func (re *RawExporter) run() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-re.ctx.Done():
+			// Write those that were already exported before stopping
+			for len(re.results) > 0 {
+				re.write(<-re.results)
+			}
+			re.flush()
+			re.reportDropped()
+			if re.w != nil {
+				HandleMinorErrorMsg(re.w.Close(), "failed to close raw results")
+				re.w = nil
+			}
+			return
+		case result := <-re.results:
+			re.write(result)
+			// Wait for a lull to write, or until the buffer is full
+			if len(re.results) == 0 {
+				re.flush()
+			}
+		case <-ticker.C:
+			re.reportDropped()
+		}
+	}
+}
+
+// write buffers the result to be written, opening w first if needed.
+func (re *RawExporter) write(result *Result) {
+	if re.w == nil {
+		if time.Now().Before(re.retryAt) {
+			re.dropped.Add(1)
+			return
+		}
+		w, err := re.open()
+		if err != nil {
+			re.fail(err, "failed to open raw results")
+			re.dropped.Add(1)
+			return
+		}
+		re.w = w
+		re.bw.Reset(w)
+	}
+	if re.format == RawFormatBinary {
+		re.buf = AppendRawResult(re.buf[:0], result)
+	} else {
+		line, err := json.Marshal(NewRawResultJSON(result))
+		if err != nil {
+			HandleMinorErrorMsg(err, "failed to encode raw result")
+			return
+		}
+		re.buf = append(append(re.buf[:0], line...), '\n')
+	}
+	if _, err := re.bw.Write(re.buf); err != nil {
+		re.fail(err, "failed to write raw results")
+	}
+}
+
+// flush writes any buffered results.
+func (re *RawExporter) flush() {
+	if re.w == nil {
+		return
+	}
+	if err := re.bw.Flush(); err != nil {
+		re.fail(err, "failed to write raw results")
+	}
+}
+
+// fail closes w after err, so it's reopened after DefaultRawRetryDelay, such
+// as once whatever is listening on the socket has restarted.
+func (re *RawExporter) fail(err error, msg string) {
+	HandleMinorErrorMsg(err, fmt.Sprintf("%s, retrying in %v", msg,
+		DefaultRawRetryDelay))
+	if re.w != nil {
+		re.w.Close()
+		re.w = nil
+	}
+	re.retryAt = time.Now().Add(DefaultRawRetryDelay)
+}
+
+// reportDropped logs how many results were dropped since it was last called.
+func (re *RawExporter) reportDropped() {
+	if n := re.dropped.Swap(0); n > 0 {
+		HandleMinorErrorMsg(fmt.Errorf("dropped %d raw results", n),
+			"raw results not written")
+	}
+}
+
+// Stop will stop the re once it's written the results that were already
+// exported, and wait for it to exit.
+func (re *RawExporter) Stop() {
+	LogInfo("Stopping RawExporter")
+	re.cancel()
+	re.wg.Wait()
+	// If it was never run
+	if re.w != nil {
+		re.w.Close()
+		re.w = nil
+	}
+}
+
+// NewRawExporter creates a RawExporter based on the rc, which stops once ctx
+// is done, or Stop is called.
+//
+// A file is opened, or created, straight away. A socket is connected to once
+// there are results to write, and reconnected to if that fails, so whatever
+// is listening on it can be started later.
+func NewRawExporter(ctx context.Context, rc RawConfig) (*RawExporter,
+	error) {
+	if !rc.Enabled() {
+		return nil, errors.New("no path or socket for raw results")
+	}
+	rc.SetDefaults()
+	re := &RawExporter{
+		format:     rc.Format,
+		sampleRate: rc.SampleRate,
+		bw:         bufio.NewWriter(nil),
+		results:    make(chan *Result, DEFAULT_CHANNEL_SIZE),
+	}
+	if rc.Path != "" {
+		re.open = func() (io.WriteCloser, error) {
+			return os.OpenFile(rc.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE,
+				0644)
+		}
+		w, err := re.open()
+		if err != nil {
+			return nil, fmt.Errorf("failed to open raw results file: %w", err)
+		}
+		re.w = w
+		re.bw.Reset(w)
+	} else {
+		re.open = func() (io.WriteCloser, error) {
+			return net.Dial("unix", rc.Socket)
+		}
+	}
+	re.ctx, re.cancel = context.WithCancel(ctx)
+	return re, nil
+}
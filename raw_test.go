@@ -0,0 +1,184 @@
+package udprobe
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var exampleRawResults = []*Result{
+	{
+		Pd: &PathDist{SrcIP: net.ParseIP("10.0.0.1").To4(), SrcPort: 40000,
+			DstIP: net.ParseIP("10.0.1.1"), DstPort: 8100, Proto: "udp"},
+		RTT:      1500000,
+		Sent:     1767322800000000000,
+		Done:     1767322800001500000,
+		Tos:      184,
+		Seq:      7,
+		FwdDelay: 700000,
+		RevDelay: -100000,
+		Dwell:    900000,
+		OneWay:   true,
+	},
+	{
+		Pd: &PathDist{SrcIP: net.ParseIP("2001:db8::1"), SrcPort: 40000,
+			DstIP: net.ParseIP("2001:db8::2"), DstPort: 8100, Proto: "udp"},
+		Sent: 1767322801000000000,
+		Seq:  8,
+		Lost: true,
+	},
+}
+
+func TestRawResultRoundTrip(t *testing.T) {
+	for _, result := range exampleRawResults {
+		buf := AppendRawResult([]byte("prefix"), result)
+		if len(buf) != len("prefix")+RawRecordSize {
+			t.Fatal("Wrong size. Got", len(buf)-len("prefix"), "expected",
+				RawRecordSize)
+		}
+		parsed, err := ParseRawResult(buf[len("prefix"):])
+		if err != nil {
+			t.Fatal("Failed to parse:", err)
+		}
+		pd := parsed.Pd
+		if !pd.SrcIP.Equal(result.Pd.SrcIP) || pd.SrcPort != result.Pd.SrcPort ||
+			!pd.DstIP.Equal(result.Pd.DstIP) || pd.DstPort != result.Pd.DstPort ||
+			pd.Proto != result.Pd.Proto {
+			t.Errorf("Wrong PathDist. Got %+v expected %+v", pd, result.Pd)
+		}
+		parsed.Pd = result.Pd
+		if *parsed != *result {
+			t.Errorf("Wrong result. Got %+v expected %+v", parsed, result)
+		}
+	}
+	if _, err := ParseRawResult(make([]byte, RawRecordSize-1)); err == nil {
+		t.Error("Expected an error for a short record")
+	}
+	if _, err := ParseRawResult(make([]byte, RawRecordSize)); err == nil {
+		t.Error("Expected an error for an unknown version")
+	}
+}
+
+func TestRawExporterFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "results.jsonl")
+	re, err := NewRawExporter(context.Background(), RawConfig{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Fed by a ResultHandler
+	in := make(chan *InFlightProbe)
+	out := make(chan *Result, 2)
+	rh := NewResultHandler(context.Background(), in, out)
+	rh.SetRawExporter(re)
+	re.Run()
+	rh.Run()
+	in <- &InFlightProbe{Pd: exampleRawResults[0].Pd, CSent: 1000, CRcvd: 3000,
+		Seq: 1}
+	in <- &InFlightProbe{Pd: exampleRawResults[0].Pd, CSent: 2000, Seq: 2}
+	<-out
+	<-out
+	rh.Stop()
+	// Writes those already exported
+	re.Stop()
+
+	data, _ := os.ReadFile(path)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatal("Wrong number of lines. Got", lines)
+	}
+	var results []RawResultJSON
+	for _, line := range lines {
+		var result RawResultJSON
+		if err := json.Unmarshal([]byte(line), &result); err != nil {
+			t.Fatal("Invalid line:", line)
+		}
+		results = append(results, result)
+	}
+	expected := []RawResultJSON{
+		{SrcIP: "10.0.0.1", SrcPort: 40000, DstIP: "10.0.1.1", DstPort: 8100,
+			Proto: "udp", Seq: 1, Sent: 1000, Received: 3000, RTT: 2000},
+		{SrcIP: "10.0.0.1", SrcPort: 40000, DstIP: "10.0.1.1", DstPort: 8100,
+			Proto: "udp", Seq: 2, Sent: 2000, Lost: true},
+	}
+	for i := range expected {
+		if results[i] != expected[i] {
+			t.Errorf("Wrong result %d. Got %+v expected %+v", i, results[i],
+				expected[i])
+		}
+	}
+}
+
+func TestRawExporterSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "results.sock")
+	re, err := NewRawExporter(context.Background(), RawConfig{Socket: path,
+		Format: RawFormatBinary})
+	if err != nil {
+		t.Fatal("Expected the socket to be connected to later. Got", err)
+	}
+	re.Run()
+	defer re.Stop()
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	received := make(chan *Result)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		record := make([]byte, RawRecordSize)
+		for {
+			if _, err := io.ReadFull(r, record); err != nil {
+				return
+			}
+			result, _ := ParseRawResult(record)
+			received <- result
+		}
+	}()
+	// Dropped until it's connected
+	deadline := time.After(5 * time.Second)
+	for {
+		re.Export(exampleRawResults[1])
+		select {
+		case result := <-received:
+			if result.Seq != exampleRawResults[1].Seq || !result.Lost {
+				t.Errorf("Wrong result. Got %+v", result)
+			}
+			return
+		case <-time.After(100 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("Result not received over the socket")
+		}
+	}
+}
+
+func TestRawExporterSample(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "results.jsonl")
+	re, err := NewRawExporter(context.Background(), RawConfig{Path: path,
+		SampleRate: 1e-12})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer re.Stop()
+	for i := 0; i < 100; i++ {
+		re.Export(exampleRawResults[0])
+	}
+	if len(re.results) != 0 {
+		t.Error("Results exported despite the sample rate. Got", len(re.results))
+	}
+	if _, err := NewRawExporter(context.Background(), RawConfig{}); err == nil {
+		t.Error("Expected an error without a path or socket")
+	}
+}
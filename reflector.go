@@ -9,14 +9,23 @@ import (
 	pb "github.com/nsw3550/udprobe/proto"
 	"golang.org/x/sys/unix"
 	"golang.org/x/time/rate"
+	"google.golang.org/protobuf/encoding/protowire"
 	"google.golang.org/protobuf/proto"
 )
 
 // Reflect will listen on the provided UDPConn and will send back any UdpData
 // compliant packets that it receives, in compliance with the RateLimiter.
-func Reflect(ctx context.Context, conn *net.UDPConn, rl *rate.Limiter) {
+//
+// tsMode determines how the receive timestamp added to probes is taken.
+// SetupTimestamps should already have been called on conn with the same mode,
+// and without transmit timestamps, since the reflector doesn't read them.
+func Reflect(ctx context.Context, conn *net.UDPConn, rl *rate.Limiter,
+	tsMode TimestampMode) {
 	reflectorUp.Set(1)
 	defer reflectorUp.Set(0)
+	// Don't leave a read hanging once ctx is done
+	unblock := context.AfterFunc(ctx, func() { conn.SetReadDeadline(time.Now()) })
+	defer unblock()
 
 	dataBuf := make([]byte, 4096)
 	oobBuf := make([]byte, 4096)
@@ -31,17 +40,10 @@ func Reflect(ctx context.Context, conn *net.UDPConn, rl *rate.Limiter) {
 		}
 
 		// Use reserve so we can track when throttling happens
-		reservation := rl.Reserve()
-		delay := reservation.Delay()
-		if delay > 0 {
-			// We hit the rate limit, so log it
-			time.Sleep(delay)
-			reflectorPacketsThrottled.Inc()
-		}
+		throttle(rl, 1)
 
 		// Receive data from the connection
-		// Not currently using `oob`
-		data, _, addr, err := Receive(dataBuf, oobBuf, conn)
+		data, oob, addr, err := Receive(dataBuf, oobBuf, conn)
 		if err != nil {
 			// If context is done, we expect errors (e.g. use of closed network connection)
 			select {
@@ -54,39 +56,173 @@ func Reflect(ctx context.Context, conn *net.UDPConn, rl *rate.Limiter) {
 			continue
 		}
 		reflectorPacketsReceived.Inc()
+		data, tos, ok := reflect(data, oob, tsMode)
+		if !ok {
+			continue
+		}
 
-		// For this section, it might make sense to put in `Process` anyways.
-		// But for now, all we need is to make sure it's udprobe data
-		// and get the ToS value.
-		pbProbe := &pb.Probe{}
-		err = proto.Unmarshal(data, pbProbe)
+		// Send the data back to sender
+		err = Send(stampSent(data), tos, conn, addr)
 		if err != nil {
-			// Else, don't reflect bad data
-			reflectorPacketsBadData.Inc()
-			HandleMinorErrorMsg(err, "failed to unmarshal probe")
+			HandleMinorErrorMsg(err, "failed to send reflected packet")
 			continue
 		}
+		reflectorPacketsReflected.Inc()
+	}
+}
 
-		// Update the received time before reflecting
-		pbProbe.Rcvd = NowUint64()
-		// Re-marshal to include the new timestamp
-		// NOTE: This adds some overhead, but is more accurate for one-way delay.
-		data, err = proto.Marshal(pbProbe)
+// ReflectBatch is the same as Reflect, but receives and sends up to size
+// packets per syscall to reduce the CPU cost of each packet.
+//
+// Packets are reflected as soon as they're received, so a batch is only as
+// big as whatever is already waiting on the socket.
+//
+// Returns an error if batching can't be set up on conn, otherwise nil once
+// ctx is done.
+func ReflectBatch(ctx context.Context, conn *net.UDPConn, rl *rate.Limiter,
+	tsMode TimestampMode, size int) error {
+	batch, err := NewBatchConn(conn, size)
+	if err != nil {
+		return err
+	}
+	reflectorUp.Set(1)
+	defer reflectorUp.Set(0)
+	// Same as in Reflect
+	unblock := context.AfterFunc(ctx, func() { conn.SetReadDeadline(time.Now()) })
+	defer unblock()
+	in := make([]BatchMessage, batch.Size())
+	for i := range in {
+		in[i].Buf = make([]byte, 4096)
+		in[i].OOB = make([]byte, 4096)
+	}
+	out := make([]BatchMessage, 0, batch.Size())
+	received := 0 // Packets from the previous batch, for rate limiting
+
+	LogInfo("Beginning batched reflection on: " + conn.LocalAddr().String())
+	for {
+		select {
+		case <-ctx.Done():
+			LogInfo("Stopping reflection on: " + conn.LocalAddr().String())
+			return nil
+		default:
+		}
+
+		// We don't know how many are coming until they're here, so this
+		// accounts for the previous batch
+		throttle(rl, received)
+
+		n, err := batch.ReadBatch(in)
+		received = n
 		if err != nil {
-			HandleMinorErrorMsg(err, "failed to marshal reflected probe")
+			// If context is done, we expect errors (e.g. use of closed network connection)
+			select {
+			case <-ctx.Done():
+				return nil
+			default:
+			}
+			HandleMinorErrorMsg(err, "failed to receive packets")
+			reflectorPacketsReceived.Inc() // Still increment as we tried to receive
+			continue
+		}
+		reflectorPacketsReceived.Add(float64(n))
+		out = out[:0]
+		for i := 0; i < n; i++ {
+			data, tos, ok := reflect(in[i].Buf[0:in[i].N], in[i].OOB[0:in[i].NN], tsMode)
+			if !ok {
+				continue
+			}
+			out = append(out, BatchMessage{
+				Buf:  data,
+				OOB:  tosCmsg(tos, in[i].Addr.IP),
+				Addr: in[i].Addr,
+			})
+		}
+		if len(out) == 0 {
 			continue
 		}
 
-		// Send the data back to sender
-		err = Send(data, byte(pbProbe.Tos), conn, addr)
+		// Send the data back to the senders
+		for i := range out {
+			out[i].Buf = stampSent(out[i].Buf)
+		}
+		sent, err := batch.WriteBatch(out)
+		reflectorPacketsReflected.Add(float64(sent))
 		if err != nil {
-			HandleMinorErrorMsg(err, "failed to send reflected packet")
-			continue
+			HandleMinorErrorMsg(err, "failed to send reflected packets")
 		}
-		reflectorPacketsReflected.Inc()
 	}
 }
 
+// throttle waits until n packets are allowed by the rl, and counts them as
+// throttled if any waiting was needed.
+func throttle(rl *rate.Limiter, n int) {
+	if n < 1 {
+		return
+	}
+	// Use reserve so we can track when throttling happens
+	reservation := rl.ReserveN(time.Now(), n)
+	if !reservation.OK() {
+		// More than the burst, so just wait for the max
+		reservation = rl.ReserveN(time.Now(), rl.Burst())
+	}
+	delay := reservation.Delay()
+	if delay > 0 {
+		// We hit the rate limit, so log it
+		time.Sleep(delay)
+		reflectorPacketsThrottled.Add(float64(n))
+	}
+}
+
+// reflect updates a received probe with the reflector's receive timestamp,
+// and returns the data to send back along with its ToS. Returns false if data
+// isn't a valid probe.
+//
+// The data still needs its send timestamp added by stampSent.
+func reflect(data []byte, oob []byte, tsMode TimestampMode) ([]byte, byte, bool) {
+	// Grab this as early as possible, in case it's from userspace
+	rcvd := RcvdTime(oob, tsMode)
+
+	// For this section, it might make sense to put in `Process` anyways.
+	// But for now, all we need is to make sure it's udprobe data
+	// and get the ToS value.
+	pbProbe := &pb.Probe{}
+	err := proto.Unmarshal(data, pbProbe)
+	if err != nil {
+		// Else, don't reflect bad data
+		reflectorPacketsBadData.Inc()
+		HandleMinorErrorMsg(err, "failed to unmarshal probe")
+		return nil, 0, false
+	}
+
+	// Update the received time before reflecting
+	pbProbe.Rcvd = rcvd
+	// Set by stampSent, once it's about to be sent
+	pbProbe.ReflectorSent = 0
+	// Re-marshal to include the new timestamp
+	// NOTE: This adds some overhead, but is more accurate for one-way delay.
+	data, err = proto.Marshal(pbProbe)
+	if err != nil {
+		HandleMinorErrorMsg(err, "failed to marshal reflected probe")
+		return nil, 0, false
+	}
+	return data, byte(pbProbe.Tos), true
+}
+
+// The field number of ReflectorSent in the probe, for stampSent.
+var reflectorSentField = (&pb.Probe{}).ProtoReflect().Descriptor().Fields().
+	ByName("reflector_sent").Number()
+
+// stampSent appends the send time to a reflected probe from reflect, just
+// before it's sent, so the collector can separate all of the time spent here
+// from the forward/reverse delay.
+//
+// The field is appended rather than set and marshalled again, which decoding
+// takes as the value, since the last one wins for repeated scalar fields.
+func stampSent(data []byte) []byte {
+	data = protowire.AppendTag(data, reflectorSentField, protowire.VarintType)
+	return protowire.AppendVarint(data, NowUint64())
+}
+
 // Receive accepts UDP packets on the provided conn and returns the data and
 // and control message slices, as well as the UDPAddr it was received from.
 func Receive(data []byte, oob []byte, conn *net.UDPConn) (
@@ -101,13 +237,31 @@ func Receive(data []byte, oob []byte, conn *net.UDPConn) (
 }
 
 // Send will send the provided data using the conn to the addr, via UDP.
+//
+// The tos is applied as IP_TOS for IPv4 (including IPv4-mapped) addrs, and
+// as IPV6_TCLASS otherwise.
 func Send(data []byte, tos byte, conn *net.UDPConn, addr *net.UDPAddr) error {
-	oob := make([]byte, unix.CmsgSpace(1))
-	h := (*unix.Cmsghdr)(unsafe.Pointer(&oob[0]))
-	h.Level = unix.IPPROTO_IP
-	h.Type = unix.IP_TOS
-	h.SetLen(unix.CmsgLen(1))
-	*(*byte)(unsafe.Pointer(uintptr(unsafe.Pointer(h)) + uintptr(unix.SizeofCmsghdr))) = tos
-	_, _, err := conn.WriteMsgUDP(data, oob, addr)
+	_, _, err := conn.WriteMsgUDP(data, tosCmsg(tos, addr.IP), addr)
 	return err
 }
+
+// tosCmsg builds the control message to send a packet to ip with the tos.
+func tosCmsg(tos byte, ip net.IP) []byte {
+	if ip.To4() != nil {
+		oob := make([]byte, unix.CmsgSpace(1))
+		h := (*unix.Cmsghdr)(unsafe.Pointer(&oob[0]))
+		h.Level = unix.IPPROTO_IP
+		h.Type = unix.IP_TOS
+		h.SetLen(unix.CmsgLen(1))
+		*(*byte)(unsafe.Pointer(uintptr(unsafe.Pointer(h)) + uintptr(unix.SizeofCmsghdr))) = tos
+		return oob
+	}
+	// IPV6_TCLASS must be an int
+	oob := make([]byte, unix.CmsgSpace(4))
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	h.Level = unix.IPPROTO_IPV6
+	h.Type = unix.IPV6_TCLASS
+	h.SetLen(unix.CmsgLen(4))
+	*(*int32)(unsafe.Pointer(uintptr(unsafe.Pointer(h)) + uintptr(unix.SizeofCmsghdr))) = int32(tos)
+	return oob
+}
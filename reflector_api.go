@@ -1,8 +1,10 @@
 package udprobe
 
 import (
+	"context"
 	"fmt"
 	"net/http"
+	"sync"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
@@ -10,6 +12,8 @@ import (
 type ReflectorAPI struct {
 	server  *http.Server
 	handler *http.ServeMux
+	errs    chan error
+	wg      sync.WaitGroup
 }
 
 func (api *ReflectorAPI) PromHandler() http.Handler {
@@ -21,11 +25,19 @@ func (api *ReflectorAPI) StatusHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (api *ReflectorAPI) Run() {
-	go func() { HandleFatalErrorMsg(api.server.ListenAndServe(), "Reflector API server failed") }()
+	api.wg.Add(1)
+	go func() {
+		defer api.wg.Done()
+		err := api.server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			reportError(api.errs, fmt.Errorf("reflector API server failed: %w", err))
+		}
+	}()
 }
 
 func (api *ReflectorAPI) Stop() {
 	api.server.Close()
+	api.wg.Wait()
 }
 
 func (api *ReflectorAPI) setupHandlers() {
@@ -33,10 +45,12 @@ func (api *ReflectorAPI) setupHandlers() {
 	api.handler.Handle("/metrics", api.PromHandler())
 }
 
-func NewReflectorAPI(bind string) *ReflectorAPI {
+func NewReflectorAPI(ctx context.Context, bind string,
+	errs chan error) *ReflectorAPI {
 	handler := http.NewServeMux()
 	server := &http.Server{Addr: bind, Handler: handler}
-	api := &ReflectorAPI{server: server, handler: handler}
+	context.AfterFunc(ctx, func() { server.Close() })
+	api := &ReflectorAPI{server: server, handler: handler, errs: errs}
 	api.setupHandlers()
 	RegisterReflectorPrometheus()
 	return api
@@ -1,6 +1,7 @@
 package udprobe
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -18,7 +19,7 @@ func TestReflectorMetricsRegistration(t *testing.T) {
 }
 
 func TestReflectorAPIHandlers(t *testing.T) {
-	api := NewReflectorAPI(":0")
+	api := NewReflectorAPI(context.Background(), ":0", nil)
 
 	req := httptest.NewRequest("GET", "/status", nil)
 	w := httptest.NewRecorder()
@@ -33,7 +34,7 @@ func TestReflectorAPIHandlers(t *testing.T) {
 }
 
 func TestReflectorAPIEndpoints(t *testing.T) {
-	api := NewReflectorAPI(":0")
+	api := NewReflectorAPI(context.Background(), ":0", nil)
 
 	req := httptest.NewRequest("GET", "/metrics", nil)
 	w := httptest.NewRecorder()
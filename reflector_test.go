@@ -5,8 +5,10 @@ import (
 	"net"
 	"testing"
 	"time"
+	"unsafe"
 
 	pb "github.com/nsw3550/udprobe/proto"
+	"golang.org/x/sys/unix"
 	"golang.org/x/time/rate"
 	"google.golang.org/protobuf/proto"
 )
@@ -100,6 +102,52 @@ func TestReflectorSend(t *testing.T) {
 	}
 }
 
+func TestReflectorSendIPv6(t *testing.T) {
+	addr, _ := net.ResolveUDPAddr("udp6", "[::1]:0")
+	conn, err := net.ListenUDP("udp6", addr)
+	if err != nil {
+		t.Skip("IPv6 not available:", err)
+	}
+	defer conn.Close()
+	// Have the traffic class reported with the packet
+	rawConn, _ := conn.SyscallConn()
+	rawConn.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6,
+			unix.IPV6_RECVTCLASS, 1)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	senderConn, _ := net.ListenUDP("udp6", addr)
+	defer senderConn.Close()
+
+	err = Send([]byte("reflector test"), 0xb8, senderConn,
+		conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 1024)
+	oob := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, oobLen, _, _, err := conn.ReadMsgUDP(buf, oob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs, _ := unix.ParseSocketControlMessage(oob[:oobLen])
+	tclass := -1
+	for _, msg := range msgs {
+		if msg.Header.Level == unix.IPPROTO_IPV6 &&
+			msg.Header.Type == unix.IPV6_TCLASS {
+			tclass = int(*(*int32)(unsafe.Pointer(&msg.Data[0])))
+		}
+	}
+	if tclass != 0xb8 {
+		t.Error("Traffic class not applied to IPv6 packet. Got", tclass,
+			"expected", 0xb8)
+	}
+}
+
 func TestReflectorLoop(t *testing.T) {
 	// 1. Setup reflector
 	addr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:0")
@@ -110,7 +158,8 @@ func TestReflectorLoop(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	
 	// Run Reflect in background
-	go Reflect(ctx, conn, rl)
+	EnableTimestamps(conn)
+	go Reflect(ctx, conn, rl, TimestampKernel)
 
 	// 2. Setup client
 	clientConn, _ := net.DialUDP("udp", nil, conn.LocalAddr().(*net.UDPAddr))
@@ -149,6 +198,9 @@ func TestReflectorLoop(t *testing.T) {
 	if reflectedProbe.Rcvd == 0 {
 		t.Error("Expected Rcvd timestamp to be set by reflector")
 	}
+	if reflectedProbe.ReflectorSent < reflectedProbe.Rcvd {
+		t.Error("Expected ReflectorSent timestamp to be set by reflector after Rcvd")
+	}
 
 	// 4. Test Error Path: Send bad data
 	badData := []byte("not a protobuf")
@@ -172,7 +224,7 @@ func TestReflectorLoop(t *testing.T) {
 	addrT, _ := net.ResolveUDPAddr("udp", "127.0.0.1:0")
 	connT, _ := net.ListenUDP("udp", addrT)
 	defer connT.Close()
-	go Reflect(ctxT, connT, rlT)
+	go Reflect(ctxT, connT, rlT, TimestampUserspace)
 	
 	clientConnT, _ := net.DialUDP("udp", nil, connT.LocalAddr().(*net.UDPAddr))
 	defer clientConnT.Close()
@@ -188,3 +240,59 @@ func TestReflectorLoop(t *testing.T) {
 	cancel()
 	cancelT()
 }
+
+func TestReflectBatch(t *testing.T) {
+	addr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+	conn, _ := net.ListenUDP("udp", addr)
+	defer conn.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ReflectBatch(ctx, conn, rate.NewLimiter(rate.Inf, 0),
+		TimestampUserspace, 8)
+
+	// A batched Port on the other end
+	tosend := make(chan *net.UDPAddr, 10)
+	cbc := make(chan *InFlightProbe, 10)
+	portConn, _ := net.ListenUDP("udp", addr)
+	port, _ := NewPort(ctx, portConn, tosend, cbc, nil,
+		time.Second, 3*time.Second, 20*time.Millisecond, TimestampUserspace)
+	port.SetBatch(8)
+	defer port.Stop()
+	for i := 0; i < 5; i++ {
+		tosend <- conn.LocalAddr().(*net.UDPAddr)
+	}
+	// Start after queueing, so they go out together
+	port.Send()
+	port.Recv()
+
+	seqs := make(map[uint64]bool)
+	for len(seqs) < 5 {
+		select {
+		case probe := <-cbc:
+			if probe.CRcvd == 0 || probe.ReflectorRcvd == 0 {
+				t.Fatal("Probe wasn't reflected:", probe)
+			}
+			seqs[probe.Seq] = true
+		case <-time.After(2 * time.Second):
+			t.Fatal("Expected 5 reflected probes, got", len(seqs))
+		}
+	}
+}
+
+func TestStampSent(t *testing.T) {
+	// An earlier value is replaced, rather than kept
+	data, _ := proto.Marshal(&pb.Probe{Signature: []byte("test-sig"), Rcvd: 1,
+		ReflectorSent: 2})
+	before := NowUint64()
+	probe := &pb.Probe{}
+	if err := proto.Unmarshal(stampSent(data), probe); err != nil {
+		t.Fatal("Failed to unmarshal stamped probe:", err)
+	}
+	if probe.ReflectorSent < before || probe.ReflectorSent > NowUint64() {
+		t.Error("ReflectorSent not stamped. Got", probe.ReflectorSent,
+			"expected at least", before)
+	}
+	if string(probe.Signature) != "test-sig" || probe.Rcvd != 1 {
+		t.Error("Other fields changed. Got", probe)
+	}
+}
@@ -1,29 +1,45 @@
 package udprobe
 
 import (
+	"context"
 	"errors"
+	"sync"
 )
 
 // Result defines characteristics of a single completed Probe.
 type Result struct {
-	Pd   *PathDist // Characteristics that make this path unique
-	RTT  uint64    // Round trip time in nanoseconds
-	Done uint64    // When the test completed (was received by Port) in ns
-	Lost bool      // If the Probe was lost and never actually completed
-	Tos  byte      // ToS value for the probe
+	Pd        *PathDist // Characteristics that make this path unique
+	RTT       uint64    // Round trip time in nanoseconds
+	Sent      uint64    // When the Probe was sent in ns
+	Done      uint64    // When the test completed (was received by Port) in ns
+	Lost      bool      // If the Probe was lost and never actually completed
+	Tos       byte      // ToS value for the probe
+	Seq       uint64    // Sequence number, per source and destination port
+	Duplicate bool      // If this is an extra copy of an already received probe
+	FwdDelay  int64     // Collector to reflector delay in ns, depends on clock sync
+	RevDelay  int64     // Reflector to collector delay in ns, depends on clock sync
+	Dwell     uint64    // Time spent in the reflector in ns
+	OneWay    bool      // If the above were calculated from reflector timestamps
 }
 
 // ResultHandler is a post-processor for Probes and converts them to Results.
 type ResultHandler struct {
-	in   chan *InFlightProbe // Probes come in
-	out  chan *Result        // Results come out
-	stop chan bool
+	in     chan *InFlightProbe // Probes come in
+	out    chan *Result        // Results come out
+	raw    *RawExporter        // Also gets each Result, if set
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
 }
 
 // Run will start the ResultHandler in a new goroutine, and cause it to forever
 // receive Probes, process them and pass their results out.
 func (rh *ResultHandler) Run() {
-	go rh.run()
+	rh.wg.Add(1)
+	go func() {
+		defer rh.wg.Done()
+		rh.run()
+	}()
 }
 
 func (rh *ResultHandler) run() {
@@ -31,31 +47,42 @@ func (rh *ResultHandler) run() {
 	for {
 		// Get the probes
 		select {
-		case <-rh.stop:
+		case <-rh.ctx.Done():
 			return // We're done here
 		case probe := <-rh.in:
 			result = Process(probe)
 		}
+		if rh.raw != nil {
+			rh.raw.Export(result)
+		}
 		// Hand them off to the summarizer
 		select {
-		case <-rh.stop:
+		case <-rh.ctx.Done():
 			return // We're done here
 		case rh.out <- result:
 		}
 	}
 }
 
-// Stop will stop the rh.
+// SetRawExporter causes each Result to also be exported by re, or nothing to
+// be exported if re is nil. This must be called before Run.
+func (rh *ResultHandler) SetRawExporter(re *RawExporter) {
+	rh.raw = re
+}
+
+// Stop will stop the rh, and wait for it to exit.
 func (rh *ResultHandler) Stop() {
 	LogInfo("Stopping ResultHandler")
-	close(rh.stop)
+	rh.cancel()
+	rh.wg.Wait()
 }
 
 // New creates a new ResultHandler that utilizes the provided in and out
-// channels.
-func NewResultHandler(in chan *InFlightProbe, out chan *Result) *ResultHandler {
-	stop := make(chan bool)
-	rh := ResultHandler{in: in, out: out, stop: stop}
+// channels. It stops once ctx is done, or Stop is called.
+func NewResultHandler(ctx context.Context, in chan *InFlightProbe,
+	out chan *Result) *ResultHandler {
+	ctx, cancel := context.WithCancel(ctx)
+	rh := ResultHandler{in: in, out: out, ctx: ctx, cancel: cancel}
 	return &rh
 }
 
@@ -63,13 +90,18 @@ func NewResultHandler(in chan *InFlightProbe, out chan *Result) *ResultHandler {
 // Result.
 func Process(probe *InFlightProbe) *Result {
 	result := &Result{
-		Pd:   probe.Pd,
-		Done: probe.CRcvd,
-		Tos:  probe.Tos,
+		Pd:        probe.Pd,
+		Sent:      probe.CSent,
+		Done:      probe.CRcvd,
+		Tos:       probe.Tos,
+		Seq:       probe.Seq,
+		Duplicate: probe.Duplicate,
 	}
 	// Add additional calculations here
 	err := RTT(probe, result)
 	HandleMinorErrorMsg(err, "failed to calculate RTT")
+	err = OneWay(probe, result)
+	HandleMinorErrorMsg(err, "failed to calculate one-way delay")
 	return result
 }
 
@@ -92,3 +124,25 @@ func RTT(probe *InFlightProbe, result *Result) error {
 	result.RTT = rtt
 	return nil
 }
+
+// OneWay calculates the forward and reverse delays, along with the time spent
+// in the reflector (dwell), for a probe and updates the Result.
+//
+// The forward and reverse delays compare timestamps from the collector's and
+// reflector's clocks, so any offset between them shows up directly in the
+// results, which may even be negative. The dwell only relies on the
+// reflector's clock.
+func OneWay(probe *InFlightProbe, result *Result) error {
+	if probe.CRcvd == 0 || probe.ReflectorRcvd == 0 || probe.ReflectorSent == 0 {
+		// Either lost, or the reflector didn't provide timestamps
+		return nil
+	}
+	if probe.ReflectorRcvd > probe.ReflectorSent {
+		return errors.New("Reflector recv/send times appear to be out of order")
+	}
+	result.FwdDelay = int64(probe.ReflectorRcvd) - int64(probe.CSent)
+	result.RevDelay = int64(probe.CRcvd) - int64(probe.ReflectorSent)
+	result.Dwell = probe.ReflectorSent - probe.ReflectorRcvd
+	result.OneWay = true
+	return nil
+}
@@ -1,6 +1,7 @@
 package udprobe
 
 import (
+	"context"
 	"testing"
 	"time"
 )
@@ -9,7 +10,7 @@ func TestResultHandlerRun(t *testing.T) {
 	// Create the TestHandler
 	in := make(chan *InFlightProbe)
 	out := make(chan *Result)
-	rh := NewResultHandler(in, out)
+	rh := NewResultHandler(context.Background(), in, out)
 	// Start it
 	rh.Run()
 	// Create a probe
@@ -32,18 +33,15 @@ func TestResultHandlerRun(t *testing.T) {
 func TestResultHandlerStop(t *testing.T) {
 	in := make(chan *InFlightProbe)
 	out := make(chan *Result)
-	rh := NewResultHandler(in, out)
+	rh := NewResultHandler(context.Background(), in, out)
 	// Make sure it's not already closed
-	select {
-	case <-rh.stop:
+	if rh.ctx.Err() != nil {
 		t.Error("ResultHandle stopped before being told to")
-	default:
 	}
 	// Close it and confirm
+	rh.Run()
 	rh.Stop()
-	select {
-	case <-rh.stop:
-	default:
+	if rh.ctx.Err() == nil {
 		t.Error("ResultHandle was told to stop but doesn't appear to be")
 	}
 }
@@ -51,7 +49,7 @@ func TestResultHandlerStop(t *testing.T) {
 func TestNewResultHandler(t *testing.T) {
 	in := make(chan *InFlightProbe)
 	out := make(chan *Result)
-	rh := NewResultHandler(in, out)
+	rh := NewResultHandler(context.Background(), in, out)
 	if rh.in != in {
 		t.Error("Provided input channel doesn't match on ResultHandler")
 	}
@@ -67,6 +65,7 @@ func TestProcess(t *testing.T) {
 		CSent: uint64(100000),
 		CRcvd: uint64(200000),
 		Tos:   byte(46),
+		Seq:   uint64(7),
 	}
 	// Make sure it processes correctly, but leave specific cases to any tests
 	// below.
@@ -82,7 +81,11 @@ func TestProcess(t *testing.T) {
 	if result.Lost == true {
 		t.Error("Result indicates Lost when it shouldn't")
 	}
-	// The Done time should make the CRcvd time on the Probe
+	// The Sent and Done times should match the CSent and CRcvd times on the
+	// Probe
+	if result.Sent != probe.CSent {
+		t.Error("CSent time wasn't propagated to Result")
+	}
 	if result.Done != probe.CRcvd {
 		t.Error("CRcvd time wasn't propagated to Result")
 	}
@@ -90,6 +93,59 @@ func TestProcess(t *testing.T) {
 	if result.Tos != probe.Tos {
 		t.Error("Tos wasn't propagated to Result")
 	}
+	// Verify sequence details are propagated
+	if result.Seq != probe.Seq || result.Duplicate {
+		t.Error("Seq/Duplicate weren't propagated to Result")
+	}
+}
+
+func TestOneWay(t *testing.T) {
+	probe := &InFlightProbe{
+		CSent:         uint64(100000),
+		ReflectorRcvd: uint64(130000),
+		ReflectorSent: uint64(140000),
+		CRcvd:         uint64(200000),
+	}
+	result := &Result{}
+	err := OneWay(probe, result)
+	if err != nil {
+		t.Error("Hit error unexpectedly calculating one-way delay:", err)
+	}
+	if !result.OneWay || result.FwdDelay != 30000 || result.RevDelay != 60000 ||
+		result.Dwell != 10000 {
+		t.Errorf("One-way calculation incorrect. Got %+v", *result)
+	}
+	// A reflector clock behind the collector makes the forward delay negative
+	probe = &InFlightProbe{
+		CSent:         uint64(100000),
+		ReflectorRcvd: uint64(50000),
+		ReflectorSent: uint64(60000),
+		CRcvd:         uint64(200000),
+	}
+	result = &Result{}
+	err = OneWay(probe, result)
+	if err != nil || result.FwdDelay != -50000 || result.RevDelay != 140000 {
+		t.Errorf("Negative forward delay not handled. Got %+v, %v", *result, err)
+	}
+	// Without reflector timestamps, nothing is calculated
+	probe = &InFlightProbe{CSent: uint64(100000), CRcvd: uint64(200000)}
+	result = &Result{}
+	err = OneWay(probe, result)
+	if err != nil || result.OneWay {
+		t.Error("One-way calculated without reflector timestamps")
+	}
+	// Reflector timestamps out of order
+	probe = &InFlightProbe{
+		CSent:         uint64(100000),
+		ReflectorRcvd: uint64(150000),
+		ReflectorSent: uint64(140000),
+		CRcvd:         uint64(200000),
+	}
+	result = &Result{}
+	err = OneWay(probe, result)
+	if err == nil || result.OneWay {
+		t.Error("Didn't hit an error for mixed up reflector times")
+	}
 }
 
 func TestRTT(t *testing.T) {
@@ -0,0 +1,88 @@
+package udprobe
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// SummaryBatch is the set of summaries from a single summarization, for the
+// results received between Start and End.
+type SummaryBatch struct {
+	Start     time.Time // Zero if summarized without Run
+	End       time.Time
+	Summaries []*Summary
+}
+
+// SummarySink receives each SummaryBatch from a Summarizer, as it's
+// summarized.
+//
+// WriteSummaries is called from the Summarizer's goroutine, so the next
+// summarization waits for it, and shouldn't block for long. Close is called
+// once the Summarizer has stopped, and nothing more will be written.
+type SummarySink interface {
+	WriteSummaries(batch *SummaryBatch) error
+	Close() error
+}
+
+// summaryLine is a line written by JSONLinesSink.
+type summaryLine struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	*SummaryJSON
+}
+
+// appendSummaryLines appends a summaryLine for each of the summaries in the
+// batch to buf, with the tags provided by tags, which may be nil.
+func appendSummaryLines(buf []byte, batch *SummaryBatch,
+	tags func(string) Tags) ([]byte, error) {
+	for _, summary := range batch.Summaries {
+		var summaryTags Tags
+		if tags != nil {
+			summaryTags = tags(summary.Pd.DstIP.String())
+		}
+		line, err := json.Marshal(&summaryLine{Start: batch.Start,
+			End: batch.End, SummaryJSON: NewSummaryJSON(summary, summaryTags)})
+		if err != nil {
+			return buf, fmt.Errorf("failed to encode summary: %w", err)
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+	return buf, nil
+}
+
+// JSONLinesSink is a SummarySink that writes each summary as a line of JSON,
+// the same as from the API's /summaries, with the start and end of its
+// interval.
+type JSONLinesSink struct {
+	w     io.Writer
+	tags  func(string) Tags
+	mutex sync.Mutex // For w
+}
+
+// WriteSummaries writes a line for each of the summaries in the batch, all
+// in a single write.
+func (s *JSONLinesSink) WriteSummaries(batch *SummaryBatch) error {
+	buf, err := appendSummaryLines(nil, batch, s.tags)
+	if err != nil || len(buf) == 0 {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, err = s.w.Write(buf)
+	return err
+}
+
+// Close does nothing, since the writer isn't owned by the s.
+func (s *JSONLinesSink) Close() error {
+	return nil
+}
+
+// NewJSONLinesSink creates a JSONLinesSink that writes to w, with the tags
+// provided by tags for each of the destination IPs, such as API.Tags. tags
+// may be nil.
+func NewJSONLinesSink(w io.Writer, tags func(string) Tags) *JSONLinesSink {
+	return &JSONLinesSink{w: w, tags: tags}
+}
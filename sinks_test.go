@@ -0,0 +1,89 @@
+package udprobe
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordingSink is a SummarySink that keeps everything written to it.
+type recordingSink struct {
+	batches []*SummaryBatch
+	closed  int
+}
+
+func (s *recordingSink) WriteSummaries(batch *SummaryBatch) error {
+	s.batches = append(s.batches, batch)
+	return nil
+}
+
+func (s *recordingSink) Close() error {
+	s.closed++
+	return nil
+}
+
+func TestSummarizeSinks(t *testing.T) {
+	s := NewSummarizer(t.Context(), nil, time.Hour, nil, nil)
+	sink := &recordingSink{}
+	s.AddSink(sink)
+	s.start = time.Now().Add(-time.Minute)
+	start := s.start
+	s.addResult(&Result{Pd: &PathDist{}, RTT: 1000000})
+	s.summarize()
+	s.summarize()
+
+	if len(sink.batches) != 2 {
+		t.Fatal("Wrong number of batches. Got", len(sink.batches))
+	}
+	first := sink.batches[0]
+	if len(first.Summaries) != 1 {
+		t.Fatal("Wrong summaries. Got", first.Summaries)
+	}
+	if !first.Start.Equal(start) || !first.End.After(start) ||
+		!first.Summaries[0].TS.Equal(first.End) {
+		t.Error("Wrong interval. Got", first.Start, first.End,
+			first.Summaries[0].TS)
+	}
+	// The next interval starts where the last one ended
+	if !sink.batches[1].Start.Equal(first.End) ||
+		len(sink.batches[1].Summaries) != 0 {
+		t.Error("Wrong second batch. Got", sink.batches[1])
+	}
+
+	s.Stop()
+	s.Stop()
+	if sink.closed != 1 {
+		t.Error("Sink closed", sink.closed, "times, expected once")
+	}
+}
+
+func TestJSONLinesSink(t *testing.T) {
+	var buf bytes.Buffer
+	sink := NewJSONLinesSink(&buf, func(ip string) Tags {
+		return Tags{"dst_hostname": "host-" + ip}
+	})
+	end := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	err := sink.WriteSummaries(&SummaryBatch{Start: end.Add(-time.Minute),
+		End: end, Summaries: exampleSummaries})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatal("Wrong number of lines. Got", lines)
+	}
+	var line struct {
+		Start time.Time `json:"start"`
+		End   time.Time `json:"end"`
+		SummaryJSON
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &line); err != nil {
+		t.Fatal("Invalid JSON:", err)
+	}
+	if !line.End.Equal(end) || line.DstIP != "10.0.1.2" || line.Tos != 184 ||
+		line.Tags["dst_hostname"] != "host-10.0.1.2" {
+		t.Error("Wrong line. Got", lines[1])
+	}
+}
@@ -1,36 +1,77 @@
 package udprobe
 
 import (
+	"context"
 	"fmt"
 	"math"
+	"sort"
 	"sync"
 	"time"
 )
 
 // Summary represents summaried results and statistics about them.
 type Summary struct {
-	Pd     *PathDist
-	RTTAvg float64
-	RTTMin float64
-	RTTMax float64
-	Sent   int
-	Lost   int
-	Loss   float64
-	Tos    byte
-	TS     time.Time // No longer used, but keeping for posterity
+	Pd             *PathDist
+	RTTAvg         float64
+	RTTMin         float64
+	RTTMax         float64
+	RTTPercentiles []Percentile      // In the order configured on the Summarizer
+	RTTHistogram   []HistogramBucket // Cumulative, in ascending order of Le
+	Jitter         float64           // RFC 3550 interarrival jitter of RTT in ms
+	IPDVMean       float64           // Mean absolute RTT delta between consecutive probes in ms
+	IPDVMax        float64           // Max absolute RTT delta between consecutive probes in ms
+	FwdDelayAvg    float64           // Avg collector to reflector delay in ms, corrected by ClockOffset
+	RevDelayAvg    float64           // Avg reflector to collector delay in ms, corrected by ClockOffset
+	DwellAvg       float64           // Avg time spent in the reflector in ms
+	ClockOffset    float64           // Estimated reflector clock offset from the collector in ms
+	ClockOffsetErr float64           // Bound on the error of ClockOffset in ms
+	Sent           int
+	Lost           int
+	Loss           float64
+	Duplicates     int    // Extra copies received, not counted in Sent
+	Reordered      int    // Probes received after one with a higher sequence number
+	ReorderExtent  uint64 // Largest sequence displacement of a reordered probe
+	Tos            byte
+	TS             time.Time // When the results were summarized
+}
+
+// Percentile is the RTT value, in milliseconds, at a given percentile rank.
+type Percentile struct {
+	P     float64 // Percentile rank out of 100 (e.g. 99.9)
+	Value float64 // RTT in milliseconds
+}
+
+// HistogramBucket is the number of completed probes with an RTT less than or
+// equal to Le. Like Prometheus histograms, buckets are cumulative.
+type HistogramBucket struct {
+	Le    float64 // Upper bound of the bucket in milliseconds
+	Count int
 }
 
 // Summarizer stores results and summarizes them at intervals.
 type Summarizer struct {
 	// NOTE(nwinemiller): For posterity, use value references for mutexes, not pointers
-	CMutex   sync.RWMutex
-	Cache    []*Summary
-	in       chan *Result
-	stop     chan bool
-	mutex    sync.RWMutex
-	results  map[string][]*Result
-	interval time.Duration // Keep this, or just pass to `Run`?
-	ticker   *time.Ticker
+	CMutex      sync.RWMutex
+	Cache       []*Summary
+	in          chan *Result
+	ctx         context.Context
+	cancel      context.CancelFunc
+	wg          sync.WaitGroup // For the summarizing and store goroutines
+	mutex       sync.RWMutex
+	results     map[string][]*Result
+	interval    time.Duration // Keep this, or just pass to `Run`?
+	percentiles []float64     // Percentile ranks (out of 100) to calculate
+	buckets     []float64     // Sorted RTT histogram upper bounds in ms
+	clocks      *ClockEstimator
+	sinks       []SummarySink
+	start       time.Time // Of the results for the next summarization
+}
+
+// AddSink adds a SummarySink to be written each set of summaries, once
+// they're in the Cache. It must be called before Run, and the sink is closed
+// once the s stops.
+func (s *Summarizer) AddSink(sink SummarySink) {
+	s.sinks = append(s.sinks, sink)
 }
 
 // Run causes the summarizer to infinitely wait for new results, store them,
@@ -38,13 +79,23 @@ type Summarizer struct {
 //
 // When results are summarized, they are removed and won't be summarized again.
 func (s *Summarizer) Run() {
-	go s.waitToSummarize()
+	s.start = time.Now()
+	s.goRun(s.waitToSummarize)
 	// TODO(nwinemiller): Need to make the number of `store` goroutines customizable.
 	//      These need to be able to keep up with the ResultHandler(s) and
 	//      however many probes are coming from all the ports/testrunners.
 	//      This was proving to be a bottleneck before.
-	go s.store()
-	go s.store()
+	s.goRun(s.store)
+	s.goRun(s.store)
+}
+
+// goRun runs f in a goroutine that Stop waits for.
+func (s *Summarizer) goRun(f func()) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		f()
+	}()
 }
 
 // waitToSummarize will wait until the next full even interval has passed
@@ -57,19 +108,24 @@ func (s *Summarizer) waitToSummarize() {
 	// Delay initially so it starts on an even interval
 	i := int64(s.interval)
 	// Sleep until the first interval
-	time.Sleep(time.Duration(i - (time.Now().UnixNano() % i)))
+	select {
+	case <-s.ctx.Done():
+		return
+	case <-time.After(time.Duration(i - (time.Now().UnixNano() % i))):
+	}
 	// This just starts the ticker, but doesn't actually start a summary cycle
 	// immediately. This allows at least a full cycle of results to populate
 	// before the first summarization. So the first summarization will likely
 	// cover more results than subsequent ones.
 	LogInfo(fmt.Sprintf("Starting ticker for Summarizer at %v intervals", s.interval))
-	s.ticker = time.NewTicker(s.interval)
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
 	// Now loop infinitely waiting for ticks
 	for {
 		select {
-		case <-s.stop:
+		case <-s.ctx.Done():
 			return
-		case <-s.ticker.C:
+		case <-ticker.C:
 			LogInfo("Summarizing results")
 			s.summarize()
 			LogInfo("Summarization complete")
@@ -89,15 +145,27 @@ func (s *Summarizer) summarize() {
 	s.mutex.Unlock()
 	// Create a new cache for this batch of results
 	var newCache []*Summary
+	now := time.Now()
 	// Perform summaries and save to new cache
 	for _, results := range results {
 		summary := s.summarizeSet(results)
+		summary.TS = now
 		newCache = append(newCache, summary)
 	}
+	// Drop clock estimates for paths that have stopped being probed
+	if s.clocks != nil {
+		s.clocks.Prune()
+	}
 	// Lock and swap the existing cache out for the new summaries
 	s.CMutex.Lock()
 	s.Cache = newCache
 	s.CMutex.Unlock()
+	batch := &SummaryBatch{Start: s.start, End: now, Summaries: newCache}
+	s.start = now
+	for _, sink := range s.sinks {
+		err := sink.WriteSummaries(batch)
+		HandleMinorErrorMsg(err, "failed to write summaries to sink")
+	}
 }
 
 // summarizeSet will return a Summary for a single set of Results, all of
@@ -113,13 +181,17 @@ func (s *Summarizer) summarizeSet(results []*Result) *Summary {
 	// be any.
 	pd := results[0].Pd
 	tos := results[0].Tos
-	// NOTE(nwinemiller): If we need timestamps again, this is the place to add them.
-	// summary := &Summary{Pd: pd, TS: time.Now()}
 	summary := &Summary{Pd: pd, Tos: tos}
 	// Perform the calculations
 	CalcCounts(results, summary)
 	CalcLoss(summary)
 	CalcRTT(results, summary)
+	CalcPercentiles(results, summary, s.percentiles)
+	CalcHistogram(results, summary, s.buckets)
+	CalcJitter(results, summary)
+	CalcReordering(results, summary)
+	CalcOneWay(results, summary)
+	CalcClockOffset(results, summary, s.clocks)
 	return summary
 }
 
@@ -129,7 +201,7 @@ func (s *Summarizer) store() {
 	for {
 		// Get the results
 		select {
-		case <-s.stop:
+		case <-s.ctx.Done():
 			return // We're done here
 		case result := <-s.in:
 			s.addResult(result)
@@ -161,28 +233,45 @@ func (s *Summarizer) addResult(result *Result) {
 	s.mutex.Unlock()
 }
 
-// Stop will stop the summarizer from receiving results or summarizing them.
+// Stop will stop the summarizer from receiving results or summarizing them,
+// and wait for it to exit.
 func (s *Summarizer) Stop() {
-	select {
-	case <-s.stop: // Provide a safe out if already stopped
-	default:
+	if s.ctx.Err() == nil {
 		LogInfo("Stopping Summarizer")
-		if s.ticker != nil {
-			s.ticker.Stop()
-		}
-		close(s.stop)
 	}
+	s.cancel()
+	s.wg.Wait()
+	for _, sink := range s.sinks {
+		err := sink.Close()
+		HandleMinorErrorMsg(err, "failed to close summary sink")
+	}
+	s.sinks = nil // So they're only closed once
 }
 
 // New returns a new Summarizer, based on the provided parameters.
-func NewSummarizer(in chan *Result, interval time.Duration) *Summarizer {
-	stop := make(chan bool)
+//
+// `percentiles` are the percentile ranks (out of 100) of RTT to include in
+// each Summary, and `buckets` are the upper bounds (in ms) of the RTT
+// histogram. Either may be empty to skip that calculation.
+//
+// The Summarizer stops once ctx is done, or Stop is called.
+func NewSummarizer(ctx context.Context, in chan *Result,
+	interval time.Duration, percentiles []float64,
+	buckets []float64) *Summarizer {
+	ctx, cancel := context.WithCancel(ctx)
 	results := make(map[string][]*Result)
+	// Keep our own sorted copy, since CalcHistogram relies on the ordering
+	sortedBuckets := append([]float64(nil), buckets...)
+	sort.Float64s(sortedBuckets)
 	summarizer := &Summarizer{
-		in:       in,
-		stop:     stop,
-		results:  results,
-		interval: interval,
+		in:          in,
+		ctx:         ctx,
+		cancel:      cancel,
+		results:     results,
+		interval:    interval,
+		percentiles: percentiles,
+		buckets:     sortedBuckets,
+		clocks:      NewClockEstimator(DefaultClockFilterSize),
 	}
 	return summarizer
 }
@@ -205,16 +294,7 @@ func CalcRTT(results []*Result, summary *Summary) {
 	if len(results) == 0 {
 		return
 	}
-	var values []float64
-	// Extract the RTT values and convert
-	for _, r := range results {
-		// If lost, don't include it
-		if r.Lost {
-			continue
-		}
-		// Also converting to milliseconds here
-		values = append(values, NsToMs(float64(r.RTT)))
-	}
+	values := rttValues(results)
 
 	// If no tests actually completed, just end here
 	if len(values) == 0 {
@@ -247,18 +327,220 @@ func CalcRTT(results []*Result, summary *Summary) {
 	summary.RTTMax = max
 }
 
-// CalcCounts will calculate the Sent and Lost counts on the provided summary,
-// based on the provided results.
+// CalcPercentiles will calculate the RTT at each of the provided percentile
+// ranks (out of 100) for the provided summary, based on the provided results.
+//
+// Values are linearly interpolated between the closest ranks, so p50 of an
+// even number of results is the mean of the middle two.
+func CalcPercentiles(results []*Result, summary *Summary, percentiles []float64) {
+	values := rttValues(results)
+	// Like CalcRTT, leave these empty if nothing completed
+	if len(values) == 0 || len(percentiles) == 0 {
+		return
+	}
+	sort.Float64s(values)
+	summary.RTTPercentiles = make([]Percentile, 0, len(percentiles))
+	for _, p := range percentiles {
+		summary.RTTPercentiles = append(summary.RTTPercentiles, Percentile{
+			P:     p,
+			Value: percentile(values, p),
+		})
+	}
+}
+
+// percentile returns the value at rank p (out of 100) from the sorted values
+// using linear interpolation. values must not be empty.
+func percentile(sorted []float64, p float64) float64 {
+	// Clamp so a bad rank can't index outside of the slice
+	p = math.Max(0, math.Min(100, p))
+	rank := (p / 100.0) * float64(len(sorted)-1)
+	lo := int(math.Floor(rank))
+	hi := int(math.Ceil(rank))
+	return sorted[lo] + (sorted[hi]-sorted[lo])*(rank-float64(lo))
+}
+
+// CalcHistogram will calculate the cumulative RTT distribution for the
+// provided summary, based on the provided results and bucket upper bounds.
+//
+// `buckets` must be sorted in ascending order. Probes with an RTT above the
+// last bucket are only accounted for in the total of completed probes
+// (Sent - Lost), which acts as the implicit +Inf bucket.
+func CalcHistogram(results []*Result, summary *Summary, buckets []float64) {
+	if len(buckets) == 0 {
+		return
+	}
+	summary.RTTHistogram = make([]HistogramBucket, len(buckets))
+	for i, le := range buckets {
+		summary.RTTHistogram[i].Le = le
+	}
+	for _, v := range rttValues(results) {
+		// Find the first bucket this fits in, and count it in every one after
+		first := sort.SearchFloat64s(buckets, v)
+		for i := first; i < len(buckets); i++ {
+			summary.RTTHistogram[i].Count++
+		}
+	}
+}
+
+// CalcJitter will calculate the interarrival jitter and IPDV (IP packet delay
+// variation) values for the provided summary, based on the provided results.
+//
+// Since there isn't a one-way transit time available, RTT is used in its place
+// and both reflect the variation across the full round trip. Consecutive
+// probes are determined by the order in which they were received (Done), so
+// lost probes are skipped. At least two completed probes are required.
+func CalcJitter(results []*Result, summary *Summary) {
+	received := receivedInOrder(results)
+	if len(received) < 2 {
+		return
+	}
+	jitter := 0.0
+	total := 0.0
+	max := 0.0
+	for i := 1; i < len(received); i++ {
+		delta := math.Abs(NsToMs(float64(received[i].RTT)) -
+			NsToMs(float64(received[i-1].RTT)))
+		// RFC 3550 section 6.4.1: J(i) = J(i-1) + (|D(i-1,i)| - J(i-1))/16
+		jitter += (delta - jitter) / 16.0
+		total += delta
+		if delta > max {
+			max = delta
+		}
+	}
+	summary.Jitter = jitter
+	summary.IPDVMean = total / float64(len(received)-1)
+	summary.IPDVMax = max
+}
+
+// CalcReordering will calculate the reordering values for the provided
+// summary, based on the provided results.
+//
+// Sequence numbers are only comparable between probes from the same source
+// port to the same destination port, so each of those is evaluated on its own.
+// A probe is considered reordered if it's received after one with a higher
+// sequence number, and its extent is how far behind the highest it was.
+func CalcReordering(results []*Result, summary *Summary) {
+	type stream struct{ src, dst int }
+	highest := make(map[stream]uint64)
+	for _, r := range receivedInOrder(results) {
+		// Zero means no sequence number was provided
+		if r.Seq == 0 {
+			continue
+		}
+		key := stream{r.Pd.SrcPort, r.Pd.DstPort}
+		if r.Seq > highest[key] {
+			highest[key] = r.Seq
+			continue
+		}
+		summary.Reordered++
+		if extent := highest[key] - r.Seq; extent > summary.ReorderExtent {
+			summary.ReorderExtent = extent
+		}
+	}
+}
+
+// CalcOneWay will calculate the average forward delay, reverse delay, and
+// reflector dwell for the provided summary, based on the provided results.
+//
+// Only results with reflector timestamps are included. If there are none, the
+// values are left as zero, like CalcRTT.
+func CalcOneWay(results []*Result, summary *Summary) {
+	var fwd, rev, dwell float64
+	count := 0
+	for _, r := range results {
+		if !r.OneWay || r.Lost || r.Duplicate {
+			continue
+		}
+		fwd += NsToMs(float64(r.FwdDelay))
+		rev += NsToMs(float64(r.RevDelay))
+		dwell += NsToMs(float64(r.Dwell))
+		count++
+	}
+	if count == 0 {
+		return
+	}
+	summary.FwdDelayAvg = fwd / float64(count)
+	summary.RevDelayAvg = rev / float64(count)
+	summary.DwellAvg = dwell / float64(count)
+}
+
+// CalcClockOffset will estimate the reflector's clock offset for the provided
+// summary using the provided ClockEstimator, and then use it to correct the
+// forward and reverse delays.
+//
+// CalcOneWay should be called before this, otherwise there's nothing to
+// correct. The estimate carries over between summarizations for the same
+// path, so the correction improves as more samples are seen.
+func CalcClockOffset(results []*Result, summary *Summary, ce *ClockEstimator) {
+	if ce == nil || summary.Pd == nil {
+		return
+	}
+	key := fmt.Sprintf("src_%v->dst_%v:%v->tos_%v", summary.Pd.SrcIP,
+		summary.Pd.DstIP, summary.Pd.DstPort, summary.Tos)
+	est, ok := ce.Update(key, results)
+	if !ok {
+		// No reflector timestamps, so nothing to estimate or correct
+		return
+	}
+	summary.ClockOffset = est.Offset
+	summary.ClockOffsetErr = est.Uncertainty
+	// A reflector clock that is ahead inflates the forward delay and deflates
+	// the reverse delay by the same amount.
+	summary.FwdDelayAvg -= est.Offset
+	summary.RevDelayAvg += est.Offset
+}
+
+// receivedInOrder returns the results that completed, without duplicates,
+// in the order they were received.
+func receivedInOrder(results []*Result) []*Result {
+	var received []*Result
+	for _, r := range results {
+		if !r.Lost && !r.Duplicate {
+			received = append(received, r)
+		}
+	}
+	sort.Slice(received, func(i, j int) bool {
+		return received[i].Done < received[j].Done
+	})
+	return received
+}
+
+// rttValues extracts the RTT, in milliseconds, of all results that weren't
+// lost or duplicates.
+func rttValues(results []*Result) []float64 {
+	var values []float64
+	for _, r := range results {
+		// If lost, don't include it
+		if r.Lost || r.Duplicate {
+			continue
+		}
+		// Also converting to milliseconds here
+		values = append(values, NsToMs(float64(r.RTT)))
+	}
+	return values
+}
+
+// CalcCounts will calculate the Sent, Lost, and Duplicates counts on the
+// provided summary, based on the provided results.
 func CalcCounts(results []*Result, summary *Summary) {
 	// These opt are safe for an empty slice, so avoiding extra logic
-	summary.Sent = len(results)
+	sent := 0
 	lost := 0
+	dups := 0
 	for _, r := range results {
+		// Duplicates weren't sent separately, so only count them on their own
+		if r.Duplicate {
+			dups++
+			continue
+		}
+		sent++
 		if r.Lost {
 			lost++
 		}
 	}
+	summary.Sent = sent
 	summary.Lost = lost
+	summary.Duplicates = dups
 }
 
 // CalcLoss will calculate the Loss percentage (out of 1) based on the Sent
@@ -272,6 +554,7 @@ func CalcLoss(summary *Summary) {
 		// marshaller, treat as zero, or make it a pointer so we get nil.
 		// Doing zero for now, as there's technically no loss.
 		summary.Loss = 0
+		return
 	}
 	// TODO(nwinemiller): Following the existing pattern by converting this to
 	//      percent out of 100 instead of 1. It's just extra math, but not
@@ -1,25 +1,34 @@
 package udprobe
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"math"
+	"net"
 	"testing"
 	"time"
 )
 
 func TestWaitToSummarize(t *testing.T) {
 	// Could do a bit more testing with some mocking
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel() // Cancel immediately so we exit
 	s := Summarizer{
-		stop:     make(chan bool),
-		interval: time.Nanosecond,
+		ctx:      ctx,
+		interval: time.Hour,
 	}
-	close(s.stop) // Close the channel immediately so we exit
-	s.waitToSummarize()
-	// Make sure the ticker got created
-	if s.ticker == nil {
-		t.Error("Ticker wasn't created")
+	done := make(chan bool)
+	go func() {
+		s.waitToSummarize()
+		close(done)
+	}()
+	// Shouldn't wait for the first interval once stopped
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("waitToSummarize didn't exit once stopped")
 	}
-	s.ticker.Stop() // Stop the ticker
 }
 
 func TestSummarize(t *testing.T) {
@@ -37,7 +46,7 @@ func TestSummarize(t *testing.T) {
 }
 
 func TestSummarizeSet(t *testing.T) {
-	s := Summarizer{}
+	s := Summarizer{percentiles: []float64{50}, buckets: []float64{1, 2}}
 	// Create some fake results
 	key := "test"
 	s.results = make(map[string][]*Result)
@@ -69,12 +78,34 @@ func TestSummarizeSet(t *testing.T) {
 	if summary.Loss != expectedLoss {
 		t.Error("Loss bad. Got", summary.Loss, "expected", expectedLoss)
 	}
-	// NOTE(nwinemiller): Keeping, because this code is still there but commented out.
-	//      However, we aren't setting this anymore, and explicitly leaving it
-	//      as zero.
-	// if summary.TS.IsZero() {
-	// 	t.Error("Summary TS was not initialized")
-	// }
+	if len(summary.RTTPercentiles) != 1 || summary.RTTPercentiles[0].Value != 2.0 {
+		t.Error("RTTPercentiles bad. Got", summary.RTTPercentiles, "expected p50 of 2.0")
+	}
+	if len(summary.RTTHistogram) != 2 || summary.RTTHistogram[0].Count != 1 ||
+		summary.RTTHistogram[1].Count != 1 {
+		t.Error("RTTHistogram bad. Got", summary.RTTHistogram)
+	}
+	// TS is set by summarize, the same for all of the summaries, see
+	// TestSummarizeSinks.
+}
+
+func TestSummarizeSetDuplicates(t *testing.T) {
+	s := Summarizer{percentiles: []float64{50}, buckets: []float64{1, 2}}
+	// Only duplicates of probes from the previous interval
+	summary := s.summarizeSet([]*Result{
+		{RTT: 1000000, Duplicate: true},
+		{RTT: 2000000, Duplicate: true},
+	})
+	if summary.Sent != 0 || summary.Duplicates != 2 {
+		t.Error("Counts bad. Got", summary.Sent, summary.Duplicates,
+			"expected", 0, 2)
+	}
+	if summary.Loss != 0 {
+		t.Error("Loss bad. Got", summary.Loss, "expected", 0)
+	}
+	if _, err := json.Marshal(summary); err != nil {
+		t.Error("Summary can't be encoded:", err)
+	}
 }
 
 func TestStore(t *testing.T) {
@@ -101,17 +132,13 @@ func TestAddResult(t *testing.T) {
 }
 
 func TestSummarizerStop(t *testing.T) {
-	s := Summarizer{
-		stop:   make(chan bool),
-		ticker: time.NewTicker(time.Nanosecond),
-	}
-	// Stop things
+	s := NewSummarizer(context.Background(), make(chan *Result), time.Hour,
+		nil, nil)
+	s.Run()
+	// Stop things, which waits for all of the goroutines to exit
 	s.Stop()
-	// The ticker should be stopped as well, but there's no good way to verify
-	// Make sure the stop channel is closed
-	select {
-	case <-s.stop:
-	default:
+	// Make sure the context is cancelled
+	if s.ctx.Err() == nil {
 		t.Error("Stop didn't actually stop")
 	}
 }
@@ -119,11 +146,18 @@ func TestSummarizerStop(t *testing.T) {
 func TestNewSummarizer(t *testing.T) {
 	// Just make sure we can create one
 	summarizer := NewSummarizer(
+		context.Background(),
 		make(chan *Result),
 		time.Second,
+		DefaultPercentiles,
+		[]float64{10, 1, 5},
 	)
 	if summarizer == nil {
-		t.Error("Was unable to create a Summarizer")
+		t.Fatal("Was unable to create a Summarizer")
+	}
+	// Buckets should have been sorted
+	if summarizer.buckets[0] != 1 || summarizer.buckets[2] != 10 {
+		t.Error("Buckets weren't sorted. Got", summarizer.buckets)
 	}
 }
 
@@ -163,6 +197,173 @@ func TestCalcRTT(t *testing.T) {
 	}
 }
 
+func TestCalcPercentiles(t *testing.T) {
+	summary := &Summary{}
+	var results []*Result
+	// Nothing completed, so nothing to calculate
+	results = append(results, &Result{Lost: true})
+	CalcPercentiles(results, summary, DefaultPercentiles)
+	if summary.RTTPercentiles != nil {
+		t.Error("Expected no percentiles after total loss. Got", summary.RTTPercentiles)
+	}
+	// 1ms through 10ms, out of order to make sure they get sorted
+	summary = &Summary{}
+	results = results[:0]
+	for _, ms := range []uint64{10, 3, 1, 2, 5, 4, 9, 6, 8, 7} {
+		results = append(results, &Result{RTT: ms * 1000000})
+	}
+	results = append(results, &Result{Lost: true})
+	CalcPercentiles(results, summary, []float64{0, 50, 90, 100})
+	expected := []float64{1.0, 5.5, 9.1, 10.0}
+	if len(summary.RTTPercentiles) != len(expected) {
+		t.Fatal("Expected", len(expected), "percentiles, got", len(summary.RTTPercentiles))
+	}
+	for i, e := range expected {
+		if math.Abs(summary.RTTPercentiles[i].Value-e) > 1e-9 {
+			t.Error("Percentile", summary.RTTPercentiles[i].P, "bad. Got",
+				summary.RTTPercentiles[i].Value, "expected", e)
+		}
+	}
+}
+
+func TestCalcHistogram(t *testing.T) {
+	summary := &Summary{}
+	var results []*Result
+	// No buckets, no histogram
+	CalcHistogram(results, summary, nil)
+	if summary.RTTHistogram != nil {
+		t.Error("Expected no histogram without buckets. Got", summary.RTTHistogram)
+	}
+	// Buckets are still populated even if everything was lost
+	results = append(results, &Result{Lost: true})
+	CalcHistogram(results, summary, []float64{1, 5})
+	if len(summary.RTTHistogram) != 2 || summary.RTTHistogram[1].Count != 0 {
+		t.Error("Expected empty buckets after total loss. Got", summary.RTTHistogram)
+	}
+	// Values on a boundary belong to that bucket, and above the last are
+	// left out.
+	summary = &Summary{}
+	for _, ms := range []uint64{1, 2, 5, 20} {
+		results = append(results, &Result{RTT: ms * 1000000})
+	}
+	CalcHistogram(results, summary, []float64{1, 5, 10})
+	expected := []int{1, 3, 3}
+	for i, e := range expected {
+		if summary.RTTHistogram[i].Count != e {
+			t.Error("Bucket", summary.RTTHistogram[i].Le, "bad. Got",
+				summary.RTTHistogram[i].Count, "expected", e)
+		}
+	}
+}
+
+func TestCalcJitter(t *testing.T) {
+	summary := &Summary{}
+	var results []*Result
+	// A single completed probe has nothing to compare against
+	results = append(results, &Result{RTT: 1000000, Done: 1})
+	results = append(results, &Result{Lost: true})
+	CalcJitter(results, summary)
+	if summary.Jitter != 0.0 || summary.IPDVMean != 0.0 || summary.IPDVMax != 0.0 {
+		t.Error("Expected zero values with a single completed probe. Got",
+			summary.Jitter, summary.IPDVMean, summary.IPDVMax)
+	}
+	// Provided out of order, so Done determines the sequence: 1ms, 3ms, 2ms
+	summary = &Summary{}
+	results = results[:0]
+	results = append(results, &Result{RTT: 2000000, Done: 30})
+	results = append(results, &Result{RTT: 1000000, Done: 10})
+	results = append(results, &Result{Lost: true})
+	results = append(results, &Result{RTT: 3000000, Done: 20})
+	CalcJitter(results, summary)
+	// Deltas of 2ms then 1ms
+	expectedJitter := 2.0 / 16.0
+	expectedJitter += (1.0 - expectedJitter) / 16.0
+	if math.Abs(summary.Jitter-expectedJitter) > 1e-9 {
+		t.Error("Jitter bad. Got", summary.Jitter, "expected", expectedJitter)
+	}
+	if summary.IPDVMean != 1.5 {
+		t.Error("IPDVMean bad. Got", summary.IPDVMean, "expected", 1.5)
+	}
+	if summary.IPDVMax != 2.0 {
+		t.Error("IPDVMax bad. Got", summary.IPDVMax, "expected", 2.0)
+	}
+}
+
+func TestCalcReordering(t *testing.T) {
+	portA := &PathDist{SrcPort: 1000, DstPort: 8100}
+	portB := &PathDist{SrcPort: 2000, DstPort: 8100}
+	summary := &Summary{}
+	var results []*Result
+	// In order on each port, even though the ports are interleaved
+	results = append(results, &Result{Pd: portA, Seq: 1, Done: 1})
+	results = append(results, &Result{Pd: portB, Seq: 5, Done: 2})
+	results = append(results, &Result{Pd: portA, Seq: 2, Done: 3})
+	results = append(results, &Result{Pd: portB, Seq: 6, Done: 4})
+	CalcReordering(results, summary)
+	if summary.Reordered != 0 || summary.ReorderExtent != 0 {
+		t.Error("Expected no reordering. Got", summary.Reordered, summary.ReorderExtent)
+	}
+	// Port A receives 1, 4, 2, 3, 5 with a lost and duplicate probe mixed in
+	summary = &Summary{}
+	results = results[:0]
+	results = append(results, &Result{Pd: portA, Seq: 1, Done: 1})
+	results = append(results, &Result{Pd: portA, Seq: 4, Done: 2})
+	results = append(results, &Result{Pd: portA, Seq: 2, Done: 3})
+	results = append(results, &Result{Pd: portA, Seq: 1, Done: 4, Duplicate: true})
+	results = append(results, &Result{Pd: portA, Seq: 3, Done: 5})
+	results = append(results, &Result{Pd: portA, Seq: 6, Lost: true})
+	results = append(results, &Result{Pd: portA, Seq: 5, Done: 6})
+	CalcReordering(results, summary)
+	if summary.Reordered != 2 {
+		t.Error("Expected 2 reordered, got", summary.Reordered)
+	}
+	if summary.ReorderExtent != 2 {
+		t.Error("Expected reorder extent of 2, got", summary.ReorderExtent)
+	}
+}
+
+func TestCalcOneWay(t *testing.T) {
+	summary := &Summary{}
+	var results []*Result
+	results = append(results, &Result{OneWay: true, FwdDelay: 1000000, RevDelay: 3000000, Dwell: 100000})
+	results = append(results, &Result{OneWay: true, FwdDelay: -1000000, RevDelay: 5000000, Dwell: 300000})
+	// None of these should be included
+	results = append(results, &Result{RTT: 5000000})
+	results = append(results, &Result{Lost: true})
+	results = append(results, &Result{OneWay: true, Duplicate: true, FwdDelay: 9000000})
+	CalcOneWay(results, summary)
+	if summary.FwdDelayAvg != 0.0 {
+		t.Error("FwdDelayAvg bad. Got", summary.FwdDelayAvg, "expected", 0.0)
+	}
+	if summary.RevDelayAvg != 4.0 {
+		t.Error("RevDelayAvg bad. Got", summary.RevDelayAvg, "expected", 4.0)
+	}
+	if math.Abs(summary.DwellAvg-0.2) > 1e-9 {
+		t.Error("DwellAvg bad. Got", summary.DwellAvg, "expected", 0.2)
+	}
+}
+
+func TestCalcClockOffset(t *testing.T) {
+	ce := NewClockEstimator(DefaultClockFilterSize)
+	summary := &Summary{Pd: &PathDist{DstIP: net.ParseIP("1.2.3.4")}}
+	// Reflector 2ms ahead with a symmetric 1ms each way
+	results := []*Result{{OneWay: true, FwdDelay: 3000000, RevDelay: -1000000}}
+	CalcOneWay(results, summary)
+	CalcClockOffset(results, summary, ce)
+	if summary.ClockOffset != 2.0 || summary.ClockOffsetErr != 1.0 {
+		t.Error("Clock offset bad. Got", summary.ClockOffset, summary.ClockOffsetErr)
+	}
+	if summary.FwdDelayAvg != 1.0 || summary.RevDelayAvg != 1.0 {
+		t.Error("Delays not corrected. Got", summary.FwdDelayAvg, summary.RevDelayAvg)
+	}
+	// Nothing to correct without reflector timestamps
+	summary = &Summary{Pd: &PathDist{DstIP: net.ParseIP("1.2.3.4")}}
+	CalcClockOffset([]*Result{{RTT: 1000000}}, summary, ce)
+	if summary.ClockOffset != 0.0 || summary.FwdDelayAvg != 0.0 {
+		t.Error("Unexpected correction without reflector timestamps. Got", summary.ClockOffset)
+	}
+}
+
 func TestCalcCounts(t *testing.T) {
 	// These are generally handled under TestSummarizeSet, so add more specific
 	// tests and corner cases here.
@@ -203,6 +404,22 @@ func TestCalcCounts(t *testing.T) {
 	if summary.Lost != 4 {
 		t.Error("Expected lost to be 4, got ", summary.Lost)
 	}
+	// Duplicates are counted on their own
+	summary = &Summary{}
+	results = results[:0]
+	results = append(results, &Result{})
+	results = append(results, &Result{Duplicate: true})
+	results = append(results, &Result{Lost: true})
+	CalcCounts(results, summary)
+	if summary.Sent != 2 {
+		t.Error("Expected sent to be 2, got ", summary.Sent)
+	}
+	if summary.Lost != 1 {
+		t.Error("Expected lost to be 1, got ", summary.Lost)
+	}
+	if summary.Duplicates != 1 {
+		t.Error("Expected duplicates to be 1, got ", summary.Duplicates)
+	}
 }
 
 func TestCalcLoss(t *testing.T) {
@@ -214,11 +431,11 @@ func TestCalcLoss(t *testing.T) {
 	if s.Loss != expected {
 		t.Error("Loss calculation incorrect. Expected", expected, "but got", s.Loss)
 	}
-	// Empty set
+	// Empty set, which can't be NaN as that can't be encoded as JSON
 	s = &Summary{}
 	CalcLoss(s)
-	if math.IsNaN(s.Loss) != true {
-		t.Error("Loss should be NaN if none sent. Got ", s.Loss)
+	if s.Loss != 0 {
+		t.Error("Loss should be 0 if none sent. Got ", s.Loss)
 	}
 	// No loss
 	s = &Summary{Sent: 5}
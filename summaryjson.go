@@ -0,0 +1,155 @@
+package udprobe
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+)
+
+// SummaryJSON is a Summary as served by the API, with the tags of its
+// destination. Times are all in milliseconds.
+type SummaryJSON struct {
+	SrcIP          string                `json:"src_ip"`
+	SrcPort        int                   `json:"src_port"`
+	DstIP          string                `json:"dst_ip"`
+	DstPort        int                   `json:"dst_port"`
+	Proto          string                `json:"proto"`
+	Tos            byte                  `json:"tos"`
+	Tags           Tags                  `json:"tags"`
+	RTTAvg         float64               `json:"rtt_avg"`
+	RTTMin         float64               `json:"rtt_min"`
+	RTTMax         float64               `json:"rtt_max"`
+	RTTPercentiles []PercentileJSON      `json:"rtt_percentiles"`
+	RTTHistogram   []HistogramBucketJSON `json:"rtt_histogram"`
+	Jitter         float64               `json:"jitter"`
+	IPDVMean       float64               `json:"ipdv_mean"`
+	IPDVMax        float64               `json:"ipdv_max"`
+	FwdDelayAvg    float64               `json:"fwd_delay_avg"`
+	RevDelayAvg    float64               `json:"rev_delay_avg"`
+	DwellAvg       float64               `json:"dwell_avg"`
+	ClockOffset    float64               `json:"clock_offset"`
+	ClockOffsetErr float64               `json:"clock_offset_err"`
+	Sent           int                   `json:"sent"`
+	Lost           int                   `json:"lost"`
+	Loss           float64               `json:"loss"`
+	Duplicates     int                   `json:"duplicates"`
+	Reordered      int                   `json:"reordered"`
+	ReorderExtent  uint64                `json:"reorder_extent"`
+}
+
+// PercentileJSON is a Percentile as served by the API.
+type PercentileJSON struct {
+	P     float64 `json:"p"`
+	Value float64 `json:"value"`
+}
+
+// HistogramBucketJSON is a HistogramBucket as served by the API.
+type HistogramBucketJSON struct {
+	Le    float64 `json:"le"`
+	Count int     `json:"count"`
+}
+
+// NewSummaryJSON converts the summary, and a copy of the tags for its
+// destination, into a SummaryJSON.
+func NewSummaryJSON(summary *Summary, tags Tags) *SummaryJSON {
+	sj := &SummaryJSON{
+		SrcIP:          summary.Pd.SrcIP.String(),
+		SrcPort:        summary.Pd.SrcPort,
+		DstIP:          summary.Pd.DstIP.String(),
+		DstPort:        summary.Pd.DstPort,
+		Proto:          summary.Pd.Proto,
+		Tos:            summary.Tos,
+		Tags:           make(Tags, len(tags)),
+		RTTAvg:         summary.RTTAvg,
+		RTTMin:         summary.RTTMin,
+		RTTMax:         summary.RTTMax,
+		RTTPercentiles: make([]PercentileJSON, 0, len(summary.RTTPercentiles)),
+		RTTHistogram:   make([]HistogramBucketJSON, 0, len(summary.RTTHistogram)),
+		Jitter:         summary.Jitter,
+		IPDVMean:       summary.IPDVMean,
+		IPDVMax:        summary.IPDVMax,
+		FwdDelayAvg:    summary.FwdDelayAvg,
+		RevDelayAvg:    summary.RevDelayAvg,
+		DwellAvg:       summary.DwellAvg,
+		ClockOffset:    summary.ClockOffset,
+		ClockOffsetErr: summary.ClockOffsetErr,
+		Sent:           summary.Sent,
+		Lost:           summary.Lost,
+		Loss:           summary.Loss,
+		Duplicates:     summary.Duplicates,
+		Reordered:      summary.Reordered,
+		ReorderExtent:  summary.ReorderExtent,
+	}
+	for k, v := range tags {
+		sj.Tags[k] = v
+	}
+	for _, p := range summary.RTTPercentiles {
+		sj.RTTPercentiles = append(sj.RTTPercentiles, PercentileJSON(p))
+	}
+	for _, b := range summary.RTTHistogram {
+		sj.RTTHistogram = append(sj.RTTHistogram, HistogramBucketJSON(b))
+	}
+	return sj
+}
+
+// SummaryFilter picks which summaries are served by the API. Empty fields
+// match everything.
+type SummaryFilter struct {
+	SrcIP net.IP
+	DstIP net.IP
+	Tos   *byte
+	Tags  Tags // Every one must match the tags of the destination
+}
+
+// ParseSummaryFilter parses a SummaryFilter from URL query values.
+// "src_ip", "dst_ip" and "tos" match the fields of the summary, and any other
+// key matches the tag with that name, as in "?dst_hostname=reflector-1".
+func ParseSummaryFilter(query url.Values) (*SummaryFilter, error) {
+	filter := &SummaryFilter{Tags: make(Tags)}
+	for key := range query {
+		value := query.Get(key)
+		switch key {
+		case "src_ip", "dst_ip":
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid %s %q", key, value)
+			}
+			if key == "src_ip" {
+				filter.SrcIP = ip
+			} else {
+				filter.DstIP = ip
+			}
+		case "tos":
+			tos, err := strconv.ParseUint(value, 10, 8)
+			if err != nil {
+				return nil, fmt.Errorf("invalid tos %q", value)
+			}
+			b := byte(tos)
+			filter.Tos = &b
+		default:
+			filter.Tags[key] = value
+		}
+	}
+	return filter, nil
+}
+
+// Matches reports if the summary, with the tags of its destination, matches
+// the filter.
+func (f *SummaryFilter) Matches(summary *Summary, tags Tags) bool {
+	if f.SrcIP != nil && !f.SrcIP.Equal(summary.Pd.SrcIP) {
+		return false
+	}
+	if f.DstIP != nil && !f.DstIP.Equal(summary.Pd.DstIP) {
+		return false
+	}
+	if f.Tos != nil && *f.Tos != summary.Tos {
+		return false
+	}
+	for k, v := range f.Tags {
+		if tags[k] != v {
+			return false
+		}
+	}
+	return true
+}
@@ -2,6 +2,7 @@ package udprobe
 
 import (
 	"context"
+	"fmt"
 	"golang.org/x/time/rate"
 	"net"
 	"sync"
@@ -14,7 +15,10 @@ type TestRunner struct {
 	pg      *PortGroup
 	tosend  chan *net.UDPAddr
 	rl      *rate.Limiter
-	stop    chan bool
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	errs    chan error
 	mutex   sync.RWMutex
 	targets []*net.UDPAddr
 }
@@ -22,7 +26,11 @@ type TestRunner struct {
 // Run starts the TestRunner and begins cycling through targets.
 func (tr *TestRunner) Run() {
 	tr.pg.Run() // Start running the PortGroup and underlying Ports in goroutines
-	go tr.run()
+	tr.wg.Add(1)
+	go func() {
+		defer tr.wg.Done()
+		tr.run()
+	}()
 }
 
 func (tr *TestRunner) run() {
@@ -33,8 +41,14 @@ func (tr *TestRunner) run() {
 		}
 		// Check if we can actually start first
 		// If over the rate limit, this will block until permitted
-		err := tr.rl.Wait(context.Background())
-		HandleError(err)
+		err := tr.rl.Wait(tr.ctx)
+		if err != nil {
+			// Stopping cancels the wait, which isn't a problem
+			if !tr.isStopped() {
+				reportError(tr.errs, fmt.Errorf("test runner stopped: %w", err))
+			}
+			return
+		}
 		// Since we may have been throttled, and possibly stopped in the
 		// meantime, check again.
 		if tr.isStopped() {
@@ -62,7 +76,11 @@ func (tr *TestRunner) cycleTargets() {
 		//      down can't keep up. Leaving it that way for now, however
 		//      it may be desirable to allow some kind of "out" in the
 		//      future.
-		tr.tosend <- target
+		select {
+		case tr.tosend <- target:
+		case <-tr.ctx.Done():
+			return
+		}
 	}
 	// Cycle is complete here.
 	// TODO(nwinemiller): This really is just referring to the ability to pass
@@ -71,23 +89,18 @@ func (tr *TestRunner) cycleTargets() {
 	//      to send.
 }
 
-// Stop will stop the TestRunner after the current cycle and any underlying
-// PortGroup and Port(s).
+// Stop will stop the TestRunner and any underlying PortGroup and Port(s),
+// waiting until they've all exited and closed their sockets.
 func (tr *TestRunner) Stop() {
 	LogInfo("Initiating Stop in TestRunner")
-	close(tr.stop)
-	// Release the portgroup
-	tr.pg = nil
+	tr.cancel()
+	tr.wg.Wait()
+	tr.pg.Stop()
 }
 
 // isStopped evaluates if the TestRunner has been stopped.
 func (tr *TestRunner) isStopped() bool {
-	select {
-	case <-tr.stop:
-		return true
-	default:
-		return false
-	}
+	return tr.ctx.Err() != nil
 }
 
 // Add will add a variable number of addrs to the slice of targets for
@@ -133,6 +146,19 @@ func (tr *TestRunner) Set(targets []*net.UDPAddr) {
 	tr.mutex.Lock()
 	tr.targets = targets
 	defer tr.mutex.Unlock()
+	// Ports can't be added once running, so this is safe without locking
+	tr.pg.SetTargets(targets)
+}
+
+// BindsAny reports if any of the TestRunner's Ports are bound to one of the
+// source ports.
+func (tr *TestRunner) BindsAny(ports map[int]bool) bool {
+	for p := range tr.pg.ports {
+		if addr, ok := p.conn.LocalAddr().(*net.UDPAddr); ok && ports[addr.Port] {
+			return true
+		}
+	}
+	return false
 }
 
 // AddNewPort will add a new Port to the TestRunner's PortGroup.
@@ -141,32 +167,42 @@ func (tr *TestRunner) Set(targets []*net.UDPAddr) {
 //
 // NOTE: This is basically just a passthrough for PortGroup.AddNew until
 //       the pattern is better understood and this can be cleaned up.
-func (tr *TestRunner) AddNewPort(portStr string, tos byte,
+func (tr *TestRunner) AddNewPort(network string, portStr string, tos byte,
 	cTimeout time.Duration,
 	cCleanRate time.Duration,
-	readTimeout time.Duration) {
+	readTimeout time.Duration,
+	tsMode TimestampMode,
+	batch int) error {
 	// TODO(nwinemiller): This must not be running already. Add enforcement.
-	tr.pg.AddNew(portStr, tos, cTimeout, cCleanRate, readTimeout)
+	_, _, err := tr.pg.AddNew(network, portStr, tos, cTimeout, cCleanRate,
+		readTimeout, tsMode, batch)
+	return err
 }
 
 // New creates and returns a new TestRunner instance.
 //
+// `ctx` being done stops the TestRunner, the same as Stop.
 // `cbc` is a channel for accepting completed Probes.
+// `errs` is a channel for reporting errors that stop the TestRunner, or any
+// of its Ports, from running. It may be nil, in which case they're only logged.
 // `rl` is a rate limiter which is used to throttle the number of cycles that
 // may be completed per second.
-func NewTestRunner(cbc chan *InFlightProbe, rl *rate.Limiter) *TestRunner {
+func NewTestRunner(ctx context.Context, cbc chan *InFlightProbe,
+	errs chan error, rl *rate.Limiter) *TestRunner {
 	// TODO(nwinemiller): What about providing this on creation? Perhaps an option at
 	//      some point, but just use Set for now.
 	//targets := make([]*net.UDPAddr)
 	var targets []*net.UDPAddr
 	tosend := make(chan *net.UDPAddr)
-	stop := make(chan bool)
-	pg := NewPortGroup(stop, cbc, tosend)
+	ctx, cancel := context.WithCancel(ctx)
+	pg := NewPortGroup(ctx, cbc, errs, tosend)
 	tr := TestRunner{
 		pg:      pg,
 		tosend:  tosend,
 		rl:      rl,
-		stop:    stop,
+		ctx:     ctx,
+		cancel:  cancel,
+		errs:    errs,
 		targets: targets,
 	}
 	return &tr
@@ -1,6 +1,7 @@
 package udprobe
 
 import (
+	"context"
 	"golang.org/x/time/rate"
 	"net"
 	"testing"
@@ -14,7 +15,7 @@ func TestTestRunnerRun(t *testing.T) {
 }
 
 func TestTestRunnerStop(t *testing.T) {
-	tr := NewTestRunner(exampleCallbackChan, rate.NewLimiter(rate.Inf, 0))
+	tr := NewTestRunner(context.Background(), exampleCallbackChan, nil, rate.NewLimiter(rate.Inf, 0))
 	tr.Run()
 	tr.Stop()
 	if tr.isStopped() != true {
@@ -23,7 +24,7 @@ func TestTestRunnerStop(t *testing.T) {
 }
 
 func TestAddAndDel(t *testing.T) {
-	tr := NewTestRunner(exampleCallbackChan, rate.NewLimiter(rate.Inf, 0))
+	tr := NewTestRunner(context.Background(), exampleCallbackChan, nil, rate.NewLimiter(rate.Inf, 0))
 	target, err := net.ResolveUDPAddr("udp", DefaultAddrStr)
 	HandleError(err)
 	if len(tr.targets) != 0 {
@@ -45,7 +46,7 @@ func TestAddAndDel(t *testing.T) {
 }
 
 func TestSet(t *testing.T) {
-	tr := NewTestRunner(exampleCallbackChan, rate.NewLimiter(rate.Inf, 0))
+	tr := NewTestRunner(context.Background(), exampleCallbackChan, nil, rate.NewLimiter(rate.Inf, 0))
 	target, err := net.ResolveUDPAddr("udp", DefaultAddrStr)
 	HandleError(err)
 	targets := []*net.UDPAddr{target, target, target}
@@ -62,19 +63,25 @@ func TestSet(t *testing.T) {
 
 func TestAddNewPort(t *testing.T) {
 	// This is all generally tested as part of PortGroup already
-	tr := NewTestRunner(exampleCallbackChan, rate.NewLimiter(rate.Inf, 0))
-	tr.AddNewPort(
+	tr := NewTestRunner(context.Background(), exampleCallbackChan, nil, rate.NewLimiter(rate.Inf, 0))
+	err := tr.AddNewPort(
+		DefaultNetwork,
 		DefaultAddrStr,
 		DefaultTos,
 		DefaultCacheTimeout,
 		DefaultCacheCleanRate,
 		DefaultReadTimeout,
+		DefaultTimestampMode,
+		1,
 	)
+	if err != nil {
+		t.Error("Failed to add new port:", err)
+	}
 }
 
 func TestNewTestRunner(t *testing.T) {
 	// Just test creating one
-	tr := NewTestRunner(exampleCallbackChan, rate.NewLimiter(rate.Inf, 0))
+	tr := NewTestRunner(context.Background(), exampleCallbackChan, nil, rate.NewLimiter(rate.Inf, 0))
 	if tr == nil {
 		t.Error("New failed to create a TestRunner")
 	}
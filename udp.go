@@ -1,11 +1,54 @@
 package udprobe
 
 import (
+	"fmt"
 	"net"
+	"unsafe"
 
 	"golang.org/x/sys/unix" // The successor to syscall
 )
 
+// TimestampMode determines where the receive time of a packet comes from.
+type TimestampMode string
+
+const (
+	// TimestampUserspace uses the time a packet was read from the socket,
+	// which includes any delay in scheduling the reading goroutine.
+	TimestampUserspace TimestampMode = "userspace"
+	// TimestampKernel uses the time the kernel received a packet, via
+	// SO_TIMESTAMPNS. Falls back to userspace if it's missing.
+	TimestampKernel TimestampMode = "kernel"
+	// TimestampSoftware uses SO_TIMESTAMPING for software timestamps taken by
+	// the kernel when packets are sent to and received from the driver.
+	TimestampSoftware TimestampMode = "software"
+	// TimestampHardware uses SO_TIMESTAMPING for timestamps taken by the NIC.
+	// The NIC must have hardware timestamping enabled separately. Hardware
+	// timestamps are in the NIC's clock, so they're only used for a probe
+	// if it has them for both sending and receiving, and software timestamps
+	// are used for both otherwise.
+	TimestampHardware TimestampMode = "hardware"
+)
+
+// transmit reports if the mode provides transmit timestamps, which need to
+// be read with TxTimestamps.
+func (mode TimestampMode) transmit() bool {
+	return mode == TimestampSoftware || mode == TimestampHardware
+}
+
+// ParseTimestampMode converts a string, as provided in a config or flag, to a
+// TimestampMode. An empty string provides DefaultTimestampMode.
+func ParseTimestampMode(mode string) (TimestampMode, error) {
+	switch TimestampMode(mode) {
+	case "":
+		return DefaultTimestampMode, nil
+	case TimestampUserspace, TimestampKernel, TimestampSoftware,
+		TimestampHardware:
+		return TimestampMode(mode), nil
+	default:
+		return "", fmt.Errorf("unknown timestamp mode %q", mode)
+	}
+}
+
 // LocalUDPAddr returns the UDPAddr and net for the provided UDPConn.
 //
 // For UDPConn instances, net is generaly 'udp'.
@@ -19,26 +62,81 @@ func LocalUDPAddr(conn *net.UDPConn) (*net.UDPAddr, string, error) {
 	return udpAddr, network, nil
 }
 
+// control runs f with the fd of the unix socket for the provided conn, and
+// returns any error from either.
+//
+// Unlike conn.File(), this doesn't dup the fd, or change it to blocking mode.
+func control(conn *net.UDPConn, f func(fd int) error) error {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var opErr error
+	err = rawConn.Control(func(fd uintptr) {
+		opErr = f(int(fd))
+	})
+	if err != nil {
+		return err
+	}
+	return opErr
+}
+
+// SocketFamily provides the address family (AF_INET or AF_INET6) of the
+// unix socket for the provided conn, and if an AF_INET6 socket is restricted
+// to IPv6 only. Otherwise, AF_INET6 sockets also handle IPv4 traffic.
+func SocketFamily(conn *net.UDPConn) (int, bool, error) {
+	var family, v6only int
+	err := control(conn, func(fd int) error {
+		var err error
+		family, err = unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_DOMAIN)
+		if err != nil || family != unix.AF_INET6 {
+			return err
+		}
+		v6only, err = unix.GetsockoptInt(fd, unix.IPPROTO_IPV6,
+			unix.IPV6_V6ONLY)
+		return err
+	})
+	return family, v6only == 1, err
+}
+
 // SetTos will set the IP_TOS value for the unix socket for the provided conn.
-func SetTos(conn *net.UDPConn, tos byte) {
-	file, err := conn.File()
-	defer FileCloseHandler(file)
-	HandleError(err)
-	err = unix.SetsockoptByte(int(file.Fd()), unix.IPPROTO_IP,
-		unix.IP_TOS, tos)
-	HandleError(err)
-}
-
-// GetTos will get the IP_TOS value for the unix socket for the provided conn.
-func GetTos(conn *net.UDPConn) byte {
-	file, err := conn.File()
-	defer FileCloseHandler(file)
-	HandleError(err)
-	value, err := unix.GetsockoptInt(int(file.Fd()), unix.IPPROTO_IP,
-		unix.IP_TOS)
-	HandleError(err)
+//
+// For IPv6 sockets, IPV6_TCLASS is set as well, so it applies regardless of
+// the IP version of the traffic.
+func SetTos(conn *net.UDPConn, tos byte) error {
+	family, _, err := SocketFamily(conn)
+	if err != nil {
+		return err
+	}
+	return control(conn, func(fd int) error {
+		err := unix.SetsockoptByte(fd, unix.IPPROTO_IP, unix.IP_TOS, tos)
+		if err != nil || family != unix.AF_INET6 {
+			return err
+		}
+		return unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_TCLASS,
+			int(tos))
+	})
+}
+
+// GetTos will get the IP_TOS value for the unix socket for the provided conn,
+// or the IPV6_TCLASS value for IPv6 sockets.
+func GetTos(conn *net.UDPConn) (byte, error) {
+	family, _, err := SocketFamily(conn)
+	if err != nil {
+		return 0, err
+	}
+	level, opt := unix.IPPROTO_IP, unix.IP_TOS
+	if family == unix.AF_INET6 {
+		level, opt = unix.IPPROTO_IPV6, unix.IPV6_TCLASS
+	}
+	var value int
+	err = control(conn, func(fd int) error {
+		var err error
+		value, err = unix.GetsockoptInt(fd, level, opt)
+		return err
+	})
 	// Convert it to a byte and return
-	return byte(value)
+	return byte(value), err
 }
 
 // EnableTimestamps enables kernel receive timestamping of packets on the
@@ -46,11 +144,208 @@ func GetTos(conn *net.UDPConn) byte {
 //
 // The timestamp values can later be extracted in the oob data from
 // Receive.
-func EnableTimestamps(conn *net.UDPConn) {
-	file, err := conn.File()
-	defer FileCloseHandler(file)
-	HandleError(err)
-	err = unix.SetsockoptInt(int(file.Fd()), unix.SOL_SOCKET,
-		unix.SO_TIMESTAMPNS, 1)
-	HandleError(err)
+func EnableTimestamps(conn *net.UDPConn) error {
+	return control(conn, func(fd int) error {
+		return unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_TIMESTAMPNS, 1)
+	})
+}
+
+// EnableTimestamping enables SO_TIMESTAMPING on the provided conn, with
+// hardware timestamps if hardware is set. If tx is set, transmit timestamps
+// are also enabled, and must be read with TxTimestamps to avoid filling up
+// the socket's error queue.
+//
+// Transmit timestamps are identified by a counter, starting at zero, that is
+// incremented for each packet sent after this is called. With hardware, there
+// are separate software and hardware transmit timestamps for each packet, so
+// there's one to fall back to if the other is missing.
+func EnableTimestamping(conn *net.UDPConn, hardware bool, tx bool) error {
+	flags := unix.SOF_TIMESTAMPING_RX_SOFTWARE | unix.SOF_TIMESTAMPING_SOFTWARE
+	if hardware {
+		flags |= unix.SOF_TIMESTAMPING_RX_HARDWARE |
+			unix.SOF_TIMESTAMPING_RAW_HARDWARE
+	}
+	if tx {
+		// Only the timestamp and counter are needed, not the whole packet
+		flags |= unix.SOF_TIMESTAMPING_OPT_ID | unix.SOF_TIMESTAMPING_OPT_TSONLY
+		flags |= unix.SOF_TIMESTAMPING_TX_SOFTWARE
+		if hardware {
+			// Otherwise there's no software one once the NIC takes one
+			flags |= unix.SOF_TIMESTAMPING_TX_HARDWARE |
+				unix.SOF_TIMESTAMPING_OPT_TX_SWHW
+		}
+	}
+	return control(conn, func(fd int) error {
+		return unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_TIMESTAMPING,
+			flags)
+	})
+}
+
+// SetupTimestamps enables whatever timestamping the TimestampMode needs on
+// the provided conn. Transmit timestamps are only enabled if tx is set.
+func SetupTimestamps(conn *net.UDPConn, mode TimestampMode, tx bool) error {
+	switch mode {
+	case TimestampKernel:
+		return EnableTimestamps(conn)
+	case TimestampSoftware:
+		return EnableTimestamping(conn, false, tx)
+	case TimestampHardware:
+		return EnableTimestamping(conn, true, tx)
+	}
+	return nil
+}
+
+// scmTimestamp provides the time, in nanoseconds, from an SCM_TIMESTAMPING
+// control message, either the hardware or the software timestamp.
+func scmTimestamp(data []byte, hardware bool) (uint64, bool) {
+	if len(data) < int(unsafe.Sizeof(unix.ScmTimestamping{})) {
+		return 0, false
+	}
+	scm := (*unix.ScmTimestamping)(unsafe.Pointer(&data[0]))
+	// The middle one is deprecated and always zero
+	ts := scm.Ts[0]
+	if hardware {
+		ts = scm.Ts[2]
+	}
+	if ts.Sec == 0 && ts.Nsec == 0 {
+		return 0, false
+	}
+	return uint64(ts.Nano()), true
+}
+
+// KernelTimestamp extracts the kernel receive time, in nanoseconds, from the
+// oob data of a received packet. Returns false if there isn't one, such as
+// when timestamps weren't enabled with EnableTimestamps or
+// EnableTimestamping.
+//
+// This is the software timestamp, in the same clock as NowUint64, even if
+// there's a hardware one too. See HardwareTimestamp.
+func KernelTimestamp(oob []byte) (uint64, bool) {
+	return rxTimestamp(oob, false)
+}
+
+// HardwareTimestamp extracts the time, in nanoseconds, that the NIC received
+// a packet from its oob data. Returns false if there isn't one, such as when
+// hardware timestamps weren't enabled with EnableTimestamping.
+//
+// This is in the NIC's clock, so it can only be compared to a hardware
+// transmit timestamp from the same NIC.
+func HardwareTimestamp(oob []byte) (uint64, bool) {
+	return rxTimestamp(oob, true)
+}
+
+// rxTimestamp extracts the hardware or software receive time from oob.
+func rxTimestamp(oob []byte, hardware bool) (uint64, bool) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0, false
+	}
+	for _, msg := range msgs {
+		if msg.Header.Level != unix.SOL_SOCKET {
+			continue
+		}
+		switch msg.Header.Type {
+		case unix.SCM_TIMESTAMPNS:
+			if hardware ||
+				len(msg.Data) < int(unsafe.Sizeof(unix.Timespec{})) {
+				continue
+			}
+			ts := (*unix.Timespec)(unsafe.Pointer(&msg.Data[0]))
+			return uint64(ts.Nano()), true
+		case unix.SCM_TIMESTAMPING:
+			if ts, ok := scmTimestamp(msg.Data, hardware); ok {
+				return ts, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// TxTimestamp is the time, in nanoseconds, that a packet was sent, as
+// reported by the kernel.
+type TxTimestamp struct {
+	ID       uint32 // Counter of the packet since timestamps were enabled
+	Time     uint64
+	Hardware bool // If Time is from the NIC's clock, rather than software
+}
+
+// parseTxTimestamp extracts a TxTimestamp from the oob data of a message from
+// the socket error queue.
+func parseTxTimestamp(oob []byte) (TxTimestamp, bool) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return TxTimestamp{}, false
+	}
+	var stamp TxTimestamp
+	foundTime, foundID := false, false
+	for _, msg := range msgs {
+		h := msg.Header
+		switch {
+		case h.Level == unix.SOL_SOCKET && h.Type == unix.SCM_TIMESTAMPING:
+			// Each is one or the other
+			stamp.Time, foundTime = scmTimestamp(msg.Data, false)
+			if !foundTime {
+				stamp.Time, foundTime = scmTimestamp(msg.Data, true)
+				stamp.Hardware = foundTime
+			}
+		case (h.Level == unix.SOL_IP && h.Type == unix.IP_RECVERR) ||
+			(h.Level == unix.SOL_IPV6 && h.Type == unix.IPV6_RECVERR):
+			if len(msg.Data) < int(unsafe.Sizeof(unix.SockExtendedErr{})) {
+				continue
+			}
+			ee := (*unix.SockExtendedErr)(unsafe.Pointer(&msg.Data[0]))
+			if ee.Errno != uint32(unix.ENOMSG) ||
+				ee.Origin != unix.SO_EE_ORIGIN_TIMESTAMPING ||
+				ee.Info != unix.SCM_TSTAMP_SND {
+				continue
+			}
+			stamp.ID, foundID = ee.Data, true
+		}
+	}
+	return stamp, foundTime && foundID
+}
+
+// TxTimestamps reads all of the transmit timestamps currently waiting in the
+// provided conn's error queue, without blocking.
+//
+// Transmit timestamps must have been enabled with EnableTimestamping.
+func TxTimestamps(conn *net.UDPConn) ([]TxTimestamp, error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var stamps []TxTimestamp
+	var readErr error
+	data := make([]byte, 64)
+	oob := make([]byte, 512)
+	err = rawConn.Control(func(fd uintptr) {
+		for {
+			_, oobn, _, _, err := unix.Recvmsg(int(fd), data, oob,
+				unix.MSG_ERRQUEUE|unix.MSG_DONTWAIT)
+			if err == unix.EAGAIN || err == unix.EINTR {
+				return // Nothing left to read
+			} else if err != nil {
+				readErr = err
+				return
+			}
+			if stamp, ok := parseTxTimestamp(oob[:oobn]); ok {
+				stamps = append(stamps, stamp)
+			}
+		}
+	})
+	if err != nil {
+		return stamps, err
+	}
+	return stamps, readErr
+}
+
+// RcvdTime provides the receive time, in nanoseconds, for a packet with the
+// provided oob data based on the TimestampMode.
+func RcvdTime(oob []byte, mode TimestampMode) uint64 {
+	if mode != TimestampUserspace {
+		if ts, ok := KernelTimestamp(oob); ok {
+			return ts
+		}
+	}
+	return NowUint64()
 }
@@ -4,8 +4,10 @@ import (
 	"bytes"
 	"net"
 	"testing"
+	"time"
 
 	pb "github.com/nsw3550/udprobe/proto"
+	"golang.org/x/sys/unix"
 	"google.golang.org/protobuf/proto"
 )
 
@@ -51,11 +53,156 @@ func TestSetTos(t *testing.T) {
 	// Set the ToS value
 	tosVal := 240
 	newTos := byte(tosVal)
-	SetTos(conn, newTos)
+	err := SetTos(conn, newTos)
+	if err != nil {
+		t.Fatal("Failed to set ToS:", err)
+	}
 	// Verify the ToS value
-	val := GetTos(conn)
-	if val != newTos {
+	val, err := GetTos(conn)
+	if err != nil || val != newTos {
 		t.Error("New ToS value not set correctly. Set", tosVal, "and got",
 			val, "instead.")
 	}
 }
+
+func TestParseTimestampMode(t *testing.T) {
+	cases := map[string]TimestampMode{
+		"":          DefaultTimestampMode,
+		"kernel":    TimestampKernel,
+		"userspace": TimestampUserspace,
+		"software":  TimestampSoftware,
+		"hardware":  TimestampHardware,
+	}
+	for in, expected := range cases {
+		mode, err := ParseTimestampMode(in)
+		if err != nil || mode != expected {
+			t.Error("Incorrect mode for", in, "Got", mode, err, "expected",
+				expected)
+		}
+	}
+	if _, err := ParseTimestampMode("ptp"); err == nil {
+		t.Error("Expected an error for an unknown timestamp mode")
+	}
+}
+
+func TestKernelTimestamp(t *testing.T) {
+	addr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+	conn, _ := net.ListenUDP("udp", addr)
+	defer conn.Close()
+	EnableTimestamps(conn)
+	client, _ := net.DialUDP("udp", nil, conn.LocalAddr().(*net.UDPAddr))
+	defer client.Close()
+
+	before := NowUint64()
+	_, _ = client.Write([]byte("timestamp"))
+	data := make([]byte, 64)
+	oob := make([]byte, 64)
+	_, oobLen, _, _, err := conn.ReadMsgUDP(data, oob)
+	after := NowUint64()
+	if err != nil {
+		t.Fatal("Failed to read packet:", err)
+	}
+	ts, ok := KernelTimestamp(oob[:oobLen])
+	if !ok {
+		t.Fatal("Expected a kernel timestamp in the oob data")
+	}
+	if ts < before || ts > after {
+		t.Error("Kernel timestamp outside of send and receive. Got", ts,
+			"expected between", before, "and", after)
+	}
+	if RcvdTime(oob[:oobLen], TimestampKernel) != ts {
+		t.Error("RcvdTime didn't use the kernel timestamp")
+	}
+
+	// No oob data, so there's nothing to find
+	if _, ok := KernelTimestamp(nil); ok {
+		t.Error("Found a kernel timestamp without any oob data")
+	}
+	if RcvdTime(nil, TimestampKernel) < after {
+		t.Error("RcvdTime didn't fall back to userspace time")
+	}
+}
+
+func TestTxTimestamps(t *testing.T) {
+	addr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+	conn, _ := net.ListenUDP("udp", addr)
+	defer conn.Close()
+	EnableTimestamping(conn, false, true)
+	dst, _ := net.ListenUDP("udp", addr)
+	defer dst.Close()
+
+	before := NowUint64()
+	for i := 0; i < 3; i++ {
+		_, _ = conn.WriteToUDP([]byte("timestamp"), dst.LocalAddr().(*net.UDPAddr))
+	}
+	after := NowUint64()
+	// Loopback timestamps are immediate, but give it a moment anyways
+	var stamps []TxTimestamp
+	for i := 0; i < 10 && len(stamps) < 3; i++ {
+		more, err := TxTimestamps(conn)
+		if err != nil {
+			t.Fatal("Failed to read transmit timestamps:", err)
+		}
+		stamps = append(stamps, more...)
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(stamps) != 3 {
+		t.Fatal("Expected 3 transmit timestamps, got", len(stamps))
+	}
+	for i, stamp := range stamps {
+		if stamp.ID != uint32(i) {
+			t.Error("Incorrect transmit timestamp ID. Got", stamp.ID,
+				"expected", i)
+		}
+		if stamp.Time < before || stamp.Time > after {
+			t.Error("Transmit timestamp outside of sending. Got", stamp.Time,
+				"expected between", before, "and", after)
+		}
+	}
+	// Software receive timestamps come along too
+	data := make([]byte, 64)
+	oob := make([]byte, 512)
+	_, oobLen, _, _, err := dst.ReadMsgUDP(data, oob)
+	if err != nil {
+		t.Fatal("Failed to read packet:", err)
+	}
+	if _, ok := KernelTimestamp(oob[:oobLen]); ok {
+		t.Error("Found a receive timestamp without enabling them")
+	}
+	EnableTimestamping(dst, false, false)
+	_, _ = conn.WriteToUDP([]byte("timestamp"), dst.LocalAddr().(*net.UDPAddr))
+	_, oobLen, _, _, err = dst.ReadMsgUDP(data, oob)
+	if err != nil {
+		t.Fatal("Failed to read packet:", err)
+	}
+	if ts, ok := KernelTimestamp(oob[:oobLen]); !ok || ts < before {
+		t.Error("Expected a software receive timestamp after sending. Got",
+			ts, ok)
+	}
+}
+
+func TestSetTosIPv6(t *testing.T) {
+	addr, _ := net.ResolveUDPAddr("udp6", "[::1]:0")
+	conn, err := net.ListenUDP("udp6", addr)
+	if err != nil {
+		t.Skip("IPv6 not available:", err)
+	}
+	defer conn.Close()
+	family, v6only, err := SocketFamily(conn)
+	if err != nil || family != unix.AF_INET6 || !v6only {
+		t.Error("Expected an IPv6 only socket. Got", family, v6only, err)
+	}
+	SetTos(conn, 0xb8)
+	if tos, _ := GetTos(conn); tos != 0xb8 {
+		t.Error("IPv6 traffic class not set correctly. Got", tos)
+	}
+}
+
+func TestSocketFamily(t *testing.T) {
+	addr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:0")
+	conn, _ := net.ListenUDP("udp4", addr)
+	defer conn.Close()
+	if family, _, _ := SocketFamily(conn); family != unix.AF_INET {
+		t.Error("Expected an IPv4 socket. Got", family)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"log"
 	"net"
 	"os"
+	"sort"
 	"time"
 
 	"github.com/google/uuid"
@@ -11,14 +12,36 @@ import (
 )
 
 const (
-	// Listens on any addr to an automatically assigned port number
+	// Listens on any addr to an automatically assigned port number. With
+	// DefaultNetwork, that's both IPv4 and IPv6 where IPv6 is available.
 	DefaultAddrStr        = "0.0.0.0:0"
+	DefaultNetwork        = "udp"
 	DefaultTos            = byte(0)
 	DefaultRcvBuff        = 2097600 // 2MiB
 	DefaultReadTimeout    = 200 * time.Millisecond
 	DefaultCacheTimeout   = 2 * time.Second
 	DefaultCacheCleanRate = 5 * time.Second
+	DefaultTimestampMode  = TimestampKernel
+	DefaultStopTimeout    = 5 * time.Second // For components to exit once stopped
 	ExpireNow             = time.Nanosecond
+	// How often targets like hostnames are looked up again, and how long
+	// each lookup can take
+	DefaultDiscoveryInterval = 60 * time.Second
+	DefaultLookupTimeout     = 10 * time.Second
+	// For writing summaries to InfluxDB
+	DefaultInfluxBatchSize  = 5000 // Lines
+	DefaultInfluxRetries    = 3
+	DefaultInfluxTimeout    = 5 * time.Second
+	DefaultInfluxRetryDelay = time.Second
+	// How long to wait before reopening the raw results file or socket
+	DefaultRawRetryDelay = time.Second
+)
+
+// Used when percentiles or histogram buckets aren't provided in the
+// summarization config.
+var (
+	DefaultPercentiles = []float64{50, 90, 99, 99.9}
+	DefaultRTTBuckets  = []float64{0.5, 1, 2.5, 5, 10, 25, 50, 100, 250, 500, 1000}
 )
 
 // NewID returns 10 bytes of a new UUID4 as a string.
@@ -44,6 +67,9 @@ func NowUint64() uint64 {
 }
 
 // FileCloseHandler will close an open File and handle the resulting error.
+//
+// Deprecated: Socket options are set through SyscallConn, so there's no
+// longer a File from a net.Conn to close. Just close the File.
 func FileCloseHandler(f *os.File) {
 	// NOTE: This is required, specifically for sockets/net.Conn because it
 	// would appear that calls like setting the ToS value or enabling
@@ -99,7 +125,29 @@ func LogInfo(msg string) {
 
 // SetRecvBufferSize sets the size of the receive buffer for the conn to the
 // provided size in bytes.
-func SetRecvBufferSize(conn *net.UDPConn, size int) {
-	err := conn.SetReadBuffer(size)
-	HandleError(err)
+func SetRecvBufferSize(conn *net.UDPConn, size int) error {
+	return conn.SetReadBuffer(size)
+}
+
+// reportError passes a runtime error to errs, for whoever created the
+// component to decide what to do about it.
+//
+// This never blocks, so if errs is nil or full, the error is only logged.
+func reportError(errs chan error, err error) {
+	select {
+	case errs <- err:
+	default:
+		log.Output(2, "ERROR (unreported): "+err.Error())
+	}
+}
+
+// sortedKeys provides the keys of m in sorted order, for going through it the
+// same way every time.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
 }